@@ -0,0 +1,141 @@
+package alerts
+
+import (
+	"clothes/config"
+	"clothes/models"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Postgres channel inventory_transaction inserts notify
+const changeChannel = "inventory_changed"
+
+// Somewhere to tell people about low and out of stock sizes
+type Sink interface {
+	Name() string
+	Notify(ctx context.Context, alerts []models.StockAlert) error
+}
+
+// Builds the sinks named in the config
+func NewSinks(cfg config.Alerts) ([]Sink, error) {
+	sinks := []Sink{}
+	for _, name := range cfg.Sinks {
+		switch name {
+		case "log":
+			sinks = append(sinks, LogSink{})
+		case "webhook":
+			if cfg.WebhookURL == "" {
+				return nil, errors.New("the webhook alert sink needs a webhook url")
+			}
+			sinks = append(sinks, NewWebhookSink(cfg.WebhookURL))
+		case "email":
+			if len(cfg.EmailTo) == 0 {
+				return nil, errors.New("the email alert sink needs at least one address to send to")
+			}
+			sinks = append(sinks, EmailSink{To: cfg.EmailTo})
+		default:
+			return nil, fmt.Errorf("unknown alert sink %q, expected log, webhook or email", name)
+		}
+	}
+	return sinks, nil
+}
+
+/*
+Raises and resolves alerts for the current stock and hands new ones to every
+sink.  Alerts are only marked notified once every sink has taken them, so a
+failing sink is retried on the next scan, and the sinks that worked hear
+about them again.
+*/
+func Scan(ctx context.Context, sinks []Sink) error {
+	pending, err := models.ApiQuery[[]models.StockAlert](ctx, "stock_alerts_scan")
+	if err != nil {
+		return err
+	}
+	if len(*pending) == 0 {
+		return nil
+	}
+
+	var errs []error
+	for _, sink := range sinks {
+		if err := sink.Notify(ctx, *pending); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	ids := make([]int, len(*pending))
+	for i, alert := range *pending {
+		ids[i] = alert.ID
+	}
+	_, err = models.ApiQuery[any](ctx, "stock_alerts_notified", ids)
+	return err
+}
+
+// Scans whenever stock changes, and every interval in case a notification
+// was missed, until ctx is done
+func Run(ctx context.Context, sinks []Sink, interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+
+	wake := make(chan struct{}, 1)
+	go listen(ctx, wake)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := Scan(ctx, sinks); err != nil && ctx.Err() == nil {
+			slog.Error("Error scanning stock for alerts", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Holds a connection listening for inventory changes, reconnecting if it
+// drops
+func listen(ctx context.Context, wake chan<- struct{}) {
+	for ctx.Err() == nil {
+		if err := waitForChanges(ctx, wake); err != nil && ctx.Err() == nil {
+			slog.Warn("Lost the inventory change listener, retrying", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}
+}
+
+func waitForChanges(ctx context.Context, wake chan<- struct{}) error {
+	pooled, err := models.GetDb().Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// a connection that was listening should not go back to the pool
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+changeChannel); err != nil {
+		return err
+	}
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package alerts
+
+import (
+	"bytes"
+	"clothes/mail"
+	"clothes/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func describe(alert models.StockAlert) string {
+	name := alert.Item
+	if alert.Brand != nil {
+		name = *alert.Brand + " " + name
+	}
+	if alert.Size != nil {
+		name += " (" + *alert.Size + ")"
+	}
+	if alert.Level == "out" {
+		return name + " is out of stock"
+	}
+	return fmt.Sprintf("%s is down to %d, reorder at %d", name, alert.StockQuantity, alert.ReorderThreshold)
+}
+
+// Writes each alert to the server log
+type LogSink struct{}
+
+func (LogSink) Name() string { return "log" }
+
+func (LogSink) Notify(ctx context.Context, alerts []models.StockAlert) error {
+	for _, alert := range alerts {
+		slog.Warn("Stock alert: "+describe(alert), "item_id", alert.ItemID, "level", alert.Level, "stock_quantity", alert.StockQuantity)
+	}
+	return nil
+}
+
+// Posts {"alerts": [...]} to a URL and expects a 2xx back
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *WebhookSink) Name() string { return "webhook" }
+
+func (s *WebhookSink) Notify(ctx context.Context, alerts []models.StockAlert) error {
+	body, err := json.Marshal(map[string]any{"alerts": alerts})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Sends one email listing every alert from a scan
+type EmailSink struct {
+	To []string
+}
+
+func (EmailSink) Name() string { return "email" }
+
+func (s EmailSink) Notify(ctx context.Context, alerts []models.StockAlert) error {
+	subject := describe(alerts[0])
+	if len(alerts) > 1 {
+		subject = fmt.Sprintf("%d sizes are low on stock", len(alerts))
+	}
+
+	var body strings.Builder
+	for _, alert := range alerts {
+		fmt.Fprintf(&body, "- %s\n", describe(alert))
+	}
+	body.WriteString("\nSee /admin/stock for everything that is low right now.\n")
+
+	return mail.Send(s.To, subject, body.String())
+}
@@ -0,0 +1,328 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variable that points at an optional JSON config file
+const FileEnv = "CLOTHES_CONFIG"
+
+type Database struct {
+	// Any connection string pgx accepts, URL or key=value form
+	DSN               string   `json:"dsn"`
+	MaxConns          int32    `json:"max_conns"`
+	MinConns          int32    `json:"min_conns"`
+	MaxConnLifetime   Duration `json:"max_conn_lifetime"`
+	MaxConnIdleTime   Duration `json:"max_conn_idle_time"`
+	ConnectTimeout    Duration `json:"connect_timeout"`
+	StatementTimeout  Duration `json:"statement_timeout"`
+	SSLMode           string   `json:"ssl_mode"`
+	SSLRootCert       string   `json:"ssl_root_cert"`
+	SSLCert           string   `json:"ssl_cert"`
+	SSLKey            string   `json:"ssl_key"`
+	ApplicationName   string   `json:"application_name"`
+	HealthCheckPeriod Duration `json:"health_check_period"`
+}
+
+// A relay on the same host, or a local stand-in like Mailpit in development
+type SMTP struct {
+	Addr string `json:"addr"`
+	From string `json:"from"`
+	// When set, email is written here as .eml files instead of being sent
+	DropDir string `json:"drop_dir"`
+}
+
+type Alerts struct {
+	// Where low stock alerts go, any of log, webhook and email
+	Sinks      []string `json:"sinks"`
+	WebhookURL string   `json:"webhook_url"`
+	EmailTo    []string `json:"email_to"`
+	// How often stock is scanned when no inventory change wakes the job
+	ScanInterval Duration `json:"scan_interval"`
+}
+
+type Accounts struct {
+	// Signs links in email.  Left empty, a random key is made at startup and
+	// links sent before a restart stop working.
+	SecretKey string `json:"secret_key"`
+	// What users may do before verifying their email address, any of
+	// closets, checkout and rent
+	UnverifiedAllow []string `json:"unverified_allow"`
+}
+
+type RateLimit struct {
+	// Where rate limit buckets are kept, memory for a single server or
+	// postgres to share them between several
+	Store string `json:"store"`
+}
+
+type Config struct {
+	ListenAddr string `json:"listen_addr"`
+	// Addresses or CIDR ranges of reverse proxies in front of the server.
+	// Only requests from these have X-Forwarded-For believed.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Where the site is reached from outside, for links in email
+	PublicURL string `json:"public_url"`
+	// Where downloaded images and their resized variants are stored
+	ImageDir string `json:"image_dir"`
+	// Name of the payment provider used at checkout
+	PaymentProvider string    `json:"payment_provider"`
+	Database        Database  `json:"database"`
+	SMTP            SMTP      `json:"smtp"`
+	Alerts          Alerts    `json:"alerts"`
+	Accounts        Accounts  `json:"accounts"`
+	RateLimit       RateLimit `json:"rate_limit"`
+}
+
+// Wraps time.Duration so config files can use strings like "30s"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("duration must be a string like \"30s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func Default() Config {
+	return Config{
+		ListenAddr:      ":8080",
+		PublicURL:       "http://localhost:8080",
+		ImageDir:        "data/images",
+		PaymentProvider: "fake",
+		Database: Database{
+			DSN:             fmt.Sprintf("postgresql:///postgres?user=%s", os.Getenv("USER")),
+			MaxConns:        10,
+			ApplicationName: "clothes",
+		},
+		SMTP: SMTP{
+			Addr: "localhost:1025",
+			From: "Carousel <noreply@localhost>",
+		},
+		Alerts: Alerts{
+			Sinks:        []string{"log"},
+			ScanInterval: Duration{5 * time.Minute},
+		},
+		Accounts: Accounts{
+			UnverifiedAllow: []string{"closets"},
+		},
+		RateLimit: RateLimit{
+			Store: "memory",
+		},
+	}
+}
+
+// A single setting that can come from the environment or the command line
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func parseInt32(dst *int32) func(string) error {
+	return func(value string) error {
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		*dst = int32(n)
+		return nil
+	}
+}
+
+// Splits a comma separated list, dropping blanks
+func parseList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func parseDuration(dst *Duration) func(string) error {
+	return func(value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		dst.Duration = d
+		return nil
+	}
+}
+
+var settings = []setting{
+	{"addr", "CLOTHES_ADDR", "Address for the web server to listen on", func(c *Config, v string) error {
+		c.ListenAddr = v
+		return nil
+	}},
+	{"trusted-proxies", "CLOTHES_TRUSTED_PROXIES", "Comma separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For is believed", func(c *Config, v string) error {
+		c.TrustedProxies = parseList(v)
+		return nil
+	}},
+	{"public-url", "CLOTHES_PUBLIC_URL", "URL the site is reached at from outside, used in links in email", func(c *Config, v string) error {
+		c.PublicURL = v
+		return nil
+	}},
+	{"image-dir", "CLOTHES_IMAGE_DIR", "Directory downloaded images are stored in", func(c *Config, v string) error {
+		c.ImageDir = v
+		return nil
+	}},
+	{"payment-provider", "CLOTHES_PAYMENT_PROVIDER", "Payment provider used at checkout", func(c *Config, v string) error {
+		c.PaymentProvider = v
+		return nil
+	}},
+	{"db-dsn", "CLOTHES_DATABASE_URL", "Database connection string", func(c *Config, v string) error {
+		c.Database.DSN = v
+		return nil
+	}},
+	{"db-max-conns", "CLOTHES_DB_MAX_CONNS", "Maximum number of pooled database connections", func(c *Config, v string) error {
+		return parseInt32(&c.Database.MaxConns)(v)
+	}},
+	{"db-min-conns", "CLOTHES_DB_MIN_CONNS", "Minimum number of idle database connections kept open", func(c *Config, v string) error {
+		return parseInt32(&c.Database.MinConns)(v)
+	}},
+	{"db-max-conn-lifetime", "CLOTHES_DB_MAX_CONN_LIFETIME", "Maximum lifetime of a database connection (e.g. 1h)", func(c *Config, v string) error {
+		return parseDuration(&c.Database.MaxConnLifetime)(v)
+	}},
+	{"db-max-conn-idle-time", "CLOTHES_DB_MAX_CONN_IDLE_TIME", "Close database connections idle for longer than this (e.g. 30m)", func(c *Config, v string) error {
+		return parseDuration(&c.Database.MaxConnIdleTime)(v)
+	}},
+	{"db-connect-timeout", "CLOTHES_DB_CONNECT_TIMEOUT", "Timeout for establishing a database connection (e.g. 5s)", func(c *Config, v string) error {
+		return parseDuration(&c.Database.ConnectTimeout)(v)
+	}},
+	{"db-statement-timeout", "CLOTHES_DB_STATEMENT_TIMEOUT", "Abort any statement that takes longer than this (e.g. 30s)", func(c *Config, v string) error {
+		return parseDuration(&c.Database.StatementTimeout)(v)
+	}},
+	{"db-sslmode", "CLOTHES_DB_SSLMODE", "Database TLS mode (disable, prefer, require, verify-ca, verify-full)", func(c *Config, v string) error {
+		c.Database.SSLMode = v
+		return nil
+	}},
+	{"db-sslrootcert", "CLOTHES_DB_SSLROOTCERT", "CA certificate used to verify the database server", func(c *Config, v string) error {
+		c.Database.SSLRootCert = v
+		return nil
+	}},
+	{"db-sslcert", "CLOTHES_DB_SSLCERT", "Client certificate for the database connection", func(c *Config, v string) error {
+		c.Database.SSLCert = v
+		return nil
+	}},
+	{"db-sslkey", "CLOTHES_DB_SSLKEY", "Client key for the database connection", func(c *Config, v string) error {
+		c.Database.SSLKey = v
+		return nil
+	}},
+	{"smtp-addr", "CLOTHES_SMTP_ADDR", "SMTP server email is sent through (host:port)", func(c *Config, v string) error {
+		c.SMTP.Addr = v
+		return nil
+	}},
+	{"smtp-from", "CLOTHES_SMTP_FROM", "From address of email the site sends", func(c *Config, v string) error {
+		c.SMTP.From = v
+		return nil
+	}},
+	{"smtp-drop-dir", "CLOTHES_SMTP_DROP_DIR", "Write email to files in this directory instead of sending it", func(c *Config, v string) error {
+		c.SMTP.DropDir = v
+		return nil
+	}},
+	{"alert-sinks", "CLOTHES_ALERT_SINKS", "Comma separated list of where stock alerts go (log, webhook, email)", func(c *Config, v string) error {
+		c.Alerts.Sinks = parseList(v)
+		return nil
+	}},
+	{"alert-webhook-url", "CLOTHES_ALERT_WEBHOOK_URL", "URL stock alerts are posted to as JSON", func(c *Config, v string) error {
+		c.Alerts.WebhookURL = v
+		return nil
+	}},
+	{"alert-email-to", "CLOTHES_ALERT_EMAIL_TO", "Comma separated list of addresses stock alerts are emailed to", func(c *Config, v string) error {
+		c.Alerts.EmailTo = parseList(v)
+		return nil
+	}},
+	{"alert-scan-interval", "CLOTHES_ALERT_SCAN_INTERVAL", "How often stock is scanned when nothing changes it (e.g. 5m)", func(c *Config, v string) error {
+		return parseDuration(&c.Alerts.ScanInterval)(v)
+	}},
+	{"secret-key", "CLOTHES_SECRET_KEY", "Key links in email are signed with", func(c *Config, v string) error {
+		c.Accounts.SecretKey = v
+		return nil
+	}},
+	{"unverified-allow", "CLOTHES_UNVERIFIED_ALLOW", "Comma separated list of what users may do before verifying their email (closets, checkout, rent)", func(c *Config, v string) error {
+		c.Accounts.UnverifiedAllow = parseList(v)
+		return nil
+	}},
+	{"rate-limit-store", "CLOTHES_RATE_LIMIT_STORE", "Where rate limits are counted, memory or postgres to share them between servers", func(c *Config, v string) error {
+		c.RateLimit.Store = v
+		return nil
+	}},
+}
+
+// Registers a flag for every setting on fs.  Flags only override the
+// config file and environment when they are explicitly passed.
+func RegisterFlags(fs *flag.FlagSet) *string {
+	for _, s := range settings {
+		fs.String(s.flag, "", fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	return fs.String("config", "", fmt.Sprintf("Path to a JSON config file (env %s)", FileEnv))
+}
+
+// Builds the config from defaults, then the config file, then environment
+// variables, then any flags set on fs, with later sources taking priority.
+// fs must already be parsed.
+func Load(path string, fs *flag.FlagSet) (*Config, error) {
+	c := Default()
+
+	if path == "" {
+		path = os.Getenv(FileEnv)
+	}
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := json.Unmarshal(content, &c); err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(&c, v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", s.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	if fs != nil {
+		fs.Visit(func(f *flag.Flag) {
+			for _, s := range settings {
+				if s.flag == f.Name && flagErr == nil {
+					if err := s.set(&c, f.Value.String()); err != nil {
+						flagErr = fmt.Errorf("invalid -%s: %w", s.flag, err)
+					}
+				}
+			}
+		})
+	}
+	if flagErr != nil {
+		return nil, flagErr
+	}
+
+	return &c, nil
+}
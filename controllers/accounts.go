@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"clothes/mail"
+	"clothes/models"
+	"clothes/signing"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Where the site is reached from outside, for links in email.  Set from the
+// config at startup, never from the request's Host header, which the client
+// controls.
+var PublicURL = "http://localhost:8080"
+
+const emailVerificationPurpose = "email-verification"
+
+// How long a verification link works for
+const emailVerificationTTL = 7 * 24 * time.Hour
+
+// Things an account may be kept from until its email address is verified,
+// with how refusals describe them
+var verifiableActions = map[string]string{
+	"closets":  "make closets",
+	"checkout": "check out",
+	"rent":     "rent",
+}
+
+var unverifiedAllowed = map[string]bool{"closets": true}
+
+// Sets what unverified accounts may do, from the accounts config
+func AllowUnverified(actions []string) error {
+	allowed := map[string]bool{}
+	for _, action := range actions {
+		if _, ok := verifiableActions[action]; !ok {
+			return fmt.Errorf("unknown action %q for unverified accounts, expected closets, checkout or rent", action)
+		}
+		allowed[action] = true
+	}
+	unverifiedAllowed = allowed
+	return nil
+}
+
+// The message for an action siteUser is not yet allowed, empty when it is
+func verificationNeeded(siteUser models.SiteUser, action string) string {
+	if siteUser.EmailVerified || unverifiedAllowed[action] {
+		return ""
+	}
+	return fmt.Sprintf("Verify your email address to %s, we sent a link to %s", verifiableActions[action], siteUser.Email)
+}
+
+// For JSON endpoints, writes a 403 and returns false when siteUser has to
+// verify their email first
+func apiRequireVerified(w http.ResponseWriter, siteUser models.SiteUser, action string) bool {
+	if message := verificationNeeded(siteUser, action); message != "" {
+		http.Error(w, message, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+type emailVerificationClaims struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// Emails a signed link that verifies the address it is sent to.  Sending is
+// rate limited per account, the limit's message is returned as a user error.
+func sendEmailVerification(r *http.Request, username string) error {
+	verification, err := models.ApiQuery[models.EmailVerification](r.Context(), "email_verification_send", username)
+	if err != nil {
+		return err
+	}
+
+	token, err := signing.Sign(emailVerificationPurpose, emailVerificationClaims{
+		Username: verification.Username,
+		Email:    strings.ToLower(verification.Email),
+	}, time.Now().Add(emailVerificationTTL))
+	if err != nil {
+		return err
+	}
+
+	link := PublicURL + "/verify-email?" + url.Values{"token": {token}}.Encode()
+	body := fmt.Sprintf(`Hi %s,
+
+Follow this link to verify the email address on your Carousel account:
+
+%s
+
+The link works for a week.  If you did not sign up, you can ignore this
+email.
+`, verification.FirstName, link)
+
+	go func() {
+		if err := mail.Send([]string{verification.Email}, "Verify your Carousel email address", body); err != nil {
+			slog.Error("Error sending verification email", "error", err)
+		}
+	}()
+	return nil
+}
+
+// The token of the session the request was made with, empty without one
+func sessionToken(r *http.Request) string {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// A row of the signed in devices page
+type accountSession struct {
+	ID        int
+	Device    string
+	IPAddress string
+	SignedIn  string
+	LastSeen  string
+	Expires   string
+	Remember  bool
+	Current   bool
+}
+
+// Browser and platform names checked for in user agents, most specific
+// first since most browsers claim to be several others
+var (
+	userAgentBrowsers = []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"SamsungBrowser/", "Samsung Internet"},
+		{"Firefox/", "Firefox"},
+		{"FxiOS/", "Firefox"},
+		{"CriOS/", "Chrome"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+	userAgentPlatforms = []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"CrOS", "ChromeOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// A short name for the device behind a user agent, like "Firefox on Windows"
+func describeUserAgent(userAgent *string) string {
+	if userAgent == nil || *userAgent == "" {
+		return "Unknown device"
+	}
+
+	browser, platform := "", ""
+	for _, b := range userAgentBrowsers {
+		if strings.Contains(*userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, p := range userAgentPlatforms {
+		if strings.Contains(*userAgent, p.token) {
+			platform = p.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	}
+	return "Unknown browser"
+}
+
+// Emails a password reset link.  It runs in the background so how long the
+// request takes does not give away whether the account exists.
+func sendPasswordReset(reset *models.PasswordResetRequest) {
+	link := PublicURL + "/reset-password?" + url.Values{"token": {reset.Token}}.Encode()
+	body := fmt.Sprintf(`Hi %s,
+
+Someone asked to reset the password for your Carousel account.  Follow this
+link within the hour to choose a new one:
+
+%s
+
+If it was not you, you can ignore this email and your password will stay
+the same.
+`, reset.FirstName, link)
+
+	go func() {
+		if err := mail.Send([]string{reset.Email}, "Reset your Carousel password", body); err != nil {
+			slog.Error("Error sending password reset email", "error", err)
+		}
+	}()
+}
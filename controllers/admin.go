@@ -0,0 +1,809 @@
+package controllers
+
+import (
+	"clothes/images"
+	"clothes/inventory"
+	"clothes/models"
+	"clothes/views"
+	"clothes/views/widgets"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Matches the basic_size table
+var basicSizes = []string{"XS", "S", "M", "L", "XL", "XXL", "XXXL"}
+
+// Staff record stock changes by hand with these, reserve and release only
+// come from orders
+var manualTransactionEvents = []string{"audit", "ship-in", "ship-out", "scrap"}
+
+const maxImageUpload = 20 << 20
+
+const maxInventoryUpload = 5 << 20
+
+// Redirects back after a form post with an alert saying how it went
+func adminRedirect(w http.ResponseWriter, r *http.Request, target string, err error, success string) {
+	if err != nil {
+		message, ok := models.UserErrorMessage(err)
+		if !ok {
+			slog.Error("Error saving admin change", "path", r.URL.Path, "error", err)
+			message = "Error saving changes"
+		}
+		setAlert(w, widgets.AlertLevelDanger, message)
+	} else {
+		setAlert(w, widgets.AlertLevelSuccess, success)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func adminItemURL(id int) string {
+	return fmt.Sprintf("/admin/items/%d", id)
+}
+
+// The blank fields of the item form become nulls
+func saveAdminItem(r *http.Request, id *int) (int, error) {
+	var rating *float64
+	if value := strings.TrimSpace(r.FormValue("rating")); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid rating %q: %w", value, err)
+		}
+		rating = &parsed
+	}
+
+	tags := []string{}
+	for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	saved, err := models.ApiQuery[int](
+		r.Context(),
+		"admin_save_base_item",
+		id,
+		r.FormValue("name"),
+		r.FormValue("description"),
+		r.FormValue("brand"),
+		rating,
+		tags,
+		r.FormValue("discontinued") == "on",
+	)
+	if err != nil {
+		return 0, err
+	}
+	return *saved, nil
+}
+
+type adminImage struct {
+	models.AdminItemImage
+	Src string
+}
+
+// Item is nil on the new item form
+type adminItemPage struct {
+	Item              *models.AdminItem
+	Href              string
+	StoreHref         string
+	Brand             string
+	Tags              string
+	Brands            []models.AdminName
+	Images            []adminImage
+	Price             *widgets.Price
+	Sizes             []string
+	TransactionEvents []string
+}
+
+// The import form, and the report of the last file sent to it
+type adminInventoryPage struct {
+	Events   []string
+	Filename string
+	DryRun   bool
+	Result   *models.InventoryImport
+}
+
+func GetAdminServerMux() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		views.RenderPage("admin", w, NewPageData(w, r, "Back Office", nil))
+	})
+
+	mux.HandleFunc("GET /items", func(w http.ResponseWriter, r *http.Request) {
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+		query := r.URL.Query().Get("q")
+
+		items, err := models.ApiQuery[models.AdminItemList](r.Context(), "admin_base_items", query, page, 50)
+		if err != nil {
+			slog.Error("Error listing items", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		// r.URL has lost the /admin prefix, and the page links need it back
+		baseURL := *r.URL
+		baseURL.Path = "/admin/items"
+
+		type row struct {
+			models.AdminItemSummary
+			Href     string
+			ImageURL string
+		}
+		data := struct {
+			Query      string
+			TotalCount int
+			Items      []row
+			Pagination widgets.Pageination
+		}{
+			Query:      query,
+			TotalCount: items.TotalCount,
+			Pagination: widgets.Pageination{
+				CurrentPage: page,
+				TotalPages:  items.TotalPages,
+				BaseURL:     baseURL,
+			},
+		}
+		for _, item := range items.Items {
+			imageURL, _ := imageSources(item.ThumbnailUrl, item.ThumbnailHash)
+			if item.ThumbnailHash != "" {
+				imageURL = images.URL(item.ThumbnailHash, "thumb")
+			}
+			data.Items = append(data.Items, row{AdminItemSummary: item, Href: adminItemURL(item.ID), ImageURL: imageURL})
+		}
+
+		views.RenderPage("admin-items", w, NewPageData(w, r, "Items", data))
+	})
+
+	mux.HandleFunc("GET /items/new", func(w http.ResponseWriter, r *http.Request) {
+		brands, err := models.ApiQuery[[]models.AdminName](r.Context(), "admin_brands")
+		if err != nil {
+			slog.Error("Error listing brands", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		data := adminItemPage{Brands: *brands}
+
+		views.RenderPage("admin-item", w, NewPageData(w, r, "New Item", data))
+	})
+
+	mux.HandleFunc("POST /items/new", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+
+		id, err := saveAdminItem(r, nil)
+		if err != nil {
+			adminRedirect(w, r, "/admin/items/new", err, "")
+			return
+		}
+		adminRedirect(w, r, adminItemURL(id), nil, "Item created")
+	})
+
+	mux.HandleFunc("GET /items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+
+		item, err := models.ApiQuery[models.AdminItem](r.Context(), "admin_base_item", id)
+		if _, ok := models.UserErrorMessage(err); ok {
+			w.WriteHeader(http.StatusNotFound)
+			views.RenderPage("404", w, NewPageData(w, r, "Page Not Found", nil))
+			return
+		} else if err != nil {
+			slog.Error("Error getting item", "id", id, "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		brands, err := models.ApiQuery[[]models.AdminName](r.Context(), "admin_brands")
+		if err != nil {
+			slog.Error("Error listing brands", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		data := adminItemPage{
+			Item:              item,
+			Href:              adminItemURL(item.ID),
+			Tags:              strings.Join(item.Tags, ", "),
+			Brands:            *brands,
+			Price:             priceWidget(item.Price),
+			TransactionEvents: manualTransactionEvents,
+		}
+		if item.BrandName != nil {
+			data.Brand = *item.BrandName
+			data.StoreHref = strings.ToLower(fmt.Sprintf("/item/%s/%s", *item.BrandName, item.Name))
+		}
+		for _, img := range item.Images {
+			src, _ := imageSources(img.Url, img.ContentHash)
+			if img.ContentHash != "" {
+				src = images.URL(img.ContentHash, "thumb")
+			}
+			data.Images = append(data.Images, adminImage{AdminItemImage: img, Src: src})
+		}
+		for _, size := range basicSizes {
+			taken := false
+			for _, existing := range item.Sizes {
+				taken = taken || strings.EqualFold(existing.Size, size)
+			}
+			if !taken {
+				data.Sizes = append(data.Sizes, size)
+			}
+		}
+
+		views.RenderPage("admin-item", w, NewPageData(w, r, item.Name, data))
+	})
+
+	mux.HandleFunc("POST /items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+
+		_, err = saveAdminItem(r, &id)
+		adminRedirect(w, r, adminItemURL(id), err, "Item saved")
+	})
+
+	mux.HandleFunc("POST /items/{id}/sizes", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+
+		size := r.FormValue("size")
+		_, err = models.ApiQuery[int](r.Context(), "admin_add_base_item_size", id, size)
+		adminRedirect(w, r, adminItemURL(id), err, fmt.Sprintf("Size %s added", size))
+	})
+
+	// Takes either an uploaded file, which is stored like scraped images,
+	// or the url of an image hosted elsewhere
+	mux.HandleFunc("POST /items/{id}/images", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+		if err := r.ParseMultipartForm(maxImageUpload); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+
+		imageURL := strings.TrimSpace(r.FormValue("url"))
+		file, _, err := r.FormFile("file")
+		if err == nil {
+			defer file.Close()
+			data, err := io.ReadAll(io.LimitReader(file, maxImageUpload))
+			if err != nil {
+				http.Error(w, "Error reading upload", http.StatusBadRequest)
+				return
+			}
+
+			// uploads have no url of their own, the same file always gets the same one
+			sum := sha256.Sum256(data)
+			imageURL = "upload:" + hex.EncodeToString(sum[:])
+			if _, err := images.Save(r.Context(), models.GetDb(), imageURL, data); err != nil {
+				slog.Error("Error saving uploaded image", "error", err)
+				setAlert(w, widgets.AlertLevelDanger, "That file could not be read as an image")
+				http.Redirect(w, r, adminItemURL(id), http.StatusSeeOther)
+				return
+			}
+		}
+
+		_, err = models.ApiQuery[string](r.Context(), "admin_add_base_item_image", id, imageURL, r.FormValue("alt"))
+		adminRedirect(w, r, adminItemURL(id), err, "Image added")
+	})
+
+	mux.HandleFunc("POST /items/{id}/images/{image_id}/thumbnail", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+		imageID, err := strconv.Atoi(r.PathValue("image_id"))
+		if err != nil {
+			http.Error(w, "Invalid image id", http.StatusBadRequest)
+			return
+		}
+
+		_, err = models.ApiQuery[string](r.Context(), "admin_set_base_item_thumbnail", id, imageID)
+		adminRedirect(w, r, adminItemURL(id), err, "Thumbnail changed")
+	})
+
+	mux.HandleFunc("POST /items/{id}/images/{image_id}/delete", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+		imageID, err := strconv.Atoi(r.PathValue("image_id"))
+		if err != nil {
+			http.Error(w, "Invalid image id", http.StatusBadRequest)
+			return
+		}
+
+		_, err = models.ApiQuery[string](r.Context(), "admin_remove_base_item_image", id, imageID)
+		adminRedirect(w, r, adminItemURL(id), err, "Image removed")
+	})
+
+	mux.HandleFunc("POST /items/{id}/transactions", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		itemID, err := strconv.Atoi(r.FormValue("item_id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+		quantity, err := strconv.Atoi(r.FormValue("quantity"))
+		if err != nil {
+			setAlert(w, widgets.AlertLevelDanger, "Quantity must be a whole number")
+			http.Redirect(w, r, adminItemURL(id), http.StatusSeeOther)
+			return
+		}
+
+		event := r.FormValue("event")
+		_, err = models.ApiQuery[string](r.Context(), "transaction", event, itemID, quantity)
+		adminRedirect(w, r, adminItemURL(id), err, fmt.Sprintf("Recorded %s of %d", event, quantity))
+	})
+
+	mux.HandleFunc("GET /items/{id}/ledger", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+
+		item, err := models.ApiQuery[models.AdminItem](r.Context(), "admin_base_item", id)
+		if _, ok := models.UserErrorMessage(err); ok {
+			w.WriteHeader(http.StatusNotFound)
+			views.RenderPage("404", w, NewPageData(w, r, "Page Not Found", nil))
+			return
+		} else if err != nil {
+			slog.Error("Error getting item", "id", id, "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		ledger, err := models.ApiQuery[[]models.LedgerEntry](r.Context(), "admin_item_ledger", id)
+		if err != nil {
+			slog.Error("Error getting ledger", "id", id, "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		type entry struct {
+			models.LedgerEntry
+			Date string
+		}
+		data := struct {
+			Item    *models.AdminItem
+			Href    string
+			Entries []entry
+		}{
+			Item: item,
+			Href: adminItemURL(item.ID),
+		}
+		for _, e := range *ledger {
+			data.Entries = append(data.Entries, entry{LedgerEntry: e, Date: formatDate(e.TransactionDate)})
+		}
+
+		views.RenderPage("admin-ledger", w, NewPageData(w, r, "Ledger: "+item.Name, data))
+	})
+
+	mux.HandleFunc("GET /brands", func(w http.ResponseWriter, r *http.Request) {
+		brands, err := models.ApiQuery[[]models.AdminName](r.Context(), "admin_brands")
+		if err != nil {
+			slog.Error("Error listing brands", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Kind   string
+			Href   string
+			Names  []models.AdminName
+			Delete bool
+		}{
+			Kind:  "Brand",
+			Href:  "/admin/brands",
+			Names: *brands,
+		}
+
+		views.RenderPage("admin-names", w, NewPageData(w, r, "Brands", data))
+	})
+
+	mux.HandleFunc("POST /brands", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+
+		name := r.FormValue("name")
+		_, err := models.ApiQuery[string](r.Context(), "admin_save_brand", nil, name)
+		adminRedirect(w, r, "/admin/brands", err, fmt.Sprintf("Brand '%s' created", name))
+	})
+
+	mux.HandleFunc("POST /brands/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid brand id", http.StatusBadRequest)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+
+		name := r.FormValue("name")
+		_, err = models.ApiQuery[string](r.Context(), "admin_save_brand", id, name)
+		adminRedirect(w, r, "/admin/brands", err, fmt.Sprintf("Brand renamed to '%s'", name))
+	})
+
+	mux.HandleFunc("GET /tags", func(w http.ResponseWriter, r *http.Request) {
+		tags, err := models.ApiQuery[[]models.AdminName](r.Context(), "admin_tags")
+		if err != nil {
+			slog.Error("Error listing tags", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		data := struct {
+			Kind   string
+			Href   string
+			Names  []models.AdminName
+			Delete bool
+		}{
+			Kind:   "Tag",
+			Href:   "/admin/tags",
+			Names:  *tags,
+			Delete: true,
+		}
+
+		views.RenderPage("admin-names", w, NewPageData(w, r, "Tags", data))
+	})
+
+	mux.HandleFunc("POST /tags", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+
+		name := r.FormValue("name")
+		_, err := models.ApiQuery[string](r.Context(), "admin_save_tag", nil, name)
+		adminRedirect(w, r, "/admin/tags", err, fmt.Sprintf("Tag '%s' created", name))
+	})
+
+	mux.HandleFunc("POST /tags/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid tag id", http.StatusBadRequest)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+
+		name := r.FormValue("name")
+		_, err = models.ApiQuery[string](r.Context(), "admin_save_tag", id, name)
+		adminRedirect(w, r, "/admin/tags", err, fmt.Sprintf("Tag renamed to '%s'", name))
+	})
+
+	mux.HandleFunc("POST /tags/{id}/delete", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid tag id", http.StatusBadRequest)
+			return
+		}
+
+		_, err = models.ApiQuery[string](r.Context(), "admin_delete_tag", id)
+		adminRedirect(w, r, "/admin/tags", err, "Tag deleted")
+	})
+
+	mux.HandleFunc("GET /inventory", func(w http.ResponseWriter, r *http.Request) {
+		data := adminInventoryPage{Events: manualTransactionEvents}
+		views.RenderPage("admin-inventory", w, NewPageData(w, r, "Inventory", data))
+	})
+
+	// Renders the per-row report directly rather than redirecting, so a dry
+	// run can be read over before the same file is imported for real
+	mux.HandleFunc("POST /inventory/import", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(maxInventoryUpload); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			setAlert(w, widgets.AlertLevelDanger, "Choose a CSV file to import")
+			http.Redirect(w, r, "/admin/inventory", http.StatusSeeOther)
+			return
+		}
+		defer file.Close()
+
+		rows, err := inventory.ReadCSV(io.LimitReader(file, maxInventoryUpload), r.FormValue("event"))
+		if err != nil {
+			setAlert(w, widgets.AlertLevelDanger, fmt.Sprintf("Could not read %s: %s", header.Filename, err))
+			http.Redirect(w, r, "/admin/inventory", http.StatusSeeOther)
+			return
+		}
+
+		dryRun := r.FormValue("dry_run") != ""
+		result, err := inventory.Import(r.Context(), rows, dryRun)
+		if err != nil {
+			adminRedirect(w, r, "/admin/inventory", err, "")
+			return
+		}
+
+		data := adminInventoryPage{
+			Events:   manualTransactionEvents,
+			Filename: header.Filename,
+			DryRun:   dryRun,
+			Result:   result,
+		}
+		views.RenderPage("admin-inventory", w, NewPageData(w, r, "Inventory", data))
+	})
+
+	mux.HandleFunc("GET /inventory/export.csv", func(w http.ResponseWriter, r *http.Request) {
+		levels, err := inventory.Export(r.Context())
+		if err != nil {
+			slog.Error("Error exporting inventory", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="inventory.csv"`)
+		if err := inventory.WriteCSV(w, levels); err != nil {
+			slog.Error("Error writing inventory csv", "error", err)
+		}
+	})
+
+	mux.HandleFunc("GET /inventory/export.json", func(w http.ResponseWriter, r *http.Request) {
+		levels, err := inventory.Export(r.Context())
+		if err != nil {
+			slog.Error("Error exporting inventory", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Disposition", `attachment; filename="inventory.json"`)
+		writeJSON(w, levels)
+	})
+
+	mux.HandleFunc("GET /stock", func(w http.ResponseWriter, r *http.Request) {
+		low, err := models.ApiQuery[[]models.StockAlert](r.Context(), "admin_low_stock")
+		if err != nil {
+			slog.Error("Error listing low stock", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		type row struct {
+			models.StockAlert
+			Href   string
+			Raised string
+		}
+		data := struct {
+			Rows     []row
+			OutCount int
+		}{}
+		for _, alert := range *low {
+			entry := row{StockAlert: alert, Href: adminItemURL(alert.BaseItemID)}
+			if alert.RaisedAt != nil {
+				entry.Raised = formatDate(*alert.RaisedAt)
+			}
+			if alert.Level == "out" {
+				data.OutCount++
+			}
+			data.Rows = append(data.Rows, entry)
+		}
+
+		views.RenderPage("admin-stock", w, NewPageData(w, r, "Low Stock", data))
+	})
+
+	// Posted from the stock dashboard and the item page, back goes to
+	// whichever it came from
+	mux.HandleFunc("POST /stock/{item_id}/threshold", func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := strconv.Atoi(r.PathValue("item_id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		back := r.FormValue("back")
+		if !strings.HasPrefix(back, "/admin/") {
+			back = "/admin/stock"
+		}
+		threshold, err := strconv.Atoi(r.FormValue("reorder_threshold"))
+		if err != nil {
+			setAlert(w, widgets.AlertLevelDanger, "The reorder threshold must be a whole number")
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+
+		_, err = models.ApiQuery[any](r.Context(), "admin_set_reorder_threshold", itemID, threshold)
+		adminRedirect(w, r, back, err, fmt.Sprintf("Reorder threshold set to %d", threshold))
+	})
+
+	mux.HandleFunc("GET /rentals", func(w http.ResponseWriter, r *http.Request) {
+		rentals, err := models.ApiQuery[[]models.AdminRental](r.Context(), "admin_open_rentals")
+		if err != nil {
+			slog.Error("Error listing open rentals", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		type row struct {
+			models.AdminRental
+			Rented string
+			Due    string
+		}
+		data := struct {
+			Rows           []row
+			ReturningCount int
+			OverdueCount   int
+		}{}
+		for _, rental := range *rentals {
+			data.Rows = append(data.Rows, row{AdminRental: rental, Rented: formatDate(rental.RentedAt), Due: formatDate(rental.DueAt)})
+			if rental.Status == "returning" {
+				data.ReturningCount++
+			}
+			if rental.Overdue {
+				data.OverdueCount++
+			}
+		}
+
+		views.RenderPage("admin-rentals", w, NewPageData(w, r, "Rentals", data))
+	})
+
+	// A check in puts the item back in stock, a lost rental stays out of it
+	rentalActions := map[string]struct {
+		apiFunction string
+		success     string
+	}{
+		"check-in": {"rental_check_in", "Rental checked in"},
+		"lost":     {"rental_mark_lost", "Rental marked lost"},
+	}
+	mux.HandleFunc("POST /rentals/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		action, ok := rentalActions[r.PathValue("action")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		rentalID, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid rental id", http.StatusBadRequest)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+
+		_, err = models.ApiQuery[any](r.Context(), action.apiFunction, rentalID, r.FormValue("condition_note"))
+		adminRedirect(w, r, "/admin/rentals", err, action.success)
+	})
+
+	mux.HandleFunc("GET /orders", func(w http.ResponseWriter, r *http.Request) {
+		orders, err := models.ApiQuery[[]models.AdminOrder](r.Context(), "admin_orders_to_fulfil")
+		if err != nil {
+			slog.Error("Error listing orders to fulfil", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		type row struct {
+			widgets.Order
+			Username string
+			Email    string
+		}
+		data := struct {
+			Rows []row
+		}{}
+		for _, order := range *orders {
+			data.Rows = append(data.Rows, row{Order: orderWidget(order.Order), Username: order.Username, Email: order.Email})
+		}
+
+		views.RenderPage("admin-orders", w, NewPageData(w, r, "Orders", data))
+	})
+
+	// Shipping turns the order's reservations into ship-outs
+	mux.HandleFunc("POST /orders/{number}/fulfil", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+
+		var note *string
+		if value := strings.TrimSpace(r.FormValue("note")); value != "" {
+			note = &value
+		}
+		number := r.PathValue("number")
+		_, err := models.ApiQuery[models.Order](r.Context(), "order_set_status", number, "fulfilled", note)
+		adminRedirect(w, r, "/admin/orders", err, fmt.Sprintf("Order %s fulfilled", number))
+	})
+
+	// who signed in from where is for admins only, not all staff
+	mux.Handle("GET /auth-events", requireRoleMiddleware(roleAdmin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		event := r.URL.Query().Get("event")
+
+		events, err := models.ApiQuery[models.AuthEventList](r.Context(), "admin_auth_events", query, event, page, 50)
+		if err != nil {
+			slog.Error("Error listing auth events", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		// r.URL has lost the /admin prefix, and the page links need it back
+		baseURL := *r.URL
+		baseURL.Path = "/admin/auth-events"
+
+		type row struct {
+			models.AuthEvent
+			Date   string
+			Device string
+		}
+		data := struct {
+			Query      string
+			Event      string
+			Events     []string
+			TotalCount int
+			Rows       []row
+			Pagination widgets.Pageination
+		}{
+			Query:      query,
+			Event:      event,
+			Events:     authEvents,
+			TotalCount: events.TotalCount,
+			Pagination: widgets.Pageination{
+				CurrentPage: page,
+				TotalPages:  events.TotalPages,
+				BaseURL:     baseURL,
+			},
+		}
+		for _, e := range events.Events {
+			data.Rows = append(data.Rows, row{AuthEvent: e, Date: formatDateTime(e.CreatedAt), Device: describeUserAgent(e.UserAgent)})
+		}
+
+		views.RenderPage("admin-auth-events", w, NewPageData(w, r, "Sign In Log", data))
+	})))
+
+	return authenticateMiddleware(requireRoleMiddleware(roleStaff, mux))
+}
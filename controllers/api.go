@@ -4,11 +4,36 @@ import (
 	"clothes/models"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
+func writeJSON(w http.ResponseWriter, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, "Error serializing response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// Stock problems and the like are the client's to fix, anything else is ours
+func userError(w http.ResponseWriter, err error, message string) {
+	if userMessage, ok := models.UserErrorMessage(err); ok {
+		http.Error(w, userMessage, http.StatusConflict)
+		return
+	}
+	slog.Error(message, "error", err)
+	http.Error(w, message, http.StatusInternalServerError)
+}
+
 func GetApiMux() http.Handler {
 	mux := http.NewServeMux()
+	mux.Handle("/v1/", http.StripPrefix("/v1", GetApiV1Mux()))
 
 	mux.HandleFunc("GET /user/closets", func(w http.ResponseWriter, r *http.Request) {
 		siteUser, err := getSession(w, r)
@@ -49,6 +74,9 @@ func GetApiMux() http.Handler {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		if !apiRequireVerified(w, *siteUser, "closets") {
+			return
+		}
 		_, err = models.ApiQuery[string](r.Context(), "site_user_add_closet", siteUser.Username, info.ClosetName)
 		if err != nil {
 			fmt.Println(err)
@@ -103,6 +131,9 @@ func GetApiMux() http.Handler {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		if !apiRequireVerified(w, *siteUser, "closets") {
+			return
+		}
 		_, err = models.ApiQuery[string](r.Context(), "site_user_add_item_to_closet", siteUser.Username, info.ClosetName, info.Item, info.Brand)
 		if err != nil {
 			fmt.Println(err)
@@ -113,6 +144,312 @@ func GetApiMux() http.Handler {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	mux.HandleFunc("POST /user/closets/rent", func(w http.ResponseWriter, r *http.Request) {
+		var info struct {
+			ClosetName string `json:"closet_name"`
+			Size       string `json:"size"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&info); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		siteUser, err := getSession(w, r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !apiRequireVerified(w, *siteUser, "rent") {
+			return
+		}
+		result, err := models.ApiQuery[models.ClosetRental](r.Context(), "rent_from_closet", siteUser.Username, info.ClosetName, info.Size)
+		if err != nil {
+			userError(w, err, "Error renting from closet")
+			return
+		}
+
+		writeJSON(w, result)
+	})
+
+	mux.HandleFunc("GET /rental_plans", func(w http.ResponseWriter, r *http.Request) {
+		plans, err := models.ApiQuery[[]models.RentalPlan](r.Context(), "rental_plans")
+		if err != nil {
+			slog.Error("Error getting rental plans", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, plans)
+	})
+
+	mux.HandleFunc("GET /user/rentals", func(w http.ResponseWriter, r *http.Request) {
+		siteUser, err := getSession(w, r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		rentals, err := models.ApiQuery[models.SiteUserRentals](r.Context(), "site_user_get_rentals", siteUser.Username)
+		if err != nil {
+			slog.Error("Error getting rentals", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, rentals)
+	})
+
+	mux.HandleFunc("POST /user/subscription", func(w http.ResponseWriter, r *http.Request) {
+		var info struct {
+			Plan string `json:"plan"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&info); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		siteUser, err := getSession(w, r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !apiRequireVerified(w, *siteUser, "rent") {
+			return
+		}
+		rentals, err := models.ApiQuery[models.SiteUserRentals](r.Context(), "site_user_subscribe", siteUser.Username, info.Plan)
+		if err != nil {
+			userError(w, err, "Error updating subscription")
+			return
+		}
+
+		writeJSON(w, rentals)
+	})
+
+	mux.HandleFunc("DELETE /user/subscription", func(w http.ResponseWriter, r *http.Request) {
+		siteUser, err := getSession(w, r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rentals, err := models.ApiQuery[models.SiteUserRentals](r.Context(), "site_user_cancel_subscription", siteUser.Username)
+		if err != nil {
+			userError(w, err, "Error cancelling subscription")
+			return
+		}
+
+		writeJSON(w, rentals)
+	})
+
+	mux.HandleFunc("POST /user/rentals", func(w http.ResponseWriter, r *http.Request) {
+		var info struct {
+			Brand string `json:"brand"`
+			Item  string `json:"item"`
+			Size  string `json:"size"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&info); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		siteUser, err := getSession(w, r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !apiRequireVerified(w, *siteUser, "rent") {
+			return
+		}
+		rental, err := models.ApiQuery[models.Rental](r.Context(), "rent_item", siteUser.Username, info.Item, info.Brand, info.Size)
+		if err != nil {
+			userError(w, err, "Error renting item")
+			return
+		}
+
+		writeJSON(w, rental)
+	})
+
+	mux.HandleFunc("POST /user/rentals/{rental_id}/return", func(w http.ResponseWriter, r *http.Request) {
+		rentalID, err := strconv.Atoi(r.PathValue("rental_id"))
+		if err != nil {
+			http.Error(w, "Invalid rental id", http.StatusBadRequest)
+			return
+		}
+
+		siteUser, err := getSession(w, r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rental, err := models.ApiQuery[models.Rental](r.Context(), "rental_start_return", siteUser.Username, rentalID)
+		if err != nil {
+			userError(w, err, "Error returning item")
+			return
+		}
+
+		writeJSON(w, rental)
+	})
+
+	mux.HandleFunc("POST /user/rentals/{rental_id}/swap", func(w http.ResponseWriter, r *http.Request) {
+		rentalID, err := strconv.Atoi(r.PathValue("rental_id"))
+		if err != nil {
+			http.Error(w, "Invalid rental id", http.StatusBadRequest)
+			return
+		}
+
+		var info struct {
+			Brand string `json:"brand"`
+			Item  string `json:"item"`
+			Size  string `json:"size"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&info); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		siteUser, err := getSession(w, r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !apiRequireVerified(w, *siteUser, "rent") {
+			return
+		}
+		rental, err := models.ApiQuery[models.Rental](r.Context(), "rental_swap", siteUser.Username, rentalID, info.Item, info.Brand, info.Size)
+		if err != nil {
+			userError(w, err, "Error swapping item")
+			return
+		}
+
+		writeJSON(w, rental)
+	})
+
+	mux.HandleFunc("GET /user/orders", func(w http.ResponseWriter, r *http.Request) {
+		siteUser, err := getSession(w, r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		orders, err := models.ApiQuery[[]models.Order](r.Context(), "site_user_get_orders", siteUser.Username)
+		if err != nil {
+			slog.Error("Error getting orders", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, orders)
+	})
+
+	mux.HandleFunc("GET /cart", func(w http.ResponseWriter, r *http.Request) {
+		username, cartToken := cartOwner(w, r)
+		cart, err := models.ApiQuery[models.Cart](r.Context(), "cart_get", username, cartToken)
+		if err != nil {
+			slog.Error("Error getting cart", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, cart)
+	})
+
+	mux.HandleFunc("POST /cart/items", func(w http.ResponseWriter, r *http.Request) {
+		var info struct {
+			Brand    string `json:"brand"`
+			Item     string `json:"item"`
+			Size     string `json:"size"`
+			Quantity int    `json:"quantity"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&info); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if info.Quantity == 0 {
+			info.Quantity = 1
+		}
+
+		username, cartToken := cartOwner(w, r)
+		cart, err := models.ApiQuery[models.Cart](r.Context(), "cart_add_item", username, cartToken, info.Item, info.Brand, info.Size, info.Quantity)
+		if err != nil {
+			userError(w, err, "Error updating cart")
+			return
+		}
+
+		rememberCart(w, r, cart)
+		writeJSON(w, cart)
+	})
+
+	mux.HandleFunc("PATCH /cart/items/{item_id}", func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := strconv.Atoi(r.PathValue("item_id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+
+		var info struct {
+			Quantity int `json:"quantity"`
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&info); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		username, cartToken := cartOwner(w, r)
+		cart, err := models.ApiQuery[models.Cart](r.Context(), "cart_set_quantity", username, cartToken, itemID, info.Quantity)
+		if err != nil {
+			userError(w, err, "Error updating cart")
+			return
+		}
+
+		writeJSON(w, cart)
+	})
+
+	mux.HandleFunc("DELETE /cart/items/{item_id}", func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := strconv.Atoi(r.PathValue("item_id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+
+		username, cartToken := cartOwner(w, r)
+		cart, err := models.ApiQuery[models.Cart](r.Context(), "cart_set_quantity", username, cartToken, itemID, 0)
+		if err != nil {
+			userError(w, err, "Error updating cart")
+			return
+		}
+
+		writeJSON(w, cart)
+	})
+
+	mux.HandleFunc("GET /browse/{top_level_tag}", func(w http.ResponseWriter, r *http.Request) {
+		tags := append(r.URL.Query()["tag"], r.PathValue("top_level_tag"))
+		writeBrowseCursor(w, r, tags, "")
+	})
+
+	mux.HandleFunc("GET /clothes", func(w http.ResponseWriter, r *http.Request) {
+		writeBrowseCursor(w, r, nil, "")
+	})
+
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if query == "" {
+			http.Error(w, "Enter something to search for", http.StatusBadRequest)
+			return
+		}
+		writeBrowseCursor(w, r, nil, query)
+	})
+
 	mux.HandleFunc("GET /search_bar", func(w http.ResponseWriter, r *http.Request) {
 		// TODO
 		input := r.URL.Query().Get("input")
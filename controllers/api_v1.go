@@ -0,0 +1,260 @@
+package controllers
+
+import (
+	"clothes/models"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Every error from /api/v1 has this shape, whatever the status
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	data, err := json.Marshal(apiError{Error: apiErrorBody{
+		Status:  status,
+		Code:    strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"),
+		Message: message,
+	}})
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+type apiParam struct {
+	Name        string
+	In          string // path or query
+	Type        string // string, integer, number or boolean
+	Description string
+	Required    bool
+	Repeated    bool
+}
+
+/*
+One /api/v1 endpoint.  The same table registers the handlers and builds the
+OpenAPI document, so the document cannot list a route that is not served.
+Response is a value of the type the handler writes on success, used only for
+its schema.
+*/
+type apiRoute struct {
+	Method      string
+	Path        string
+	OperationID string
+	Summary     string
+	Params      []apiParam
+	Response    any
+	Handler     http.HandlerFunc
+}
+
+// Filters shared by the listing endpoints, the same ones the browse sidebar sets
+var apiFilterParams = []apiParam{
+	{Name: "brand", In: "query", Type: "string", Repeated: true, Description: "Only items from these brands"},
+	{Name: "size", In: "query", Type: "string", Repeated: true, Description: "Only items in stock in one of these sizes"},
+	{Name: "in_stock", In: "query", Type: "boolean", Description: "Only items with some size in stock"},
+	{Name: "min_rating", In: "query", Type: "number", Description: "Lowest rating, out of 5"},
+	{Name: "min_price", In: "query", Type: "number", Description: "Lowest current price"},
+	{Name: "max_price", In: "query", Type: "number", Description: "Highest current price"},
+	{Name: "sort", In: "query", Type: "string", Description: "newest, popular, rating, price-low, price-high or name.  Left out, catalogue order, or best match first with q"},
+}
+
+type apiItems struct {
+	Page    int `json:"page"`
+	PerPage int `json:"per_page"`
+	models.Browse
+}
+
+func apiV1Routes() []apiRoute {
+	return []apiRoute{
+		{
+			Method:      "GET",
+			Path:        "/items",
+			OperationID: "listItems",
+			Summary:     "Items in the catalogue, a page at a time, with facet counts",
+			Params: append([]apiParam{
+				{Name: "page", In: "query", Type: "integer", Description: "Page number, from 1"},
+				{Name: "per_page", In: "query", Type: "integer", Description: "Items per page, 1 to 100, 20 by default"},
+				{Name: "tag", In: "query", Type: "string", Repeated: true, Description: "Only items with all of these tags"},
+				{Name: "q", In: "query", Type: "string", Description: "Only items matching this search"},
+			}, apiFilterParams...),
+			Response: apiItems{},
+			Handler:  apiListItems,
+		},
+		{
+			Method:      "GET",
+			Path:        "/items/{brand}/{item}",
+			OperationID: "getItem",
+			Summary:     "One item with its sizes, prices and similar items",
+			Params: []apiParam{
+				{Name: "brand", In: "path", Type: "string", Required: true},
+				{Name: "item", In: "path", Type: "string", Required: true},
+			},
+			Response: models.Detail{},
+			Handler:  apiGetItem,
+		},
+		{
+			Method:      "GET",
+			Path:        "/brands",
+			OperationID: "listBrands",
+			Summary:     "Every brand name, grouped by initial",
+			Response:    models.Brands{},
+			Handler:     apiListBrands,
+		},
+		{
+			Method:      "GET",
+			Path:        "/tags",
+			OperationID: "listTags",
+			Summary:     "Every tag with how many items carry it",
+			Response:    []models.Tag{},
+			Handler:     apiListTags,
+		},
+		{
+			Method:      "GET",
+			Path:        "/openapi.json",
+			OperationID: "getOpenAPI",
+			Summary:     "This document",
+			Response:    map[string]any{},
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, OpenAPIDocument())
+			},
+		},
+	}
+}
+
+// The public catalogue api.  Anything added here should keep working for
+// existing clients, breaking changes go in a new version.
+func GetApiV1Mux() http.Handler {
+	mux := http.NewServeMux()
+	methods := map[string][]string{}
+	paths := []string{}
+	for _, route := range apiV1Routes() {
+		mux.HandleFunc(route.Method+" "+route.Path, route.Handler)
+		if _, ok := methods[route.Path]; !ok {
+			paths = append(paths, route.Path)
+		}
+		methods[route.Path] = append(methods[route.Path], route.Method)
+		if route.Method == http.MethodGet {
+			methods[route.Path] = append(methods[route.Path], http.MethodHead)
+		}
+	}
+	// without a method these only match what the routes above don't, so
+	// the wrong method gets a JSON error rather than ServeMux's plain text
+	for _, path := range paths {
+		allow := strings.Join(methods[path], ", ")
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", allow)
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not allowed here, use %s", r.Method, allow))
+		})
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "No such endpoint")
+	})
+	return mux
+}
+
+func apiListItems(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	page := 1
+	if pageStr := q.Get("page"); pageStr != "" {
+		var err error
+		page, err = strconv.Atoi(pageStr)
+		if err != nil || page < 1 {
+			writeAPIError(w, http.StatusBadRequest, "Invalid 'page' number")
+			return
+		}
+	}
+
+	perPage := 20
+	if perPageStr := q.Get("per_page"); perPageStr != "" {
+		var err error
+		perPage, err = strconv.Atoi(perPageStr)
+		if err != nil || perPage < 1 || perPage > 100 {
+			writeAPIError(w, http.StatusBadRequest, "Invalid 'per_page' number")
+			return
+		}
+	}
+
+	sort := q.Get("sort")
+	if !validSort(sort) {
+		writeAPIError(w, http.StatusBadRequest, "Invalid 'sort'")
+		return
+	}
+
+	filtersJSON, err := json.Marshal(browseFilters(q))
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "Error reading filters")
+		return
+	}
+
+	// q and tag narrow the same list, a search within tags keeps both
+	var tags []string
+	if len(q["tag"]) > 0 {
+		tags = q["tag"]
+	}
+	var search *string
+	if query := strings.TrimSpace(q.Get("q")); query != "" {
+		search = &query
+	}
+
+	items, err := models.ApiQuery[models.Browse](r.Context(), "browse", page, perPage, tags, string(filtersJSON), sort, search)
+	if err != nil {
+		if message, ok := models.UserErrorMessage(err); ok {
+			writeAPIError(w, http.StatusBadRequest, message)
+			return
+		}
+		slog.Error("Error listing items", "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Error querying database")
+		return
+	}
+
+	writeJSON(w, apiItems{Page: page, PerPage: perPage, Browse: *items})
+}
+
+func apiGetItem(w http.ResponseWriter, r *http.Request) {
+	detail, err := models.ApiQuery[models.Detail](r.Context(), "detail", r.PathValue("item"), r.PathValue("brand"))
+	if err != nil {
+		if message, ok := models.UserErrorMessage(err); ok {
+			writeAPIError(w, http.StatusNotFound, message)
+			return
+		}
+		slog.Error("Error getting item", "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Error querying database")
+		return
+	}
+	writeJSON(w, detail)
+}
+
+func apiListBrands(w http.ResponseWriter, r *http.Request) {
+	brands, err := models.ApiQuery[models.Brands](r.Context(), "brands")
+	if err != nil {
+		slog.Error("Error listing brands", "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Error querying database")
+		return
+	}
+	writeJSON(w, brands)
+}
+
+func apiListTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := models.ApiQuery[[]models.Tag](r.Context(), "tags")
+	if err != nil {
+		slog.Error("Error listing tags", "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Error querying database")
+		return
+	}
+	writeJSON(w, tags)
+}
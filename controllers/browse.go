@@ -0,0 +1,415 @@
+package controllers
+
+import (
+	"clothes/models"
+	"clothes/views"
+	"clothes/views/widgets"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Query parameters the filter sidebar sets, cleared together by its clear link
+var filterParams = []string{"brand", "size", "in_stock", "min_rating", "min_price", "max_price"}
+
+// Values of the sort query parameter, in the order the menu lists them.  The
+// empty one is catalogue order, or best match first on search results.
+var browseSorts = []struct {
+	Value string
+	Label string
+}{
+	{"", "Featured"},
+	{"newest", "Newest"},
+	{"popular", "Most popular"},
+	{"rating", "Top rated"},
+	{"price-low", "Price: low to high"},
+	{"price-high", "Price: high to low"},
+	{"name", "Name"},
+}
+
+func validSort(sort string) bool {
+	for _, s := range browseSorts {
+		if s.Value == sort {
+			return true
+		}
+	}
+	return false
+}
+
+// Links to the same listing in each sort, back on its first page
+func browseSortMenu(u *url.URL, current string, searching bool) widgets.SortMenu {
+	menu := widgets.SortMenu{}
+	for _, s := range browseSorts {
+		if s.Value == "" && searching {
+			s.Label = "Best match"
+		}
+
+		sorted := *u
+		q := sorted.Query()
+		q.Del("page")
+		if s.Value == "" {
+			q.Del("sort")
+		} else {
+			q.Set("sort", s.Value)
+		}
+		sorted.RawQuery = q.Encode()
+
+		if s.Value == current {
+			menu.Label = s.Label
+		}
+		menu.Options = append(menu.Options, widgets.SortOption{
+			Label:  s.Label,
+			Href:   sorted.String(),
+			Active: s.Value == current,
+		})
+	}
+	return menu
+}
+
+func parseFilterNumber(q url.Values, name string) *float64 {
+	value, err := strconv.ParseFloat(strings.TrimSpace(q.Get(name)), 64)
+	if err != nil || value < 0 {
+		return nil
+	}
+	return &value
+}
+
+// Reads the facet filters from the query string.  Values that do not parse
+// are ignored rather than failing the page, they usually come from a hand
+// edited url.
+func browseFilters(q url.Values) models.BrowseFilters {
+	filters := models.BrowseFilters{
+		InStock:   q.Get("in_stock") != "",
+		MinRating: parseFilterNumber(q, "min_rating"),
+		MinPrice:  parseFilterNumber(q, "min_price"),
+		MaxPrice:  parseFilterNumber(q, "max_price"),
+	}
+	for _, brand := range q["brand"] {
+		if brand = strings.TrimSpace(brand); brand != "" {
+			filters.Brands = append(filters.Brands, brand)
+		}
+	}
+	for _, size := range q["size"] {
+		if size = strings.TrimSpace(size); size != "" {
+			filters.Sizes = append(filters.Sizes, size)
+		}
+	}
+	return filters
+}
+
+func formatFilterNumber(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds the sidebar from the facet counts.  Picked values the other filters
+// have emptied out are kept with a count of zero so they can be unpicked.
+func browseFilterWidget(u *url.URL, filters models.BrowseFilters, facets models.BrowseFacets) widgets.BrowseFilters {
+	q := u.Query()
+	widget := widgets.BrowseFilters{
+		Action:   u.EscapedPath(),
+		InStock:  widgets.FilterOption{Value: "1", Label: "In stock", Count: facets.InStock, Checked: filters.InStock},
+		MinPrice: formatFilterNumber(filters.MinPrice),
+		MaxPrice: formatFilterNumber(filters.MaxPrice),
+	}
+
+	// everything but the filters and the page, so a new filter starts from
+	// the first page
+	for _, name := range slices.Sorted(maps.Keys(q)) {
+		if name == "page" || slices.Contains(filterParams, name) {
+			continue
+		}
+		for _, value := range q[name] {
+			widget.Hidden = append(widget.Hidden, widgets.HiddenField{Name: name, Value: value})
+		}
+	}
+
+	for _, brand := range facets.Brands {
+		widget.Brands = append(widget.Brands, widgets.FilterOption{
+			Value:   brand.Name,
+			Label:   brand.Name,
+			Count:   brand.Count,
+			Checked: containsFold(filters.Brands, brand.Name),
+		})
+	}
+	for _, brand := range filters.Brands {
+		found := false
+		for _, option := range widget.Brands {
+			found = found || strings.EqualFold(option.Value, brand)
+		}
+		if !found {
+			widget.Brands = append(widget.Brands, widgets.FilterOption{Value: brand, Label: brand, Checked: true})
+		}
+	}
+
+	for _, size := range facets.Sizes {
+		widget.Sizes = append(widget.Sizes, widgets.FilterOption{
+			Value:   size.Size,
+			Label:   size.Size,
+			Count:   size.Count,
+			Checked: containsFold(filters.Sizes, size.Size),
+		})
+	}
+	for _, size := range filters.Sizes {
+		found := false
+		for _, option := range widget.Sizes {
+			found = found || strings.EqualFold(option.Value, size)
+		}
+		if !found {
+			widget.Sizes = append(widget.Sizes, widgets.FilterOption{Value: size, Label: size, Checked: true})
+		}
+	}
+
+	widget.Ratings = append(widget.Ratings, widgets.FilterOption{Label: "Any rating", Checked: filters.MinRating == nil})
+	for _, rating := range facets.Ratings {
+		widget.Ratings = append(widget.Ratings, widgets.FilterOption{
+			Value:   strconv.Itoa(rating.MinRating),
+			Label:   fmt.Sprintf("%d stars and up", rating.MinRating),
+			Count:   rating.Count,
+			Checked: filters.MinRating != nil && *filters.MinRating == float64(rating.MinRating),
+		})
+	}
+
+	if facets.MinPrice != nil {
+		widget.PriceLow = strconv.FormatFloat(*facets.MinPrice, 'f', 0, 64)
+	}
+	if facets.MaxPrice != nil {
+		widget.PriceHigh = strconv.FormatFloat(*facets.MaxPrice, 'f', 0, 64)
+	}
+
+	active := false
+	cleared := url.Values{}
+	for name, values := range q {
+		if slices.Contains(filterParams, name) {
+			active = true
+		} else if name != "page" {
+			cleared[name] = values
+		}
+	}
+	if active {
+		clearURL := *u
+		clearURL.RawQuery = cleared.Encode()
+		widget.ClearHref = clearURL.String()
+	}
+
+	return widget
+}
+
+func browseCard(item models.BrowseItem) widgets.ItemCard {
+	card := widgets.ItemCard{
+		ItemName: item.ItemName,
+		Brand:    item.BrandName,
+		ImageAlt: fmt.Sprintf("%s %s", item.BrandName, item.ItemName),
+		Href:     strings.ToLower(fmt.Sprintf("/item/%s/%s", item.BrandName, item.ItemName)),
+	}
+	card.ImageURL, card.ImageSrcset = imageSources(item.ThumbnailUrl, item.ThumbnailHash)
+	card.Price = priceWidget(item.Price)
+	return card
+}
+
+// Shared by /clothes, /browse/{top_level_tag} and /search.  tags is nil for
+// every item, and query is only set when searching.
+func renderBrowse(w http.ResponseWriter, r *http.Request, title string, tags []string, query string) {
+	pageStr := r.URL.Query().Get("page")
+	if pageStr == "" {
+		pageStr = "1"
+	}
+	var page int
+	_, err := fmt.Sscanf(pageStr, "%d", &page)
+	if err != nil || page < 1 {
+		http.Error(w, "Invalid page number", http.StatusBadRequest)
+		return
+	}
+
+	pageSizeStr := r.URL.Query().Get("pageSize")
+	if pageSizeStr == "" {
+		pageSizeStr = "20"
+	}
+	var pageSize int
+	_, err = fmt.Sscanf(pageSizeStr, "%d", &pageSize)
+	if err != nil || pageSize < 1 || pageSize > 100 {
+		http.Error(w, "Invalid 'pageSize' number", http.StatusBadRequest)
+		return
+	}
+
+	sort := r.URL.Query().Get("sort")
+	if !validSort(sort) {
+		http.Error(w, "Invalid 'sort'", http.StatusBadRequest)
+		return
+	}
+
+	filters := browseFilters(r.URL.Query())
+	filtersJSON, err := json.Marshal(filters)
+	if err != nil {
+		http.Error(w, "Error reading filters", http.StatusInternalServerError)
+		return
+	}
+
+	var items *models.Browse
+	if query != "" {
+		items, err = models.ApiQuery[models.Browse](r.Context(), "search", query, page, pageSize, string(filtersJSON), sort)
+	} else {
+		items, err = models.ApiQuery[models.Browse](r.Context(), "browse", page, pageSize, tags, string(filtersJSON), sort)
+	}
+	if err != nil {
+		slog.Error("Error browsing", "tags", tags, "query", query, "error", err)
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+
+	cards := []widgets.ItemCard{}
+	for _, item := range items.Items {
+		cards = append(cards, browseCard(item))
+	}
+
+	data := struct {
+		Cards      []widgets.ItemCard
+		TotalCount int
+		Filters    widgets.BrowseFilters
+		Sort       widgets.SortMenu
+		Pagination widgets.Pageination
+	}{
+		Cards:      cards,
+		TotalCount: items.TotalCount,
+		Filters:    browseFilterWidget(r.URL, filters, items.Facets),
+		Sort:       browseSortMenu(r.URL, sort, query != ""),
+		Pagination: widgets.Pageination{
+			CurrentPage: page,
+			TotalPages:  items.TotalPages,
+			BaseURL:     *r.URL,
+		},
+	}
+
+	views.RenderPage("browse", w, NewPageData(w, r, title, data))
+}
+
+type browseCursorItem struct {
+	ItemName    string        `json:"item_name"`
+	BrandName   string        `json:"brand_name"`
+	Description string        `json:"description"`
+	Href        string        `json:"href"`
+	ImageURL    string        `json:"image_url"`
+	ImageSrcset string        `json:"image_srcset"`
+	Price       *models.Price `json:"price"`
+}
+
+type browseCursorResponse struct {
+	Items      []browseCursorItem `json:"items"`
+	NextCursor *string            `json:"next_cursor"`
+	PrevCursor *string            `json:"prev_cursor"`
+}
+
+// Cursors go out as url safe base64 so clients pass them back untouched
+// rather than building their own
+func encodeCursor(raw json.RawMessage) *string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	cursor := base64.RawURLEncoding.EncodeToString(raw)
+	return &cursor
+}
+
+func decodeCursor(cursor string) (*string, bool) {
+	if cursor == "" {
+		return nil, true
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !json.Valid(raw) {
+		return nil, false
+	}
+	decoded := string(raw)
+	return &decoded, true
+}
+
+/*
+The JSON twin of renderBrowse for infinite scroll.  Instead of a page number
+it takes the cursor from the last response's next_cursor or prev_cursor, and
+a limit.  Filters and sort are the same query parameters, and a cursor only
+works with the sort it came from.
+*/
+func writeBrowseCursor(w http.ResponseWriter, r *http.Request, tags []string, query string) {
+	q := r.URL.Query()
+
+	limit := 20
+	if limitStr := q.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > 100 {
+			http.Error(w, "Invalid 'limit' number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cursor, ok := decodeCursor(q.Get("cursor"))
+	if !ok {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+
+	sort := q.Get("sort")
+	if !validSort(sort) {
+		http.Error(w, "Invalid 'sort'", http.StatusBadRequest)
+		return
+	}
+
+	filtersJSON, err := json.Marshal(browseFilters(q))
+	if err != nil {
+		http.Error(w, "Error reading filters", http.StatusInternalServerError)
+		return
+	}
+
+	var search *string
+	if query != "" {
+		search = &query
+	}
+
+	result, err := models.ApiQuery[models.BrowseCursorPage](r.Context(), "browse_cursor", limit, cursor, tags, string(filtersJSON), sort, search)
+	if err != nil {
+		// the only user errors are a cursor that doesn't fit the request
+		if message, ok := models.UserErrorMessage(err); ok {
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+		slog.Error("Error querying database", "error", err)
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+
+	response := browseCursorResponse{
+		Items:      []browseCursorItem{},
+		NextCursor: encodeCursor(result.NextCursor),
+		PrevCursor: encodeCursor(result.PrevCursor),
+	}
+	for _, item := range result.Items {
+		card := browseCard(item)
+		response.Items = append(response.Items, browseCursorItem{
+			ItemName:    item.ItemName,
+			BrandName:   item.BrandName,
+			Description: item.Description,
+			Href:        card.Href,
+			ImageURL:    card.ImageURL,
+			ImageSrcset: card.ImageSrcset,
+			Price:       item.Price,
+		})
+	}
+
+	writeJSON(w, response)
+}
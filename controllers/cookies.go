@@ -6,14 +6,24 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
+	"time"
 )
 
 const (
 	sessionCookieName = "session_token"
 	alertCookieName   = "alert_message"
+	cartCookieName    = "cart"
 )
 
+// Anonymous carts outlive the browser session
+const cartCookieMaxAge = 30 * 24 * 60 * 60
+
 type alert struct {
 	Level   widgets.AlertLevel `json:"level"`
 	Message string             `json:"message"`
@@ -39,16 +49,18 @@ func DecodeJSONCookie[T any](r *http.Request, name string) (*T, error) {
 }
 
 func EncodeJSONCookie[T any](w http.ResponseWriter, name string, value *T) error {
+	return EncodeJSONCookieAs(w, http.Cookie{Name: name}, value)
+}
+
+// Like EncodeJSONCookie, keeping the path, lifetime and flags of cookie
+func EncodeJSONCookieAs[T any](w http.ResponseWriter, cookie http.Cookie, value *T) error {
 	raw, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
 
-	encoded := base64.RawURLEncoding.EncodeToString(raw)
-	http.SetCookie(w, &http.Cookie{
-		Name:  name,
-		Value: encoded,
-	})
+	cookie.Value = base64.RawURLEncoding.EncodeToString(raw)
+	http.SetCookie(w, &cookie)
 	return nil
 }
 
@@ -56,12 +68,14 @@ func ClearCookie(w http.ResponseWriter, name string) {
 	http.SetCookie(w, &http.Cookie{
 		Name:   name,
 		Value:  "",
+		Path:   "/",
 		MaxAge: -1,
 	})
 }
 
 func setAlert(w http.ResponseWriter, alertType widgets.AlertLevel, alertMessage string) error {
-	return EncodeJSONCookie(w, alertCookieName, &alert{
+	// set for the whole site so the alert survives redirects to other paths
+	return EncodeJSONCookieAs(w, http.Cookie{Name: alertCookieName, Path: "/"}, &alert{
 		Level:   alertType,
 		Message: alertMessage,
 	})
@@ -85,20 +99,124 @@ func getAndClearAlert(r *http.Request, w http.ResponseWriter) (*alert, error) {
 	}, nil
 }
 
-func setSession(r *http.Request, w http.ResponseWriter, email string, password string) error {
-	session, err := models.ApiQuery[string](r.Context(), "site_user_authenticate", email, password)
-	if err != nil {
-		return err
-	}
+// "Remember me" sessions keep their cookie after the browser closes
+const rememberCookieMaxAge = 30 * 24 * 60 * 60
 
-	http.SetCookie(w, &http.Cookie{
+func setSessionCookie(w http.ResponseWriter, token string, remember bool) {
+	cookie := &http.Cookie{
 		Name:     sessionCookieName,
-		Value:    *session,
+		Value:    token,
 		HttpOnly: true,
 		Secure:   true,
 		Path:     "/",
 		SameSite: http.SameSiteLaxMode,
-	})
+	}
+	if remember {
+		cookie.MaxAge = rememberCookieMaxAge
+	}
+	http.SetCookie(w, cookie)
+}
+
+// Reverse proxies in front of the server, whose X-Forwarded-For is believed
+var trustedProxies []netip.Prefix
+
+// Sets which addresses are reverse proxies, from the trusted_proxies config.
+// Each is an address or a CIDR range.
+func TrustProxies(proxies []string) error {
+	prefixes := []netip.Prefix{}
+	for _, proxy := range proxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				return fmt.Errorf("invalid trusted proxy %q, expected an address or CIDR range", proxy)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	trustedProxies = prefixes
+	return nil
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+The address a request came from, without the port.  When it came through a
+trusted proxy this is the last address in X-Forwarded-For that is not one of
+them.  Anything further left was sent by the client and could be made up.
+*/
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	addr = addr.Unmap()
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && isTrustedProxy(addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+	}
+	return addr.String()
+}
+
+// The email or password was wrong
+var errSignInFailed = errors.New("incorrect email or password")
+
+// Too many wrong passwords were tried, from this address or from everywhere,
+// and the account is refusing sign ins from here
+type accountLockedError struct {
+	Until time.Time
+}
+
+func (e *accountLockedError) Error() string {
+	return fmt.Sprintf("account locked until %s", e.Until.Format(time.RFC3339))
+}
+
+// Signs in on this device, alongside any other sessions the user has.
+// Refused sign ins are errSignInFailed or an *accountLockedError.
+func setSession(r *http.Request, w http.ResponseWriter, email string, password string, remember bool) error {
+	signIn, err := models.ApiQuery[models.SignIn](r.Context(), "site_user_authenticate", email, password, r.UserAgent(), clientIP(r), remember)
+	if err != nil {
+		return err
+	}
+
+	switch signIn.Status {
+	case "ok":
+	case "locked":
+		locked := &accountLockedError{}
+		if signIn.LockedUntil != nil {
+			locked.Until, _ = time.Parse(time.RFC3339Nano, *signIn.LockedUntil)
+		}
+		return locked
+	default:
+		return errSignInFailed
+	}
+
+	if cartToken := getCartToken(r); cartToken != nil {
+		if _, err := models.ApiQuery[string](r.Context(), "cart_merge", signIn.SessionToken, *cartToken); err != nil {
+			slog.Error("Error merging cart", "error", err)
+		} else {
+			clearCartToken(w)
+		}
+	}
+
+	setSessionCookie(w, signIn.SessionToken, remember)
 	return nil
 }
 
@@ -139,5 +257,68 @@ func getSession(w http.ResponseWriter, r *http.Request) (*models.SiteUser, error
 		return nil, err
 	}
 
+	// the session slides forward as it is used, so should the cookie
+	if siteUser.Remember {
+		setSessionCookie(w, c.Value, true)
+	}
+
 	return siteUser, nil
 }
+
+type cartCookie struct {
+	Token string `json:"token"`
+}
+
+// Token of the anonymous cart, if the browser has one
+func getCartToken(r *http.Request) *string {
+	c, err := DecodeJSONCookie[cartCookie](r, cartCookieName)
+	if err != nil || c.Token == "" {
+		return nil
+	}
+	return &c.Token
+}
+
+func setCartToken(w http.ResponseWriter, token string) error {
+	return EncodeJSONCookieAs(w, http.Cookie{
+		Name:     cartCookieName,
+		Path:     "/",
+		MaxAge:   cartCookieMaxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}, &cartCookie{Token: token})
+}
+
+func clearCartToken(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cartCookieName,
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Who the cart belongs to, the signed in user or else the anonymous cart
+// in the cookie.  Either may be nil.
+func cartOwner(w http.ResponseWriter, r *http.Request) (*string, *string) {
+	if siteUser, err := getSession(w, r); err == nil && siteUser != nil {
+		return &siteUser.Username, nil
+	}
+	return nil, getCartToken(r)
+}
+
+// Keeps the cookie pointing at the anonymous cart an api function returned
+func rememberCart(w http.ResponseWriter, r *http.Request, cart *models.Cart) {
+	if cart.CartToken == nil {
+		return
+	}
+	if current := getCartToken(r); current != nil && *current == *cart.CartToken {
+		return
+	}
+	if err := setCartToken(w, *cart.CartToken); err != nil {
+		slog.Error("Error setting cart cookie", "error", err)
+	}
+}
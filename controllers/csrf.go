@@ -0,0 +1,110 @@
+package controllers
+
+import (
+	"clothes/signing"
+	"clothes/views"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	csrfCookieName = "csrf"
+	csrfFormField  = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+// Multipart bodies are parsed for the token with at most this much held in
+// memory, anything bigger goes to temporary files as usual
+const csrfMultipartMemory = 1 << 20
+
+// A random value per browser that tokens are derived from, set the first
+// time a page is rendered
+func csrfSecret(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookieName); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		slog.Error("Error making csrf secret", "error", err)
+		return ""
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    secret,
+		HttpOnly: true,
+		Secure:   true,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+	// so a token made later in this request matches the new cookie
+	r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: secret})
+	return secret
+}
+
+/*
+The token forms and fetch calls send back.  It is tied to the session as
+well as the browser, so signing in or out changes it and a token from before
+stops working.  signedIn is false when the session cookie is being cleared,
+so the token matches the requests that follow.
+*/
+func csrfToken(w http.ResponseWriter, r *http.Request, signedIn bool) string {
+	secret := csrfSecret(w, r)
+	if secret == "" {
+		return ""
+	}
+	session := ""
+	if signedIn {
+		session = sessionToken(r)
+	}
+	return signing.Tag("csrf", secret, session)
+}
+
+func validCSRF(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	expected := signing.Tag("csrf", c.Value, sessionToken(r))
+
+	sent := r.Header.Get(csrfHeader)
+	if sent == "" {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			r.ParseMultipartForm(csrfMultipartMemory)
+		}
+		sent = r.PostFormValue(csrfFormField)
+	}
+	return sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) == 1
+}
+
+// Refuses requests that change anything unless they carry the csrf token,
+// as a form field or for fetch calls the X-CSRF-Token header
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if validCSRF(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		slog.Warn("Rejected request without a valid csrf token", "method", r.Method, "path", r.URL.Path)
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			http.Error(w, "Missing or invalid CSRF token, reload the page and try again", http.StatusForbidden)
+			return
+		}
+		// page data first, it may set the csrf cookie and headers can't follow the status
+		pd := NewPageData(w, r, "Forbidden", "This form has expired.  Go back, reload the page and try again.")
+		w.WriteHeader(http.StatusForbidden)
+		views.RenderPage("403", w, pd)
+	})
+}
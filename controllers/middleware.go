@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"clothes/models"
+	"clothes/views"
 	"compress/gzip"
 	"context"
 	"log/slog"
@@ -75,3 +76,36 @@ func authenticateMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+type role int
+
+const (
+	roleStaff role = iota
+	roleAdmin
+)
+
+// Admins can do anything staff can
+func (required role) allows(siteUser models.SiteUser) bool {
+	switch required {
+	case roleStaff:
+		return siteUser.IsStaff || siteUser.IsAdmin
+	case roleAdmin:
+		return siteUser.IsAdmin
+	}
+	return false
+}
+
+// Must be wrapped by authenticateMiddleware, which puts the user in the context
+func requireRoleMiddleware(required role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siteUser, ok := r.Context().Value("siteUser").(models.SiteUser)
+		if !ok || !required.allows(siteUser) {
+			slog.Warn("Forbidden", "path", r.URL.Path, "username", siteUser.Username)
+			w.WriteHeader(http.StatusForbidden)
+			views.RenderPage("403", w, NewPageData(w, r, "Forbidden", nil))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	pathParamRe    = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+)
+
+// Turns Go types into OpenAPI schemas, collecting named structs as components
+// so they are described once and referenced everywhere else
+type schemaBuilder struct {
+	components map[string]any
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := b.schema(t.Elem())
+		if ref, ok := s["$ref"]; ok {
+			// siblings of $ref are ignored, so nullable needs a wrapper
+			return map[string]any{"allOf": []any{map[string]any{"$ref": ref}}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t == rawMessageType {
+			return map[string]any{}
+		}
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := t.Name()
+		if _, ok := b.components[name]; !ok {
+			// placeholder first in case the struct refers to itself
+			b.components[name] = map[string]any{}
+			b.components[name] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	default:
+		return map[string]any{}
+	}
+}
+
+// Properties the way encoding/json would write them, embedded structs
+// flattened in
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	b.addFields(t, properties, &required)
+
+	s := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func (b *schemaBuilder) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			b.addFields(field.Type, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = b.schema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+func (p apiParam) openAPI() map[string]any {
+	s := map[string]any{"type": p.Type}
+	if p.Repeated {
+		s = map[string]any{"type": "array", "items": s}
+	}
+	param := map[string]any{
+		"name":     p.Name,
+		"in":       p.In,
+		"required": p.Required || p.In == "path",
+		"schema":   s,
+	}
+	if p.Description != "" {
+		param["description"] = p.Description
+	}
+	if p.Repeated {
+		param["style"] = "form"
+		param["explode"] = true
+	}
+	return param
+}
+
+/*
+The OpenAPI 3 description of /api/v1, built from the same route table the
+mux is, with schemas read off the Go types the handlers write.  Served at
+/api/v1/openapi.json and printed by the openapi command.
+*/
+func OpenAPIDocument() map[string]any {
+	builder := &schemaBuilder{components: map[string]any{}}
+	errorSchema := builder.schema(reflect.TypeOf(apiError{}))
+
+	paths := map[string]any{}
+	for _, route := range apiV1Routes() {
+		path := pathParamRe.ReplaceAllString(route.Path, "{$1}")
+		item, ok := paths[path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[path] = item
+		}
+
+		params := []any{}
+		for _, p := range route.Params {
+			params = append(params, p.openAPI())
+		}
+
+		item[strings.ToLower(route.Method)] = map[string]any{
+			"operationId": route.OperationID,
+			"summary":     route.Summary,
+			"parameters":  params,
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "OK",
+					"content": map[string]any{
+						"application/json": map[string]any{"schema": builder.schema(reflect.TypeOf(route.Response))},
+					},
+				},
+				"default": map[string]any{
+					"description": "Error",
+					"content": map[string]any{
+						"application/json": map[string]any{"schema": errorSchema},
+					},
+				},
+			},
+		}
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Carousel catalogue API",
+			"version": "1",
+		},
+		"servers":    []any{map[string]any{"url": "/api/v1"}},
+		"paths":      paths,
+		"components": map[string]any{"schemas": builder.components},
+	}
+}
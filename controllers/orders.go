@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"clothes/models"
+	"clothes/payments"
+	"clothes/views/widgets"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Refunds a paid order and cancels it, putting its reserved stock back
+func cancelOrder(ctx context.Context, order *models.Order, note string) error {
+	if order.Status == "paid" && order.PaymentReference != nil {
+		provider := payments.Active()
+		if provider.Name() != order.PaymentProvider {
+			return fmt.Errorf("order %s was paid with %s but %s is in use", order.ID, order.PaymentProvider, provider.Name())
+		}
+		if err := provider.Refund(ctx, *order.PaymentReference, order.Total, order.Currency); err != nil {
+			return fmt.Errorf("refunding order %s: %w", order.ID, err)
+		}
+	}
+
+	_, err := models.ApiQuery[models.Order](ctx, "order_set_status", order.ID, "cancelled", note)
+	return err
+}
+
+// Takes payment for an order that was just checked out.  The order is
+// cancelled again if the payment does not go through.
+func payForOrder(ctx context.Context, order *models.Order, token string) error {
+	provider := payments.Active()
+	reference, err := provider.Charge(ctx, payments.Charge{
+		OrderNumber: order.ID,
+		Amount:      order.Total,
+		Currency:    order.Currency,
+		Token:       token,
+	})
+	if err != nil {
+		if _, cancelErr := models.ApiQuery[models.Order](ctx, "order_set_status", order.ID, "cancelled", "Payment failed: "+err.Error()); cancelErr != nil {
+			slog.Error("Error cancelling unpaid order", "order", order.ID, "error", cancelErr)
+		}
+		return err
+	}
+
+	if _, err := models.ApiQuery[models.Order](ctx, "order_mark_paid", order.ID, reference); err != nil {
+		slog.Error("Payment taken but the order could not be marked paid", "order", order.ID, "reference", reference, "error", err)
+		order.Status = "paid"
+		order.PaymentReference = &reference
+		if cancelErr := cancelOrder(ctx, order, "Could not record payment"); cancelErr != nil {
+			slog.Error("Error cancelling order after payment", "order", order.ID, "error", cancelErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func orderWidget(order models.Order) widgets.Order {
+	o := widgets.Order{
+		Number:        order.ID,
+		Href:          "/account/orders/" + order.ID,
+		Status:        order.Status,
+		Date:          formatDate(order.CreatedAt),
+		ItemCount:     order.ItemCount,
+		Subtotal:      widgets.FormatMoney(order.Currency, order.Subtotal),
+		Total:         widgets.FormatMoney(order.Currency, order.Total),
+		ShipToName:    order.ShipToName,
+		ShipToAddress: order.ShipToAddress,
+		Cancellable:   order.Cancellable(),
+	}
+	for _, line := range order.Lines {
+		l := widgets.OrderLine{
+			ItemName:  line.ItemName,
+			Brand:     line.BrandName,
+			Size:      line.Size,
+			Href:      strings.ToLower(fmt.Sprintf("/item/%s/%s", line.BrandName, line.ItemName)),
+			Quantity:  line.Quantity,
+			UnitPrice: widgets.FormatMoney(order.Currency, line.UnitPrice),
+			LineTotal: widgets.FormatMoney(order.Currency, line.LineTotal),
+		}
+		l.ImageURL, l.ImageSrcset = imageSources(line.ThumbnailUrl, line.ThumbnailHash)
+		o.Lines = append(o.Lines, l)
+	}
+	for _, change := range order.History {
+		c := widgets.OrderStatusChange{Status: change.Status, Date: formatDate(change.ChangedAt)}
+		if change.Note != nil {
+			c.Note = *change.Note
+		}
+		o.History = append(o.History, c)
+	}
+	return o
+}
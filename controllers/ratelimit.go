@@ -0,0 +1,127 @@
+package controllers
+
+import (
+	"clothes/models"
+	"clothes/ratelimit"
+	"clothes/views/widgets"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of auth_event, in the order the admin filter lists them.  The sign
+// in events and account_locked are recorded by api.site_user_authenticate,
+// password_reset by api.password_reset.
+var authEvents = []string{
+	"sign_in",
+	"sign_in_failed",
+	"sign_in_locked",
+	"account_locked",
+	"sign_up",
+	"password_reset_requested",
+	"password_reset",
+	"rate_limited",
+}
+
+// How often one of the account forms may be posted, from one address and
+// for one email address
+type authLimit struct {
+	Action     string
+	PerIP      ratelimit.Limit
+	PerAccount ratelimit.Limit
+	// Counts PerAccount separately for each address, so using up an
+	// account's tokens from one place doesn't keep its owner out.  Guessing
+	// spread over many addresses is slowed by api.site_user_authenticate.
+	AccountPerIP bool
+}
+
+var (
+	signInLimit = authLimit{
+		Action:       "sign_in",
+		PerIP:        ratelimit.Limit{Burst: 20, Every: time.Minute},
+		PerAccount:   ratelimit.Limit{Burst: 10, Every: 5 * time.Minute},
+		AccountPerIP: true,
+	}
+	signUpLimit = authLimit{
+		Action:     "sign_up",
+		PerIP:      ratelimit.Limit{Burst: 5, Every: 10 * time.Minute},
+		PerAccount: ratelimit.Limit{Burst: 3, Every: time.Hour},
+	}
+	passwordResetLimit = authLimit{
+		Action:     "password_reset",
+		PerIP:      ratelimit.Limit{Burst: 5, Every: 10 * time.Minute},
+		PerAccount: ratelimit.Limit{Burst: 3, Every: time.Hour},
+	}
+)
+
+/*
+How long the client must wait before trying the action again, zero when it
+may go ahead.  account is the email typed into the form, blank to only limit
+by address.  When the store fails the request is let through, an outage
+should not lock everyone out.
+*/
+func (l authLimit) wait(r *http.Request, account string) time.Duration {
+	ip := clientIP(r)
+	wait := takeToken(r, l.Action+":ip:"+ip, l.PerIP)
+	if account = strings.ToLower(strings.TrimSpace(account)); wait == 0 && account != "" {
+		key := l.Action + ":account:" + account
+		if l.AccountPerIP {
+			key += ":ip:" + ip
+		}
+		wait = takeToken(r, key, l.PerAccount)
+	}
+	return wait
+}
+
+func takeToken(r *http.Request, key string, limit ratelimit.Limit) time.Duration {
+	wait, err := ratelimit.Take(r.Context(), key, limit)
+	if err != nil {
+		slog.Error("Error checking rate limit", "key", key, "error", err)
+		return 0
+	}
+	return wait
+}
+
+// Turns the form post away with an alert when it is over the limit,
+// returning true when it did
+func authRateLimited(w http.ResponseWriter, r *http.Request, limit authLimit, account string, back string) bool {
+	wait := limit.wait(r, account)
+	if wait == 0 {
+		return false
+	}
+
+	slog.Warn("Rate limited", "action", limit.Action, "ip", clientIP(r))
+	recordAuthEvent(r, "rate_limited", account, limit.Action)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	setAlert(w, widgets.AlertLevelDanger, fmt.Sprintf("Too many attempts, try again in %s", describeWait(wait)))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+	return true
+}
+
+// A wait rounded up to the minute or hour, for alerts
+func describeWait(wait time.Duration) string {
+	switch minutes := int(math.Ceil(wait.Minutes())); {
+	case minutes <= 1:
+		return "a minute"
+	case minutes < 90:
+		return fmt.Sprintf("%d minutes", minutes)
+	default:
+		return fmt.Sprintf("%d hours", int(math.Ceil(wait.Hours())))
+	}
+}
+
+// Adds to the auth_event log, only logging when that fails since the event
+// has already happened
+func recordAuthEvent(r *http.Request, event string, email string, detail string) {
+	var detailArg *string
+	if detail != "" {
+		detailArg = &detail
+	}
+	if _, err := models.ApiQuery[any](r.Context(), "auth_event_record", event, email, clientIP(r), r.UserAgent(), detailArg); err != nil {
+		slog.Error("Error recording auth event", "event", event, "error", err)
+	}
+}
@@ -1,13 +1,20 @@
 package controllers
 
 import (
+	"clothes/images"
 	"clothes/models"
+	"clothes/payments"
+	"clothes/signing"
 	"clothes/views"
 	"clothes/views/widgets"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func NewPageData(w http.ResponseWriter, r *http.Request, title string, data any) views.PageData {
@@ -28,9 +35,62 @@ func NewPageData(w http.ResponseWriter, r *http.Request, title string, data any)
 	if err != nil {
 		clearSession(w, r)
 	}
+	pd.CSRFToken = csrfToken(w, r, pd.SiteUser != nil)
 	return pd
 }
 
+// Prefers the locally stored variants of an image, falling back to the
+// original url for images that have not been downloaded yet
+func imageSources(url string, hash string) (string, string) {
+	if hash != "" {
+		return images.URL(hash, "medium"), images.Srcset(hash)
+	}
+	if url == "" || strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		return url, ""
+	}
+	return fmt.Sprintf("/static/images/%s", url), ""
+}
+
+func priceWidget(p *models.Price) *widgets.Price {
+	if p == nil {
+		return nil
+	}
+	return &widgets.Price{Currency: p.Currency, Price: p.Price, ListPrice: p.ListPrice}
+}
+
+// Timestamps from the database are shown as dates only
+func formatDate(timestamp string) string {
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.Format("Jan 2, 2006")
+}
+
+func formatDateTime(timestamp string) string {
+	t, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.Local().Format("Jan 2, 2006 3:04 PM")
+}
+
+// Changes a line of the cart from a form post, reporting problems through
+// an alert on the cart page
+func setCartQuantity(w http.ResponseWriter, r *http.Request, itemID int, quantity int) {
+	username, cartToken := cartOwner(w, r)
+	_, err := models.ApiQuery[models.Cart](r.Context(), "cart_set_quantity", username, cartToken, itemID, quantity)
+	if err == nil {
+		return
+	}
+	message, ok := models.UserErrorMessage(err)
+	if !ok {
+		slog.Error("Error updating cart", "error", err)
+		message = "Error updating cart"
+	}
+	setAlert(w, widgets.AlertLevelDanger, message)
+}
+
 func GetAuthenticatedServerMux() http.Handler {
 	mux := http.NewServeMux()
 
@@ -66,6 +126,11 @@ func GetAuthenticatedServerMux() http.Handler {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		if message := verificationNeeded(*siteUser, "closets"); message != "" {
+			setAlert(w, widgets.AlertLevelWarning, message)
+			http.Redirect(w, r, "/account", http.StatusSeeOther)
+			return
+		}
 
 		_, err = models.ApiQuery[any](r.Context(), "site_user_add_closet", siteUser.Username, closetName)
 		if err != nil {
@@ -79,151 +144,200 @@ func GetAuthenticatedServerMux() http.Handler {
 		http.Redirect(w, r, "/account", http.StatusSeeOther)
 	})
 
-	return authenticateMiddleware(mux)
-}
-
-func GetServerMux() http.Handler {
-	mux := http.NewServeMux()
-
-	// everything under account is authenticated
-	mux.Handle("/account/", http.StripPrefix("/account", GetAuthenticatedServerMux()))
-	mux.Handle("/api/", http.StripPrefix("/api", GetApiMux()))
-
-	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
-		views.RenderPage("home", w, NewPageData(w, r, "Home", nil))
+	mux.HandleFunc("POST /verify-email", func(w http.ResponseWriter, r *http.Request) {
+		siteUser := r.Context().Value("siteUser").(models.SiteUser)
+		if err := sendEmailVerification(r, siteUser.Username); err != nil {
+			message, ok := models.UserErrorMessage(err)
+			if !ok {
+				slog.Error("Error resending verification email", "username", siteUser.Username, "error", err)
+				message = "Error sending your verification email, please try again"
+			}
+			setAlert(w, widgets.AlertLevelDanger, message)
+		} else {
+			setAlert(w, widgets.AlertLevelSuccess, fmt.Sprintf("We have sent a new verification link to %s", siteUser.Email))
+		}
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
 	})
 
-	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-
-	mux.HandleFunc("GET /brands", func(w http.ResponseWriter, r *http.Request) {
-		brands, err := models.ApiQuery[models.Brands](r.Context(), "brands")
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		sessions, err := models.ApiQuery[[]models.Session](r.Context(), "user_sessions", sessionToken(r))
 		if err != nil {
+			slog.Error("Error listing sessions", "error", err)
 			http.Error(w, "Error querying database", http.StatusInternalServerError)
 			return
 		}
 
-		views.RenderPage("brands", w, NewPageData(w, r, "Brands", brands))
-	})
+		data := []accountSession{}
+		for _, session := range *sessions {
+			row := accountSession{
+				ID:       session.ID,
+				Device:   describeUserAgent(session.UserAgent),
+				SignedIn: formatDateTime(session.CreatedAt),
+				LastSeen: formatDateTime(session.LastSeenAt),
+				Expires:  formatDateTime(session.ExpiresAt),
+				Remember: session.Remember,
+				Current:  session.Current,
+			}
+			if session.IPAddress != nil {
+				row.IPAddress = *session.IPAddress
+			}
+			data = append(data, row)
+		}
 
-	mux.HandleFunc("GET /browse/{top_level_tag}", func(w http.ResponseWriter, r *http.Request) {
-		topLevelTag := r.PathValue("top_level_tag")
-		// these are other filter tags
-		tags := r.URL.Query()["tag"]
-		tags = append(tags, topLevelTag)
+		views.RenderPage("account-sessions", w, NewPageData(w, r, "Signed In Devices", data))
+	})
 
-		pageStr := r.URL.Query().Get("page")
-		if pageStr == "" {
-			pageStr = "1"
+	mux.HandleFunc("POST /sessions/{session_id}/revoke", func(w http.ResponseWriter, r *http.Request) {
+		sessionID, err := strconv.Atoi(r.PathValue("session_id"))
+		if err != nil {
+			http.Error(w, "Invalid session", http.StatusBadRequest)
+			return
 		}
-		var page int
-		_, err := fmt.Sscanf(pageStr, "%d", &page)
-		if err != nil || page < 1 {
-			http.Error(w, "Invalid page number", http.StatusBadRequest)
+
+		// signing out this device is just signing out
+		if r.FormValue("current") != "" {
+			clearSession(w, r)
+			setAlert(w, widgets.AlertLevelSuccess, "You have been signed out")
+			http.Redirect(w, r, "/sign-in", http.StatusSeeOther)
 			return
 		}
 
-		pageSizeStr := r.URL.Query().Get("pageSize")
-		if pageSizeStr == "" {
-			pageSizeStr = "20"
+		if _, err := models.ApiQuery[any](r.Context(), "user_revoke_session", sessionToken(r), sessionID); err != nil {
+			message, ok := models.UserErrorMessage(err)
+			if !ok {
+				slog.Error("Error revoking session", "error", err)
+				message = "Error signing out that device"
+			}
+			setAlert(w, widgets.AlertLevelDanger, message)
+		} else {
+			setAlert(w, widgets.AlertLevelSuccess, "That device has been signed out")
 		}
-		var pageSize int
-		_, err = fmt.Sscanf(pageSizeStr, "%d", &pageSize)
-		if err != nil || pageSize < 1 || pageSize > 100 {
-			http.Error(w, "Invalid 'pageSize' number", http.StatusBadRequest)
+		http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("POST /sessions/revoke-all", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := models.ApiQuery[any](r.Context(), "user_signout_everywhere", sessionToken(r)); err != nil {
+			slog.Error("Error signing out everywhere", "error", err)
+			setAlert(w, widgets.AlertLevelDanger, "Error signing out your devices")
+			http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
 			return
 		}
 
-		slog.Info("Browsing with tags", "tags", tags)
-		items, err := models.ApiQuery[models.Browse](r.Context(), "browse", page, pageSize, tags)
+		ClearCookie(w, sessionCookieName)
+		setAlert(w, widgets.AlertLevelSuccess, "You have been signed out on every device")
+		http.Redirect(w, r, "/sign-in", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("GET /orders", func(w http.ResponseWriter, r *http.Request) {
+		siteUser := r.Context().Value("siteUser").(models.SiteUser)
+		orders, err := models.ApiQuery[[]models.Order](r.Context(), "site_user_get_orders", siteUser.Username)
 		if err != nil {
+			slog.Error("Error getting orders", "error", err)
 			http.Error(w, "Error querying database", http.StatusInternalServerError)
 			return
 		}
 
-		cards := []widgets.ItemCard{}
-		for _, item := range items.Items {
-			card := widgets.ItemCard{
-				ItemName: item.ItemName,
-				Brand:    item.BrandName,
-				ImageURL: fmt.Sprintf("/static/images/%s", item.ThumbnailUrl),
-				ImageAlt: fmt.Sprintf("%s %s", item.BrandName, item.ItemName),
-				Href:     strings.ToLower(fmt.Sprintf("/item/%s/%s", item.BrandName, item.ItemName)),
-			}
-			cards = append(cards, card)
+		data := []widgets.Order{}
+		for _, order := range *orders {
+			data = append(data, orderWidget(order))
 		}
 
-		data := struct {
-			Cards      []widgets.ItemCard
-			Pagination widgets.Pageination
-		}{
-			Cards: cards,
-			Pagination: widgets.Pageination{
-				CurrentPage: page,
-				TotalPages:  items.TotalPages,
-				BaseURL:     *r.URL,
-			},
-		}
-		fmt.Println(data.Cards)
+		views.RenderPage("orders", w, NewPageData(w, r, "Orders", data))
+	})
 
-		title := strings.Title(strings.ReplaceAll(topLevelTag, "_", " "))
+	mux.HandleFunc("GET /orders/{order_number}", func(w http.ResponseWriter, r *http.Request) {
+		siteUser := r.Context().Value("siteUser").(models.SiteUser)
+		order, err := models.ApiQuery[models.Order](r.Context(), "site_user_get_order", siteUser.Username, r.PathValue("order_number"))
+		if _, ok := models.UserErrorMessage(err); ok {
+			w.WriteHeader(http.StatusNotFound)
+			views.RenderPage("404", w, NewPageData(w, r, "Page Not Found", nil))
+			return
+		} else if err != nil {
+			slog.Error("Error getting order", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
 
-		views.RenderPage("browse", w, NewPageData(w, r, title, data))
+		views.RenderPage("order", w, NewPageData(w, r, "Order "+order.ID, orderWidget(*order)))
 	})
 
-	mux.HandleFunc("GET /clothes", func(w http.ResponseWriter, r *http.Request) {
-		pageStr := r.URL.Query().Get("page")
-		if pageStr == "" {
-			pageStr = "1"
-		}
-		var page int
-		_, err := fmt.Sscanf(pageStr, "%d", &page)
-		if err != nil || page < 1 {
-			http.Error(w, "Invalid page number", http.StatusBadRequest)
+	mux.HandleFunc("POST /orders/{order_number}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		siteUser := r.Context().Value("siteUser").(models.SiteUser)
+		order, err := models.ApiQuery[models.Order](r.Context(), "site_user_get_order", siteUser.Username, r.PathValue("order_number"))
+		if err != nil {
+			http.Error(w, "Order not found", http.StatusNotFound)
 			return
 		}
+		orderURL := "/account/orders/" + order.ID
 
-		pageSizeStr := r.URL.Query().Get("pageSize")
-		if pageSizeStr == "" {
-			pageSizeStr = "20"
+		if !order.Cancellable() {
+			setAlert(w, widgets.AlertLevelWarning, "This order can no longer be cancelled")
+			http.Redirect(w, r, orderURL, http.StatusSeeOther)
+			return
 		}
-		var pageSize int
-		_, err = fmt.Sscanf(pageSizeStr, "%d", &pageSize)
-		if err != nil || pageSize < 1 || pageSize > 100 {
-			http.Error(w, "Invalid 'pageSize' number", http.StatusBadRequest)
+
+		if err := cancelOrder(r.Context(), order, "Cancelled by customer"); err != nil {
+			slog.Error("Error cancelling order", "order", order.ID, "error", err)
+			setAlert(w, widgets.AlertLevelDanger, "Error cancelling order")
+			http.Redirect(w, r, orderURL, http.StatusSeeOther)
 			return
 		}
 
-		items, err := models.ApiQuery[models.Browse](r.Context(), "browse", page, pageSize)
+		setAlert(w, widgets.AlertLevelSuccess, fmt.Sprintf("Order %s was cancelled", order.ID))
+		http.Redirect(w, r, orderURL, http.StatusSeeOther)
+	})
+
+	return authenticateMiddleware(mux)
+}
+
+func GetServerMux() http.Handler {
+	mux := http.NewServeMux()
+
+	// everything under account is authenticated
+	mux.Handle("/account/", http.StripPrefix("/account", GetAuthenticatedServerMux()))
+	// and admin also needs a staff account
+	mux.Handle("/admin/", http.StripPrefix("/admin", GetAdminServerMux()))
+	mux.Handle("/api/", http.StripPrefix("/api", GetApiMux()))
+
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		views.RenderPage("home", w, NewPageData(w, r, "Home", nil))
+	})
+
+	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.Handle("GET /images/{hash}/{size}", images.Handler())
+
+	mux.HandleFunc("GET /brands", func(w http.ResponseWriter, r *http.Request) {
+		brands, err := models.ApiQuery[models.Brands](r.Context(), "brands")
 		if err != nil {
 			http.Error(w, "Error querying database", http.StatusInternalServerError)
 			return
 		}
 
-		cards := []widgets.ItemCard{}
-		for _, item := range items.Items {
-			card := widgets.ItemCard{
-				ItemName: item.ItemName,
-				Brand:    item.BrandName,
-				ImageURL: fmt.Sprintf("/static/images/%s", item.ThumbnailUrl),
-				ImageAlt: fmt.Sprintf("%s %s", item.BrandName, item.ItemName),
-				Href:     strings.ToLower(fmt.Sprintf("/item/%s/%s", item.BrandName, item.ItemName)),
-			}
-			cards = append(cards, card)
-		}
+		views.RenderPage("brands", w, NewPageData(w, r, "Brands", brands))
+	})
 
-		data := struct {
-			Cards      []widgets.ItemCard
-			Pagination widgets.Pageination
-		}{
-			Cards: cards,
-			Pagination: widgets.Pageination{
-				CurrentPage: page,
-				TotalPages:  items.TotalPages,
-				BaseURL:     *r.URL,
-			},
+	mux.HandleFunc("GET /browse/{top_level_tag}", func(w http.ResponseWriter, r *http.Request) {
+		topLevelTag := r.PathValue("top_level_tag")
+		// these are other filter tags
+		tags := r.URL.Query()["tag"]
+		tags = append(tags, topLevelTag)
+
+		title := strings.Title(strings.ReplaceAll(topLevelTag, "_", " "))
+		renderBrowse(w, r, title, tags, "")
+	})
+
+	mux.HandleFunc("GET /clothes", func(w http.ResponseWriter, r *http.Request) {
+		renderBrowse(w, r, "Clothes", nil, "")
+	})
+
+	mux.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		if query == "" {
+			http.Redirect(w, r, "/clothes", http.StatusSeeOther)
+			return
 		}
 
-		views.RenderPage("browse", w, NewPageData(w, r, "Clothes", data))
+		renderBrowse(w, r, fmt.Sprintf("Results for \"%s\"", query), nil, query)
 	})
 
 	mux.HandleFunc("GET /item/{brand_name}/{base_item_name}", func(w http.ResponseWriter, r *http.Request) {
@@ -232,16 +346,23 @@ func GetServerMux() http.Handler {
 
 		detail, err := models.ApiQuery[models.Detail](r.Context(), "detail", baseItemName, brandName)
 		if err != nil {
+			if _, ok := models.UserErrorMessage(err); ok {
+				http.NotFound(w, r)
+				return
+			}
 			http.Error(w, "Error querying database", http.StatusInternalServerError)
 			return
 		}
 
 		data := struct {
-			Brand     string
-			ItemName  string
-			Rating    widgets.Rating
-			ImageUrls []string
-			SizeInfo  []struct {
+			Brand        string
+			ItemName     string
+			Discontinued bool
+			Price        *widgets.Price
+			PriceHistory []widgets.PriceChange
+			Rating       widgets.Rating
+			Images       []widgets.Image
+			SizeInfo     []struct {
 				Size    string
 				InStock bool
 			}
@@ -252,13 +373,14 @@ func GetServerMux() http.Handler {
 			MoreOfBrand  widgets.MoreLike
 			SimilarItems widgets.MoreLike
 		}{
-			Brand:    detail.BrandName,
-			ItemName: detail.ItemName,
+			Brand:        detail.BrandName,
+			ItemName:     detail.ItemName,
+			Discontinued: detail.Discontinued,
+			Price:        priceWidget(detail.Price),
 			Rating: widgets.Rating{
 				Rating: detail.Rating,
 				Max:    5,
 			},
-			ImageUrls: detail.ImageUrls,
 			SizeInfo: []struct {
 				Size    string
 				InStock bool
@@ -276,32 +398,263 @@ func GetServerMux() http.Handler {
 			card := widgets.ItemCard{
 				ItemName: item.ItemName,
 				Brand:    item.BrandName,
-				ImageURL: fmt.Sprintf("/static/images/%s", item.ThumbnailUrl),
 				ImageAlt: fmt.Sprintf("%s %s", item.BrandName, item.ItemName),
 				Href:     strings.ToLower(fmt.Sprintf("/item/%s/%s", item.BrandName, item.ItemName)),
 			}
+			card.ImageURL, card.ImageSrcset = imageSources(item.ThumbnailUrl, item.ThumbnailHash)
+			card.Price = priceWidget(item.Price)
 			data.MoreOfBrand.Items = append(data.MoreOfBrand.Items, card)
 		}
 		for _, item := range detail.MoreLike.SimilarItems {
 			card := widgets.ItemCard{
 				ItemName: item.ItemName,
 				Brand:    item.BrandName,
-				ImageURL: fmt.Sprintf("/static/images/%s", item.ThumbnailUrl),
 				ImageAlt: fmt.Sprintf("%s %s", item.BrandName, item.ItemName),
 				Href:     strings.ToLower(fmt.Sprintf("/item/%s/%s", item.BrandName, item.ItemName)),
 			}
+			card.ImageURL, card.ImageSrcset = imageSources(item.ThumbnailUrl, item.ThumbnailHash)
+			card.Price = priceWidget(item.Price)
 			data.SimilarItems.Items = append(data.SimilarItems.Items, card)
 		}
 
-		imageUrls := []string{}
-		for _, img := range detail.ImageUrls {
-			imageUrls = append(imageUrls, fmt.Sprintf("/static/images/%s", img))
+		for _, change := range detail.PriceHistory {
+			price := widgets.Price{Currency: change.Currency, Price: change.ListPrice, ListPrice: change.ListPrice}
+			if change.SalePrice != nil {
+				price.Price = *change.SalePrice
+			}
+			entry := widgets.PriceChange{Price: price, From: formatDate(change.EffectiveFrom)}
+			if change.EffectiveTo != nil {
+				entry.To = formatDate(*change.EffectiveTo)
+			}
+			data.PriceHistory = append(data.PriceHistory, entry)
+		}
+
+		for _, img := range detail.Images {
+			src, srcset := imageSources(img.Url, img.Hash)
+			data.Images = append(data.Images, widgets.Image{URL: src, Srcset: srcset})
 		}
-		data.ImageUrls = imageUrls
 
 		views.RenderPage("detail", w, NewPageData(w, r, detail.ItemName, data))
 	})
 
+	mux.HandleFunc("GET /cart", func(w http.ResponseWriter, r *http.Request) {
+		username, cartToken := cartOwner(w, r)
+		cart, err := models.ApiQuery[models.Cart](r.Context(), "cart_get", username, cartToken)
+		if err != nil {
+			slog.Error("Error getting cart", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+
+		currency := "USD"
+		if cart.Currency != nil {
+			currency = *cart.Currency
+		}
+
+		data := struct {
+			Lines     []widgets.CartLine
+			ItemCount int
+			Subtotal  string
+		}{
+			ItemCount: cart.ItemCount,
+			Subtotal:  widgets.FormatMoney(currency, cart.Subtotal),
+		}
+		for _, item := range cart.Items {
+			line := widgets.CartLine{
+				ItemID:        item.ItemID,
+				ItemName:      item.ItemName,
+				Brand:         item.BrandName,
+				Size:          item.Size,
+				Href:          strings.ToLower(fmt.Sprintf("/item/%s/%s", item.BrandName, item.ItemName)),
+				Quantity:      item.Quantity,
+				StockQuantity: item.StockQuantity,
+				Available:     item.Available,
+				Price:         priceWidget(item.Price),
+			}
+			line.ImageURL, line.ImageSrcset = imageSources(item.ThumbnailUrl, item.ThumbnailHash)
+			if item.LineTotal != nil {
+				line.LineTotal = widgets.FormatMoney(currency, *item.LineTotal)
+			}
+			data.Lines = append(data.Lines, line)
+		}
+
+		views.RenderPage("cart", w, NewPageData(w, r, "Cart", data))
+	})
+
+	mux.HandleFunc("POST /cart/add", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		brand := r.FormValue("brand")
+		item := r.FormValue("item")
+		size := r.FormValue("size")
+		quantity, err := strconv.Atoi(r.FormValue("quantity"))
+		if err != nil {
+			quantity = 1
+		}
+
+		itemURL := strings.ToLower(fmt.Sprintf("/item/%s/%s", brand, item))
+		if size == "" {
+			setAlert(w, widgets.AlertLevelWarning, "Choose a size first")
+			http.Redirect(w, r, itemURL, http.StatusSeeOther)
+			return
+		}
+
+		username, cartToken := cartOwner(w, r)
+		cart, err := models.ApiQuery[models.Cart](r.Context(), "cart_add_item", username, cartToken, item, brand, size, quantity)
+		if err != nil {
+			message, ok := models.UserErrorMessage(err)
+			if !ok {
+				slog.Error("Error adding to cart", "error", err)
+				message = "Error adding to cart"
+			}
+			setAlert(w, widgets.AlertLevelDanger, message)
+			http.Redirect(w, r, itemURL, http.StatusSeeOther)
+			return
+		}
+
+		rememberCart(w, r, cart)
+		setAlert(w, widgets.AlertLevelSuccess, fmt.Sprintf("Added %s to your cart", item))
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("POST /cart/update", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		itemID, err := strconv.Atoi(r.FormValue("item_id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+		quantity, err := strconv.Atoi(r.FormValue("quantity"))
+		if err != nil {
+			http.Error(w, "Invalid quantity", http.StatusBadRequest)
+			return
+		}
+
+		setCartQuantity(w, r, itemID, quantity)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("POST /cart/remove", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		itemID, err := strconv.Atoi(r.FormValue("item_id"))
+		if err != nil {
+			http.Error(w, "Invalid item id", http.StatusBadRequest)
+			return
+		}
+
+		setCartQuantity(w, r, itemID, 0)
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("GET /checkout", func(w http.ResponseWriter, r *http.Request) {
+		siteUser, err := getSession(w, r)
+		if err != nil {
+			setAlert(w, widgets.AlertLevelInfo, "Sign in to check out, your cart will be kept")
+			http.Redirect(w, r, "/sign-in", http.StatusSeeOther)
+			return
+		}
+		if message := verificationNeeded(*siteUser, "checkout"); message != "" {
+			setAlert(w, widgets.AlertLevelWarning, message)
+			http.Redirect(w, r, "/cart", http.StatusSeeOther)
+			return
+		}
+
+		cart, err := models.ApiQuery[models.Cart](r.Context(), "cart_get", siteUser.Username, nil)
+		if err != nil {
+			slog.Error("Error getting cart", "error", err)
+			http.Error(w, "Error querying database", http.StatusInternalServerError)
+			return
+		}
+		if len(cart.Items) == 0 {
+			http.Redirect(w, r, "/cart", http.StatusSeeOther)
+			return
+		}
+
+		currency := "USD"
+		if cart.Currency != nil {
+			currency = *cart.Currency
+		}
+
+		data := struct {
+			Lines        []widgets.OrderLine
+			ItemCount    int
+			Subtotal     string
+			ShipToName   string
+			TestPayments bool
+		}{
+			ItemCount:    cart.ItemCount,
+			Subtotal:     widgets.FormatMoney(currency, cart.Subtotal),
+			ShipToName:   strings.TrimSpace(siteUser.FirstName + " " + siteUser.LastName),
+			TestPayments: payments.Active().Name() == "fake",
+		}
+		for _, item := range cart.Items {
+			line := widgets.OrderLine{
+				ItemName: item.ItemName,
+				Brand:    item.BrandName,
+				Size:     item.Size,
+				Quantity: item.Quantity,
+			}
+			if item.LineTotal != nil {
+				line.LineTotal = widgets.FormatMoney(currency, *item.LineTotal)
+			}
+			data.Lines = append(data.Lines, line)
+		}
+
+		views.RenderPage("checkout", w, NewPageData(w, r, "Checkout", data))
+	})
+
+	mux.HandleFunc("POST /checkout", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		siteUser, err := getSession(w, r)
+		if err != nil {
+			http.Redirect(w, r, "/sign-in", http.StatusSeeOther)
+			return
+		}
+		if message := verificationNeeded(*siteUser, "checkout"); message != "" {
+			setAlert(w, widgets.AlertLevelWarning, message)
+			http.Redirect(w, r, "/cart", http.StatusSeeOther)
+			return
+		}
+
+		order, err := models.ApiQuery[models.Order](r.Context(), "checkout", siteUser.Username, r.FormValue("ship_to_name"), r.FormValue("ship_to_address"), payments.Active().Name())
+		if err != nil {
+			message, ok := models.UserErrorMessage(err)
+			if !ok {
+				slog.Error("Error checking out", "error", err)
+				message = "Error placing your order"
+			}
+			setAlert(w, widgets.AlertLevelDanger, message)
+			http.Redirect(w, r, "/checkout", http.StatusSeeOther)
+			return
+		}
+
+		if err := payForOrder(r.Context(), order, r.FormValue("payment_token")); err != nil {
+			message := "We could not take your payment, please try again"
+			if errors.Is(err, payments.ErrDeclined) {
+				message = "Your payment was declined"
+			} else {
+				slog.Error("Error taking payment", "order", order.ID, "error", err)
+			}
+			setAlert(w, widgets.AlertLevelDanger, message)
+			http.Redirect(w, r, "/checkout", http.StatusSeeOther)
+			return
+		}
+
+		setAlert(w, widgets.AlertLevelSuccess, fmt.Sprintf("Thank you, order %s has been placed", order.ID))
+		http.Redirect(w, r, "/account/orders/"+order.ID, http.StatusSeeOther)
+	})
+
 	mux.HandleFunc("GET /sign-in", func(w http.ResponseWriter, r *http.Request) {
 		views.RenderPage("sign-in", w, NewPageData(w, r, "Sign In", nil))
 	})
@@ -313,11 +666,23 @@ func GetServerMux() http.Handler {
 		}
 		email := r.FormValue("email")
 		password := r.FormValue("password")
+		remember := r.FormValue("remember") != ""
 
-		err := setSession(r, w, email, password)
-		if err != nil {
-			slog.Error("Error signing in user", "error", err)
-			setAlert(w, widgets.AlertLevelDanger, "Incorrect email or password")
+		if authRateLimited(w, r, signInLimit, email, "/sign-in") {
+			return
+		}
+
+		if err := setSession(r, w, email, password, remember); err != nil {
+			var locked *accountLockedError
+			switch {
+			case errors.Is(err, errSignInFailed):
+				setAlert(w, widgets.AlertLevelDanger, "Incorrect email or password")
+			case errors.As(err, &locked):
+				setAlert(w, widgets.AlertLevelDanger, fmt.Sprintf("Too many wrong passwords have been tried, signing in to this account from here is locked for %s.  Try again then, or reset your password.", describeWait(time.Until(locked.Until))))
+			default:
+				slog.Error("Error signing in user", "error", err)
+				setAlert(w, widgets.AlertLevelDanger, "Error signing in, please try again")
+			}
 			http.Redirect(w, r, "/sign-in", http.StatusSeeOther)
 			return
 		}
@@ -340,21 +705,161 @@ func GetServerMux() http.Handler {
 		email := r.FormValue("email")
 		password := r.FormValue("password")
 
-		_, err := models.ApiQuery[string](r.Context(), "site_user_signup", firstName, lastName, username, email, password)
+		if authRateLimited(w, r, signUpLimit, email, "/sign-up") {
+			return
+		}
+
+		_, err := models.ApiQuery[any](r.Context(), "site_user_signup", firstName, lastName, username, email, password)
 		if err != nil {
 			setAlert(w, widgets.AlertLevelDanger, "Error signing up user")
 			http.Redirect(w, r, "/sign-up", http.StatusSeeOther)
 			return
 		}
+		recordAuthEvent(r, "sign_up", email, "")
 
-		err = setSession(r, w, email, password)
+		if err := setSession(r, w, email, password, false); err != nil {
+			slog.Error("Error signing in new user", "username", username, "error", err)
+			setAlert(w, widgets.AlertLevelWarning, "Your account has been made, sign in to start using it")
+			http.Redirect(w, r, "/sign-in", http.StatusSeeOther)
+			return
+		}
+
+		if err := sendEmailVerification(r, username); err != nil {
+			slog.Error("Error sending verification email", "username", username, "error", err)
+			setAlert(w, widgets.AlertLevelWarning, "Welcome!  We could not send your verification email, you can ask for another from your account")
+		} else {
+			setAlert(w, widgets.AlertLevelSuccess, fmt.Sprintf("Welcome!  We have sent a link to %s to verify your email address", email))
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("GET /verify-email", func(w http.ResponseWriter, r *http.Request) {
+		var claims emailVerificationClaims
+		if err := signing.Verify(emailVerificationPurpose, r.URL.Query().Get("token"), &claims); err != nil {
+			message := "This verification link is not valid, check it was copied in full"
+			if errors.Is(err, signing.ErrExpired) {
+				message = "This verification link has expired, ask for a new one from your account"
+			}
+			setAlert(w, widgets.AlertLevelDanger, message)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		verified, err := models.ApiQuery[bool](r.Context(), "email_verify", claims.Username, claims.Email)
 		if err != nil {
-			panic(err)
+			message, ok := models.UserErrorMessage(err)
+			if !ok {
+				slog.Error("Error verifying email", "username", claims.Username, "error", err)
+				message = "Error verifying your email address, please try again"
+			}
+			setAlert(w, widgets.AlertLevelDanger, message)
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
 		}
 
+		if *verified {
+			setAlert(w, widgets.AlertLevelSuccess, fmt.Sprintf("Thank you, %s is verified", claims.Email))
+		} else {
+			setAlert(w, widgets.AlertLevelInfo, fmt.Sprintf("%s is already verified", claims.Email))
+		}
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	})
 
+	mux.HandleFunc("GET /forgot-password", func(w http.ResponseWriter, r *http.Request) {
+		views.RenderPage("forgot-password", w, NewPageData(w, r, "Forgot Password", nil))
+	})
+
+	mux.HandleFunc("POST /forgot-password", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		email := strings.TrimSpace(r.FormValue("email"))
+		if email == "" {
+			setAlert(w, widgets.AlertLevelDanger, "Enter the email address you signed up with")
+			http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+			return
+		}
+
+		if authRateLimited(w, r, passwordResetLimit, email, "/forgot-password") {
+			return
+		}
+
+		reset, err := models.ApiQuery[*models.PasswordResetRequest](r.Context(), "password_reset_request", email)
+		if err != nil {
+			slog.Error("Error requesting password reset", "error", err)
+			setAlert(w, widgets.AlertLevelDanger, "Error requesting a password reset, please try again")
+			http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+			return
+		}
+		if *reset != nil {
+			sendPasswordReset(*reset)
+			recordAuthEvent(r, "password_reset_requested", email, "")
+		} else {
+			recordAuthEvent(r, "password_reset_requested", email, "No account with this email")
+		}
+
+		// the same either way, so the form cannot be used to find accounts
+		setAlert(w, widgets.AlertLevelSuccess, fmt.Sprintf("If there is an account for %s, we have emailed it a link to reset the password", email))
+		http.Redirect(w, r, "/sign-in", http.StatusSeeOther)
+	})
+
+	mux.HandleFunc("GET /reset-password", func(w http.ResponseWriter, r *http.Request) {
+		// the token is in the url, keep it out of the Referer of anything the
+		// page links to
+		w.Header().Set("Referrer-Policy", "no-referrer")
+
+		token := r.URL.Query().Get("token")
+		valid := false
+		if token != "" {
+			result, err := models.ApiQuery[bool](r.Context(), "password_reset_valid", token)
+			if err != nil {
+				slog.Error("Error checking password reset", "error", err)
+				http.Error(w, "Error querying database", http.StatusInternalServerError)
+				return
+			}
+			valid = *result
+		}
+
+		data := struct {
+			Token string
+			Valid bool
+		}{Token: token, Valid: valid}
+		views.RenderPage("reset-password", w, NewPageData(w, r, "Reset Password", data))
+	})
+
+	mux.HandleFunc("POST /reset-password", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Error parsing form", http.StatusBadRequest)
+			return
+		}
+		token := r.FormValue("token")
+		password := r.FormValue("password")
+		back := "/reset-password?" + url.Values{"token": {token}}.Encode()
+
+		if password != r.FormValue("confirm_password") {
+			setAlert(w, widgets.AlertLevelDanger, "The passwords do not match")
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+
+		if _, err := models.ApiQuery[any](r.Context(), "password_reset", token, password, clientIP(r), r.UserAgent()); err != nil {
+			message, ok := models.UserErrorMessage(err)
+			if !ok {
+				slog.Error("Error resetting password", "error", err)
+				message = "Error resetting your password, please try again"
+			}
+			setAlert(w, widgets.AlertLevelDanger, message)
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+
+		// every session was ended, including this browser's if it had one
+		clearSession(w, r)
+		setAlert(w, widgets.AlertLevelSuccess, "Your password has been changed, sign in with the new one")
+		http.Redirect(w, r, "/sign-in", http.StatusSeeOther)
+	})
+
 	mux.HandleFunc("GET /sign-out", func(w http.ResponseWriter, r *http.Request) {
 		clearSession(w, r)
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -365,5 +870,5 @@ func GetServerMux() http.Handler {
 		views.RenderPage("404", w, NewPageData(w, r, "Page Not Found", nil))
 	}))
 
-	return loggingMiddleware(gzipMiddleware(mux))
+	return loggingMiddleware(gzipMiddleware(csrfMiddleware(mux)))
 }
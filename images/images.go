@@ -0,0 +1,369 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Root directory images are stored under, set from the config at startup
+var Dir = "data/images"
+
+type Size struct {
+	Name  string
+	Width int
+}
+
+// Resized variants generated for every image, smallest first.  Images are
+// never scaled up, so a variant may be narrower than its nominal width.
+var Sizes = []Size{
+	{Name: "thumb", Width: 320},
+	{Name: "medium", Width: 640},
+	{Name: "large", Width: 1280},
+}
+
+const jpegQuality = 85
+
+type Variant struct {
+	Size      string
+	Format    string
+	LocalPath string
+	Width     int
+	Height    int
+	ByteSize  int
+}
+
+type Image struct {
+	ContentHash string
+	LocalPath   string
+	MimeType    string
+	Width       int
+	Height      int
+	ByteSize    int
+	Variants    []Variant
+}
+
+var mimeExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Directory holding the original and every variant of an image
+func hashDir(hash string) string {
+	return filepath.Join(Dir, hash[:2], hash)
+}
+
+func isHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// WebP variants are only produced when cwebp is installed, as the standard
+// library can only encode JPEG
+var cwebpPath = sync.OnceValue(func() string {
+	path, err := exec.LookPath("cwebp")
+	if err != nil {
+		slog.Warn("cwebp not found, only JPEG image variants will be generated")
+		return ""
+	}
+	return path
+})
+
+// Whether new images get WebP variants.  Called at startup so a missing
+// cwebp is warned about straight away, not on the first image saved.
+func WebPAvailable() bool {
+	return cwebpPath() != ""
+}
+
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	tmp := path + "~"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func resize(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	if b.Dx() <= width {
+		width = b.Dx()
+	}
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+	return dst
+}
+
+func encodeWebP(jpegPath string, webpPath string) error {
+	cmd := exec.Command(cwebpPath(), "-quiet", "-q", fmt.Sprint(jpegQuality), jpegPath, "-o", webpPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cwebp: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func makeVariants(hash string, src image.Image) ([]Variant, error) {
+	variants := []Variant{}
+	for _, size := range Sizes {
+		resized := resize(src, size.Width)
+
+		buf := bytes.Buffer{}
+		if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, err
+		}
+		jpegPath := filepath.Join(hashDir(hash), size.Name+".jpg")
+		if err := writeFile(jpegPath, buf.Bytes()); err != nil {
+			return nil, err
+		}
+		variants = append(variants, Variant{
+			Size:      size.Name,
+			Format:    "jpeg",
+			LocalPath: jpegPath,
+			Width:     resized.Bounds().Dx(),
+			Height:    resized.Bounds().Dy(),
+			ByteSize:  buf.Len(),
+		})
+
+		if cwebpPath() == "" {
+			continue
+		}
+		webpPath := filepath.Join(hashDir(hash), size.Name+".webp")
+		if err := encodeWebP(jpegPath, webpPath); err != nil {
+			slog.Error("Failed to encode webp variant", "hash", hash, "size", size.Name, "error", err)
+			continue
+		}
+		info, err := os.Stat(webpPath)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, Variant{
+			Size:      size.Name,
+			Format:    "webp",
+			LocalPath: webpPath,
+			Width:     resized.Bounds().Dx(),
+			Height:    resized.Bounds().Dy(),
+			ByteSize:  int(info.Size()),
+		})
+	}
+	return variants, nil
+}
+
+// Stores a downloaded image under the hash of its content, generates its
+// variants and records everything against the image row for sourceURL.
+// Files are only written the first time a given content hash is seen.
+func Save(ctx context.Context, db *pgxpool.Pool, sourceURL string, data []byte) (*Image, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("reading image %s: %w", sourceURL, err)
+	}
+	mimeType := "image/" + format
+	ext, ok := mimeExtensions[mimeType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported image type %s for %s", mimeType, sourceURL)
+	}
+
+	img := &Image{
+		ContentHash: hash,
+		LocalPath:   filepath.Join(hashDir(hash), "original"+ext),
+		MimeType:    mimeType,
+		Width:       config.Width,
+		Height:      config.Height,
+		ByteSize:    len(data),
+	}
+
+	if _, err := os.Stat(img.LocalPath); errors.Is(err, os.ErrNotExist) {
+		src, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("decoding image %s: %w", sourceURL, err)
+		}
+		if img.Variants, err = makeVariants(hash, src); err != nil {
+			return nil, fmt.Errorf("resizing image %s: %w", sourceURL, err)
+		}
+		// written last so a partially processed image is retried
+		if err := writeFile(img.LocalPath, data); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO image (url, content_hash, local_path, mime_type, width, height, byte_size, downloaded_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		ON CONFLICT (url) DO UPDATE SET
+			content_hash = EXCLUDED.content_hash,
+			local_path = EXCLUDED.local_path,
+			mime_type = EXCLUDED.mime_type,
+			width = EXCLUDED.width,
+			height = EXCLUDED.height,
+			byte_size = EXCLUDED.byte_size,
+			downloaded_at = EXCLUDED.downloaded_at
+	`, sourceURL, img.ContentHash, img.LocalPath, img.MimeType, img.Width, img.Height, img.ByteSize)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range img.Variants {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO image_variant (content_hash, size, format, local_path, width, height, byte_size)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (content_hash, size, format) DO UPDATE SET
+				local_path = EXCLUDED.local_path,
+				width = EXCLUDED.width,
+				height = EXCLUDED.height,
+				byte_size = EXCLUDED.byte_size
+		`, hash, v.Size, v.Format, v.LocalPath, v.Width, v.Height, v.ByteSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return img, tx.Commit(ctx)
+}
+
+// URL of a variant, or of the original when size is "original"
+func URL(hash string, size string) string {
+	return fmt.Sprintf("/images/%s/%s", hash, size)
+}
+
+// Real widths of the variants of each image, by hash.  Content is addressed
+// by hash so they never change once read.
+var variantWidths sync.Map
+
+// Width of each variant read from its JPEG, which the WebP matches, zero
+// for variants that are missing
+func readVariantWidths(hash string) []int {
+	if widths, ok := variantWidths.Load(hash); ok {
+		return widths.([]int)
+	}
+
+	widths := make([]int, len(Sizes))
+	complete := true
+	for i, size := range Sizes {
+		f, err := os.Open(filepath.Join(hashDir(hash), size.Name+".jpg"))
+		if err != nil {
+			complete = false
+			continue
+		}
+		config, err := jpeg.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			slog.Error("Failed to read image variant", "hash", hash, "size", size.Name, "error", err)
+			complete = false
+			continue
+		}
+		widths[i] = config.Width
+	}
+	// missing variants may still be being written, look again next time
+	if complete {
+		variantWidths.Store(hash, widths)
+	}
+	return widths
+}
+
+// srcset attribute listing every variant of the image at its real width.
+// Small images are never scaled up, so several variants can share a width
+// and only the first of them is listed.
+func Srcset(hash string) string {
+	if !isHash(hash) {
+		return ""
+	}
+
+	parts := []string{}
+	seen := map[int]bool{}
+	for i, width := range readVariantWidths(hash) {
+		if width == 0 || seen[width] {
+			continue
+		}
+		seen[width] = true
+		parts = append(parts, fmt.Sprintf("%s %dw", URL(hash, Sizes[i].Name), width))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Serves GET /images/{hash}/{size}.  Content is addressed by hash so it can
+// be cached forever.  WebP is preferred when the client accepts it.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash := r.PathValue("hash")
+		size := r.PathValue("size")
+		if !isHash(hash) {
+			http.NotFound(w, r)
+			return
+		}
+
+		candidates := []string{}
+		if size == "original" {
+			for _, ext := range mimeExtensions {
+				candidates = append(candidates, "original"+ext)
+			}
+		} else {
+			known := false
+			for _, s := range Sizes {
+				known = known || s.Name == size
+			}
+			if !known {
+				http.NotFound(w, r)
+				return
+			}
+			if strings.Contains(r.Header.Get("Accept"), "image/webp") {
+				candidates = append(candidates, size+".webp")
+			}
+			candidates = append(candidates, size+".jpg")
+		}
+
+		for _, name := range candidates {
+			path := filepath.Join(hashDir(hash), name)
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			w.Header().Set("Vary", "Accept")
+			w.Header().Set("ETag", fmt.Sprintf(`"%s-%s"`, hash, name))
+			http.ServeFile(w, r, path)
+			return
+		}
+		http.NotFound(w, r)
+	})
+}
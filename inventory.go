@@ -0,0 +1,178 @@
+package main
+
+import (
+	"clothes/inventory"
+	"clothes/models"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+func runInventory(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: inventory audit|import|export")
+	}
+
+	switch args[0] {
+	case "audit":
+		return runInventoryAudit(args[1:])
+	case "import":
+		return runInventoryImport(args[1:])
+	case "export":
+		return runInventoryExport(args[1:])
+	default:
+		return fmt.Errorf("unknown inventory command %q, expected audit, import or export", args[0])
+	}
+}
+
+func runInventoryAudit(args []string) error {
+	fs := flag.NewFlagSet("inventory audit", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: inventory audit [flags] BRAND ITEM SIZE QUANTITY\n\nSets the stock of one size of an item to the counted QUANTITY")
+		fs.PrintDefaults()
+	}
+	if _, err := setup(fs, args); err != nil {
+		return err
+	}
+	defer models.Close()
+
+	if fs.NArg() != 4 {
+		fs.Usage()
+		return fmt.Errorf("expected 4 arguments, got %d", fs.NArg())
+	}
+	brand, item, size := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+	quantity, err := strconv.Atoi(fs.Arg(3))
+	if err != nil {
+		return fmt.Errorf("invalid quantity %q: %w", fs.Arg(3), err)
+	}
+
+	ctx := context.Background()
+	itemID, err := models.ApiQuery[*int](ctx, "clothing_item_id", item, brand, size)
+	if err != nil {
+		return err
+	}
+	if *itemID == nil {
+		return fmt.Errorf("%s %q does not come in size %s", brand, item, size)
+	}
+
+	before, err := models.ApiQuery[int](ctx, "stock_quantity", **itemID)
+	if err != nil {
+		return err
+	}
+	if _, err := models.ApiQuery[any](ctx, "transaction", "audit", **itemID, quantity); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s %s (%s): %d -> %d\n", brand, item, size, *before, quantity)
+	return nil
+}
+
+func runInventoryImport(args []string) error {
+	fs := flag.NewFlagSet("inventory import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: inventory import [flags] FILE\n\nRecords stock changes from a CSV file with brand, item, size, event and quantity\ncolumns, or - to read standard input.  Nothing is recorded if any row has an error.")
+		fs.PrintDefaults()
+	}
+	dryRun := fs.Bool("dry-run", false, "Check the file and report what would change without recording anything")
+	event := fs.String("event", "", "Event for rows that leave it blank: audit, ship-in, ship-out or scrap")
+	if _, err := setup(fs, args); err != nil {
+		return err
+	}
+	defer models.Close()
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a file to import")
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	rows, err := inventory.ReadCSV(in, *event)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", fs.Arg(0), err)
+	}
+
+	result, err := inventory.Import(context.Background(), rows, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINE\tBRAND\tITEM\tSIZE\tEVENT\tQUANTITY\tSTOCK\tERROR")
+	for _, row := range result.Rows {
+		stock, message := "", ""
+		if row.StockBefore != nil && row.StockAfter != nil {
+			stock = fmt.Sprintf("%d -> %d", *row.StockBefore, *row.StockAfter)
+		}
+		if row.Error != nil {
+			message = *row.Error
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", row.Line, row.Brand, row.Item, row.Size, row.Event, row.Quantity, stock, message)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	switch {
+	case result.ErrorCount > 0:
+		return fmt.Errorf("%d of %d rows have errors, nothing was recorded", result.ErrorCount, result.RowCount)
+	case result.Applied:
+		fmt.Printf("Recorded %d rows\n", result.RowCount)
+	default:
+		fmt.Printf("All %d rows are valid, run without -dry-run to record them\n", result.RowCount)
+	}
+	return nil
+}
+
+func runInventoryExport(args []string) error {
+	fs := flag.NewFlagSet("inventory export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: inventory export [flags]\n\nWrites the current stock of every size of every item")
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "csv", "Output format, csv or json")
+	output := fs.String("o", "-", "File to write, - for standard output")
+	if _, err := setup(fs, args); err != nil {
+		return err
+	}
+	defer models.Close()
+
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown format %q, expected csv or json", *format)
+	}
+
+	levels, err := inventory.Export(context.Background())
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(levels)
+	}
+	return inventory.WriteCSV(out, levels)
+}
@@ -0,0 +1,162 @@
+package inventory
+
+import (
+	"clothes/models"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Columns of an import file, in the order an export writes them.  The event
+// column can be left out when a default event is given.
+var importColumns = []string{"brand", "item", "size", "event", "quantity"}
+
+// Other names spreadsheets tend to use for the same columns
+var columnAliases = map[string]string{
+	"brand name": "brand",
+	"item name":  "item",
+	"name":       "item",
+	"qty":        "quantity",
+	"count":      "quantity",
+	"stock":      "quantity",
+}
+
+// A row to import, kept as text so the database can report every problem
+// with it along with the line it came from
+type ImportRow struct {
+	Line     int    `json:"line"`
+	Brand    string `json:"brand"`
+	Item     string `json:"item"`
+	Size     string `json:"size"`
+	Event    string `json:"event"`
+	Quantity string `json:"quantity"`
+}
+
+func columnName(header string) string {
+	name := strings.ToLower(strings.TrimSpace(header))
+	name = strings.ReplaceAll(name, "_", " ")
+	if alias, ok := columnAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+/*
+Reads rows from a CSV file whose first line names its columns.  Columns are
+matched by name in any order and unknown ones are ignored, so an export can
+be edited and read back.  Rows with an empty event get defaultEvent, and
+blank lines are skipped.
+*/
+func ReadCSV(r io.Reader, defaultEvent string) ([]ImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("the file is empty")
+	} else if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		// spreadsheets often start their csv files with a byte order mark
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		if _, seen := columns[columnName(name)]; !seen {
+			columns[columnName(name)] = i
+		}
+	}
+	for _, name := range importColumns {
+		if _, ok := columns[name]; !ok && !(name == "event" && defaultEvent != "") {
+			return nil, fmt.Errorf("missing the %s column, expected %s", name, strings.Join(importColumns, ", "))
+		}
+	}
+
+	field := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []ImportRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+
+		row := ImportRow{
+			Line:     line,
+			Brand:    field(record, "brand"),
+			Item:     field(record, "item"),
+			Size:     field(record, "size"),
+			Event:    field(record, "event"),
+			Quantity: field(record, "quantity"),
+		}
+		if row.Event == "" {
+			row.Event = defaultEvent
+		}
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("the file has no rows to import")
+	}
+	return rows, nil
+}
+
+// Checks every row and, unless dryRun is set or a row has an error, records
+// them all in one go
+func Import(ctx context.Context, rows []ImportRow, dryRun bool) (*models.InventoryImport, error) {
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return nil, err
+	}
+	return models.ApiQuery[models.InventoryImport](ctx, "inventory_import", string(data), dryRun)
+}
+
+func Export(ctx context.Context) ([]models.InventoryLevel, error) {
+	levels, err := models.ApiQuery[[]models.InventoryLevel](ctx, "inventory_export")
+	if err != nil {
+		return nil, err
+	}
+	return *levels, nil
+}
+
+// Writes levels with the import columns first, so a count can be filled in
+// over the quantity column and imported as an audit.  The quantity is what is
+// on the shelves, as an audit counts it.
+func WriteCSV(w io.Writer, levels []models.InventoryLevel) error {
+	writer := csv.NewWriter(w)
+	writer.Write(append(importColumns, "item_id", "discontinued"))
+	for _, level := range levels {
+		writer.Write([]string{
+			level.Brand,
+			level.Item,
+			level.Size,
+			"audit",
+			strconv.Itoa(level.PhysicalStock),
+			strconv.Itoa(level.ItemID),
+			strconv.FormatBool(level.Discontinued),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,34 @@
+package mail
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Writes each message to its own .eml file in Dir instead of sending it, for
+// development without an SMTP server.  Any mail client can open the files.
+type DropDir struct {
+	Dir  string
+	From string
+}
+
+func (d *DropDir) Send(to []string, subject, body string) error {
+	if len(to) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+	if err := os.MkdirAll(d.Dir, 0o755); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000"), hex.EncodeToString(suffix))
+
+	return os.WriteFile(filepath.Join(d.Dir, name), message(d.From, to, subject, body), 0o644)
+}
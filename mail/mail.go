@@ -0,0 +1,72 @@
+package mail
+
+import (
+	"fmt"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Anything that can deliver the site's email
+type Mailer interface {
+	Send(to []string, subject, body string) error
+}
+
+/*
+Sends plain text email through an SMTP server.  There is no authentication
+or TLS, it is meant to hand mail to a relay on the same host, or to a local
+stand-in like Mailpit that catches everything during development.
+*/
+type Sender struct {
+	Addr string
+	From string
+}
+
+// Keeps a subject from adding headers of its own
+var headerReplacer = strings.NewReplacer("\r", "", "\n", " ")
+
+var defaultMailer Mailer
+
+// Sets the mailer used by Send, called once at startup
+func Use(m Mailer) {
+	defaultMailer = m
+}
+
+// Sends with the mailer given to Use
+func Send(to []string, subject, body string) error {
+	if defaultMailer == nil {
+		return fmt.Errorf("no mailer is configured")
+	}
+	return defaultMailer.Send(to, subject, body)
+}
+
+// The message as it goes over the wire, headers and all
+func message(from string, to []string, subject, body string) []byte {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", headerReplacer.Replace(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(msg.String())
+}
+
+func (s *Sender) Send(to []string, subject, body string) error {
+	if s.Addr == "" {
+		return fmt.Errorf("no smtp server is configured")
+	}
+	if len(to) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+	// From can have a display name, the envelope only takes the address
+	from, err := netmail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address %q: %w", s.From, err)
+	}
+
+	return smtp.SendMail(s.Addr, nil, from.Address, to, message(s.From, to, subject, body))
+}
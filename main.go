@@ -1,12 +1,27 @@
 package main
 
 import (
+	"clothes/alerts"
+	"clothes/config"
 	"clothes/controllers"
+	"clothes/images"
+	"clothes/mail"
 	"clothes/models"
+	"clothes/payments"
+	"clothes/ratelimit"
 	"clothes/scraper"
+	"clothes/signing"
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/evanw/esbuild/pkg/api"
 )
@@ -36,24 +51,251 @@ func BuildWebApps(entrypoints ...string) {
 	}
 }
 
-func main() {
-	slog.Info("Starting clothes app")
+// Everything a subcommand needs before it runs: its flags parsed, the
+// config loaded and the database connected.  Callers close the database.
+func setup(fs *flag.FlagSet, args []string) (*config.Config, error) {
+	configFile := config.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg, err := config.Load(*configFile, fs)
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
+	}
+
+	images.Dir = cfg.ImageDir
+
+	if err := models.Connect(context.Background(), cfg.Database); err != nil {
+		return nil, fmt.Errorf("connecting to database: %w", err)
+	}
+	return cfg, nil
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "Run the web server", runServe},
+	{"migrate", "Run database migrations (status, up, down N, baseline N)", runMigrate},
+	{"scrape", "Scrape a source into the catalog", runScrape},
+	{"user", "Manage accounts (create, promote, demote, reset-password, list)", runUser},
+	{"inventory", "Manage stock (audit, import, export)", runInventory},
+	{"openapi", "Print the OpenAPI document for /api/v1", runOpenAPI},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [args]\n\nCommands:\n", os.Args[0])
+	tw := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.usage)
+	}
+	tw.Flush()
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for a command's flags.  With no command, serve is run.\n", os.Args[0])
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	cfg, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer models.Close()
+
+	if err := payments.Use(cfg.PaymentProvider); err != nil {
+		return fmt.Errorf("setting up payments: %w", err)
+	}
+	if cfg.PaymentProvider == "fake" {
+		slog.Warn("Using the fake payment provider, no real payments will be taken")
+	}
+
+	if err := models.CheckMigrations(context.Background()); err != nil {
+		slog.Warn("Database schema is not up to date", "error", err)
+	}
+
+	if cfg.SMTP.DropDir != "" {
+		mail.Use(&mail.DropDir{Dir: cfg.SMTP.DropDir, From: cfg.SMTP.From})
+		slog.Info("Writing email to files instead of sending it", "dir", cfg.SMTP.DropDir)
+	} else {
+		mail.Use(&mail.Sender{Addr: cfg.SMTP.Addr, From: cfg.SMTP.From})
+	}
+	controllers.PublicURL = strings.TrimSuffix(cfg.PublicURL, "/")
+
+	random, err := signing.Use(cfg.Accounts.SecretKey)
+	if err != nil {
+		return fmt.Errorf("setting up link signing: %w", err)
+	}
+	if random {
+		slog.Warn("No secret key is configured, links in email will stop working when the server restarts")
+	}
+	if err := controllers.AllowUnverified(cfg.Accounts.UnverifiedAllow); err != nil {
+		return err
+	}
+	if err := controllers.TrustProxies(cfg.TrustedProxies); err != nil {
+		return err
+	}
+	if err := ratelimit.Use(cfg.RateLimit.Store); err != nil {
+		return err
+	}
+
+	sinks, err := alerts.NewSinks(cfg.Alerts)
+	if err != nil {
+		return fmt.Errorf("setting up stock alerts: %w", err)
+	}
+	go alerts.Run(context.Background(), sinks, cfg.Alerts.ScanInterval.Duration)
 
-	scrapeBrand := flag.Bool("scrape", false, "Run scraper for given brand (nike, adidas, puma)")
-	databaseMigrate := flag.Bool("migrate", false, "Run database migrations")
-	flag.Parse()
+	// uploads from the back office get variants, warn now if WebP is missing
+	images.WebPAvailable()
 
 	// BuildWebApps("webcomponents/src/_bundle.ts")
 	BuildWebApps("./views/react/index.tsx")
 
-	if *databaseMigrate {
-		models.Migrate()
+	slog.Info("Listening", "addr", cfg.ListenAddr)
+	return http.ListenAndServe(cfg.ListenAddr, controllers.GetServerMux())
+}
+
+func runOpenAPI(args []string) error {
+	fs := flag.NewFlagSet("openapi", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: openapi\n\nWrites the OpenAPI document describing /api/v1 to standard output")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(controllers.OpenAPIDocument())
+}
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: migrate [flags] status|up|down N|baseline N\n\nbaseline N records migrations up to N as applied without running them, for a\ndatabase whose tables were made before migrations were tracked")
+		fs.PrintDefaults()
+	}
+	if _, err := setup(fs, args); err != nil {
+		return err
+	}
+	defer models.Close()
+
+	ctx := context.Background()
+
+	switch fs.Arg(0) {
+	case "status":
+		statuses, err := models.GetMigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, s := range statuses {
+			status, appliedAt := "pending", ""
+			if s.AppliedAt != nil {
+				status = "applied"
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			if s.ChecksumMismatch {
+				status = "modified"
+			}
+			fmt.Fprintf(tw, "%03d\t%s\t%s\t%s\n", s.Version, s.Name, status, appliedAt)
+		}
+		return tw.Flush()
+
+	case "up":
+		return models.MigrateUp(ctx)
+
+	case "down":
+		if fs.NArg() != 2 {
+			return fmt.Errorf("usage: migrate down N")
+		}
+		n, err := strconv.Atoi(fs.Arg(1))
+		if err != nil {
+			return fmt.Errorf("invalid number of migrations %q: %w", fs.Arg(1), err)
+		}
+		return models.MigrateDown(ctx, n)
+
+	case "baseline":
+		if fs.NArg() != 2 {
+			return fmt.Errorf("usage: migrate baseline N")
+		}
+		version, err := strconv.Atoi(fs.Arg(1))
+		if err != nil {
+			return fmt.Errorf("invalid migration version %q: %w", fs.Arg(1), err)
+		}
+		return models.MigrateBaseline(ctx, version)
+
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected status, up, down N or baseline N", fs.Arg(0))
 	}
-	if *scrapeBrand {
-		go scraper.ScrapeAll()
+}
+
+func runScrape(args []string) error {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: scrape [flags] [source]\n\nsource is fashionpass, a source configured in -sources, or all (the default)")
+		fs.PrintDefaults()
+	}
+	sources := fs.String("sources", "scraper/sources", "Directory of JSON configs for additional scraper sources")
+	maxPages := fs.Int("max-pages", 0, "Maximum number of pages to scrape per run, 0 for no limit")
+	restart := fs.Bool("restart", false, "Start scraping from the first page instead of resuming the last unfinished run")
+	offline := fs.Bool("offline", false, "Replay the scraper from its cache without touching the network")
+	delay := fs.Duration("delay", 1*time.Second, "Delay between scraper requests to the same site")
+	if _, err := setup(fs, args); err != nil {
+		return err
+	}
+	defer models.Close()
+
+	source := fs.Arg(0)
+	if source == "" {
+		source = "all"
+	}
+
+	images.WebPAvailable()
+
+	if err := scraper.LoadSources(*sources); err != nil {
+		return fmt.Errorf("loading scraper sources: %w", err)
+	}
+	return scraper.Scrape(models.GetDb(), source, scraper.Options{
+		MaxPages: *maxPages,
+		Restart:  *restart,
+		Offline:  *offline,
+		Delay:    *delay,
+	})
+}
+
+func main() {
+	args := os.Args[1:]
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage()
+		return
 	}
 
-	if err := http.ListenAndServe(":8080", controllers.GetServerMux()); err != nil {
-		slog.Error("Failed to start server", "error", err)
+	for _, c := range commands {
+		if c.name == name {
+			if err := c.run(args); err != nil {
+				if message, ok := models.UserErrorMessage(err); ok {
+					fmt.Fprintln(os.Stderr, message)
+				} else {
+					slog.Error("Command failed", "command", name, "error", err)
+				}
+				os.Exit(1)
+			}
+			return
+		}
 	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
 }
@@ -1,14 +1,17 @@
 package models
 
 import (
+	"clothes/config"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
-	"slices"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -16,6 +19,21 @@ const sqlDir = "models/sql"
 
 var pool *pgxpool.Pool
 
+var ErrNotConnected = errors.New("database connection pool has not been created")
+
+// SQLSTATE api functions raise when the message is meant for the user
+const userErrorCode = "UE000"
+
+// Returns the message of an error an api function raised for the user, such
+// as an item being out of stock
+func UserErrorMessage(err error) (string, bool) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == userErrorCode {
+		return pgErr.Message, true
+	}
+	return "", false
+}
+
 func GetDb() *pgxpool.Pool {
 	return pool
 }
@@ -28,6 +46,10 @@ func ApiQuery[T any](ctx context.Context, apiFunction string, args ...any) (*T,
 	}
 	argsString := strings.Join(argsStrings, ", ")
 
+	if pool == nil {
+		return nil, ErrNotConnected
+	}
+
 	rows, err := pool.Query(ctx, fmt.Sprintf("SELECT * FROM api.%s(%s) AS result", apiFunction, argsString), args...)
 	if err != nil {
 		return nil, err
@@ -45,62 +67,100 @@ func ApiQuery[T any](ctx context.Context, apiFunction string, args ...any) (*T,
 	return &res.Result, nil
 }
 
-func init() {
-	connectionString := fmt.Sprintf("postgresql:///postgres?user=%s", os.Getenv("USER"))
-	slog.Info("Connecting to database", "connectionString", connectionString)
-	p, err := pgxpool.New(context.Background(), connectionString)
+// Creates the connection pool.  Must be called before any other function
+// in this package touches the database.
+func Connect(ctx context.Context, cfg config.Database) error {
+	dsn, err := withTLSParams(cfg)
 	if err != nil {
-		slog.Error("Failed to create connection pool", "error", err)
-		os.Exit(1)
+		return err
 	}
 
-	// BEGIN KLUDGE
-	// always rerun the api sql schema to ensure it's up to date
-	content, err := os.ReadFile(fmt.Sprintf("%s/03_api.sql", sqlDir))
+	poolConfig, err := pgxpool.ParseConfig(dsn)
 	if err != nil {
-		slog.Error("Failed to read api schema SQL file", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("parsing database connection string: %w", err)
+	}
+	if cfg.MaxConns > 0 {
+		poolConfig.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		poolConfig.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConnLifetime.Duration > 0 {
+		poolConfig.MaxConnLifetime = cfg.MaxConnLifetime.Duration
+	}
+	if cfg.MaxConnIdleTime.Duration > 0 {
+		poolConfig.MaxConnIdleTime = cfg.MaxConnIdleTime.Duration
+	}
+	if cfg.HealthCheckPeriod.Duration > 0 {
+		poolConfig.HealthCheckPeriod = cfg.HealthCheckPeriod.Duration
+	}
+	if cfg.ConnectTimeout.Duration > 0 {
+		poolConfig.ConnConfig.ConnectTimeout = cfg.ConnectTimeout.Duration
 	}
-	_, err = p.Exec(context.Background(), string(content))
+	if cfg.StatementTimeout.Duration > 0 {
+		poolConfig.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10)
+	}
+	if cfg.ApplicationName != "" {
+		poolConfig.ConnConfig.RuntimeParams["application_name"] = cfg.ApplicationName
+	}
+
+	slog.Info("Connecting to database",
+		"host", poolConfig.ConnConfig.Host,
+		"database", poolConfig.ConnConfig.Database,
+		"user", poolConfig.ConnConfig.User,
+		"maxConns", poolConfig.MaxConns,
+	)
+	p, err := pgxpool.NewWithConfig(ctx, poolConfig)
 	if err != nil {
-		slog.Error("Failed to execute api schema SQL file", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("creating connection pool: %w", err)
+	}
+	if err := p.Ping(ctx); err != nil {
+		p.Close()
+		return fmt.Errorf("connecting to database: %w", err)
 	}
-	// END KLUDGE
 
-	slog.Info("Database connection pool established and schema initialized")
+	slog.Info("Database connection pool established")
 	pool = p
+	return nil
 }
 
-func Migrate() {
-	files, err := os.ReadDir(sqlDir)
-	if err != nil {
-		slog.Error("Failed to read sql directory", "error", err)
-		os.Exit(1)
+func Close() {
+	if pool != nil {
+		pool.Close()
+		pool = nil
 	}
+}
 
-	sqlFilePaths := []string{}
-	for _, f := range files {
-		if f.IsDir() {
-			slog.Warn("Skipping directory in sqlDir", "name", f.Name())
-			continue
-		}
-		sqlFilePaths = append(sqlFilePaths, fmt.Sprintf("%s/%s", sqlDir, f.Name()))
+// Adds the TLS settings to the connection string so pgx builds the TLS
+// config the same way it would for a DSN that contained them
+func withTLSParams(cfg config.Database) (string, error) {
+	params := map[string]string{
+		"sslmode":     cfg.SSLMode,
+		"sslrootcert": cfg.SSLRootCert,
+		"sslcert":     cfg.SSLCert,
+		"sslkey":      cfg.SSLKey,
 	}
 
-	slices.Sort(sqlFilePaths)
-
-	for _, f := range sqlFilePaths {
-		slog.Info("Executing sql file", "name", f)
-		content, err := os.ReadFile(f)
+	if strings.HasPrefix(cfg.DSN, "postgres://") || strings.HasPrefix(cfg.DSN, "postgresql://") {
+		u, err := url.Parse(cfg.DSN)
 		if err != nil {
-			slog.Error("Failed to read SQL file", "file", f, "error", err)
-			os.Exit(1)
+			return "", fmt.Errorf("parsing database connection string: %w", err)
 		}
-		_, err = pool.Exec(context.Background(), string(content))
-		if err != nil {
-			slog.Error("Failed to execute SQL file", "file", f, "error", err)
-			os.Exit(1)
+		q := u.Query()
+		for k, v := range params {
+			if v != "" {
+				q.Set(k, v)
+			}
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+
+	dsn := cfg.DSN
+	for k, v := range params {
+		if v != "" {
+			dsn += fmt.Sprintf(" %s='%s'", k, strings.ReplaceAll(v, "'", `\'`))
 		}
 	}
+	return dsn, nil
 }
@@ -0,0 +1,480 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	migrationsDir = sqlDir + "/migrations"
+	// The api schema only holds functions, so it is dropped and recreated
+	// whenever its contents change instead of being versioned.
+	apiSchemaFile = sqlDir + "/api.sql"
+	apiSchemaName = "api.sql"
+
+	// Arbitrary key shared by every instance so only one of them migrates at a time
+	migrationLockKey int64 = 0x636c6f74686573
+)
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version  int
+	Name     string
+	UpFile   string
+	DownFile string
+	Checksum string
+}
+
+type MigrationStatus struct {
+	Migration
+	AppliedAt        *time.Time
+	AppliedChecksum  string
+	ChecksumMismatch bool
+}
+
+type appliedMigration struct {
+	Version   int
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+func fileChecksum(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Reads the migrations directory and returns the migrations ordered by version
+func loadMigrations() ([]Migration, error) {
+	files, err := os.ReadDir(migrationsDir)
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations directory: %w", err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, f := range files {
+		if f.IsDir() {
+			slog.Warn("Skipping directory in migrationsDir", "name", f.Name())
+			continue
+		}
+		match := migrationFilePattern.FindStringSubmatch(f.Name())
+		if match == nil {
+			slog.Warn("Skipping file that is not a migration", "name", f.Name())
+			continue
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version %q: %w", f.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d is used by both %q and %q", version, m.Name, match[2])
+		}
+
+		path := filepath.Join(migrationsDir, f.Name())
+		if match[3] == "up" {
+			m.UpFile = path
+		} else {
+			m.DownFile = path
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.UpFile == "" {
+			return nil, fmt.Errorf("migration %03d_%s has no up file", m.Version, m.Name)
+		}
+		m.Checksum, err = fileChecksum(m.UpFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading migration %03d_%s: %w", m.Version, m.Name, err)
+		}
+		migrations = append(migrations, *m)
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int {
+		return a.Version - b.Version
+	})
+
+	return migrations, nil
+}
+
+func ensureMigrationTables(ctx context.Context, conn *pgxpool.Conn) error {
+	_, err := conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+
+		CREATE TABLE IF NOT EXISTS schema_repeatable_migrations (
+			name TEXT PRIMARY KEY,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+	`)
+	return err
+}
+
+type querier interface {
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+	QueryRow(context.Context, string, ...any) pgx.Row
+}
+
+func migrationTablesExist(ctx context.Context, q querier) (bool, error) {
+	var exists bool
+	err := q.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	return exists, err
+}
+
+func appliedMigrations(ctx context.Context, q querier) (map[int]appliedMigration, error) {
+	out := map[int]appliedMigration{}
+
+	exists, err := migrationTablesExist(ctx, q)
+	if err != nil || !exists {
+		return out, err
+	}
+
+	rows, err := q.Query(ctx, "SELECT version, name, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	applied, err := pgx.CollectRows(rows, pgx.RowToStructByPos[appliedMigration])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range applied {
+		out[a.Version] = a
+	}
+	return out, nil
+}
+
+// Holds a session level advisory lock for the duration of fn so that
+// concurrent instances cannot run migrations over each other
+func withMigrationLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	if pool == nil {
+		return ErrNotConnected
+	}
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquiring connection: %w", err)
+	}
+	defer conn.Release()
+
+	slog.Info("Waiting for migration lock")
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	defer func() {
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+			slog.Error("Failed to release migration lock", "error", err)
+		}
+	}()
+
+	if err := ensureMigrationTables(ctx, conn); err != nil {
+		return fmt.Errorf("creating migration tables: %w", err)
+	}
+	return fn(conn)
+}
+
+func runMigrationFile(ctx context.Context, conn *pgxpool.Conn, path string, record func(tx pgx.Tx) error) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, string(content)); err != nil {
+		return err
+	}
+	if err := record(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Returns an error if any applied migration no longer matches the file on disk
+func verifyChecksums(migrations []Migration, applied map[int]appliedMigration) error {
+	for _, m := range migrations {
+		a, ok := applied[m.Version]
+		if ok && a.Checksum != m.Checksum {
+			return fmt.Errorf("migration %03d_%s was modified after being applied (file checksum %s, applied checksum %s)", m.Version, m.Name, m.Checksum, a.Checksum)
+		}
+	}
+	for version, a := range applied {
+		if !slices.ContainsFunc(migrations, func(m Migration) bool { return m.Version == version }) {
+			return fmt.Errorf("migration %03d_%s is applied but missing from %s", version, a.Name, migrationsDir)
+		}
+	}
+	return nil
+}
+
+func applyApiSchema(ctx context.Context, conn *pgxpool.Conn) error {
+	checksum, err := fileChecksum(apiSchemaFile)
+	if err != nil {
+		return fmt.Errorf("reading api schema: %w", err)
+	}
+
+	var current string
+	err = conn.QueryRow(ctx, "SELECT checksum FROM schema_repeatable_migrations WHERE name = $1", apiSchemaName).Scan(&current)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	if current == checksum {
+		return nil
+	}
+
+	slog.Info("Applying api schema", "file", apiSchemaFile)
+	return runMigrationFile(ctx, conn, apiSchemaFile, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO schema_repeatable_migrations (name, checksum)
+			VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET checksum = EXCLUDED.checksum, applied_at = NOW()
+		`, apiSchemaName, checksum)
+		return err
+	})
+}
+
+// Whether the tables from 001 are there, for databases built before
+// migrations were tracked
+func schemaExists(ctx context.Context, q querier) (bool, error) {
+	var exists bool
+	err := q.QueryRow(ctx, "SELECT to_regclass('site_user') IS NOT NULL").Scan(&exists)
+	return exists, err
+}
+
+// Applies every pending migration in order, then refreshes the api schema
+func MigrateUp(ctx context.Context) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("reading applied migrations: %w", err)
+		}
+		if err := verifyChecksums(migrations, applied); err != nil {
+			return err
+		}
+
+		if len(applied) == 0 {
+			exists, err := schemaExists(ctx, conn)
+			if err != nil {
+				return fmt.Errorf("checking for an existing schema: %w", err)
+			}
+			if exists {
+				return errors.New("the database already has tables but no migrations are recorded, run migrate baseline N with the last migration its schema matches")
+			}
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+
+			slog.Info("Applying migration", "version", m.Version, "name", m.Name)
+			err := runMigrationFile(ctx, conn, m.UpFile, func(tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)", m.Version, m.Name, m.Checksum)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("applying migration %03d_%s: %w", m.Version, m.Name, err)
+			}
+		}
+
+		return applyApiSchema(ctx, conn)
+	})
+}
+
+/*
+Records migrations up to and including version as applied without running
+them, to adopt a database whose schema was made before migrations were
+tracked.  Only allowed while nothing is recorded, later migrations are left
+for migrate up.
+*/
+func MigrateBaseline(ctx context.Context, version int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(migrations, func(m Migration) bool { return m.Version == version }) {
+		return fmt.Errorf("there is no migration %03d in %s", version, migrationsDir)
+	}
+
+	return withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("reading applied migrations: %w", err)
+		}
+		if len(applied) > 0 {
+			return errors.New("migrations are already recorded for this database, baseline is only for one that has none")
+		}
+
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		for _, m := range migrations {
+			if m.Version > version {
+				break
+			}
+			slog.Info("Recording migration as applied", "version", m.Version, "name", m.Name)
+			if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name, checksum) VALUES ($1, $2, $3)", m.Version, m.Name, m.Checksum); err != nil {
+				return fmt.Errorf("recording migration %03d_%s: %w", m.Version, m.Name, err)
+			}
+		}
+		return tx.Commit(ctx)
+	})
+}
+
+// Reverts the most recently applied n migrations using their down files
+func MigrateDown(ctx context.Context, n int) error {
+	if n < 1 {
+		return fmt.Errorf("number of migrations to revert must be at least 1, got %d", n)
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("reading applied migrations: %w", err)
+		}
+		if err := verifyChecksums(migrations, applied); err != nil {
+			return err
+		}
+
+		reverted := 0
+		for _, m := range slices.Backward(migrations) {
+			if reverted == n {
+				break
+			}
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.DownFile == "" {
+				return fmt.Errorf("migration %03d_%s has no down file", m.Version, m.Name)
+			}
+
+			slog.Info("Reverting migration", "version", m.Version, "name", m.Name)
+			err := runMigrationFile(ctx, conn, m.DownFile, func(tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("reverting migration %03d_%s: %w", m.Version, m.Name, err)
+			}
+			reverted++
+		}
+
+		if reverted < n {
+			slog.Warn("Fewer migrations were applied than requested", "requested", n, "reverted", reverted)
+		}
+
+		// the api functions may reference what was just removed, so force
+		// them to be recreated on the next migrate up
+		_, err = conn.Exec(ctx, "DELETE FROM schema_repeatable_migrations WHERE name = $1", apiSchemaName)
+		return err
+	})
+}
+
+// Reports every known migration and whether it has been applied
+func GetMigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if pool == nil {
+		return nil, ErrNotConnected
+	}
+
+	applied, err := appliedMigrations(ctx, pool)
+	if err != nil {
+		return nil, fmt.Errorf("reading applied migrations: %w", err)
+	}
+
+	statuses := []MigrationStatus{}
+	for _, m := range migrations {
+		s := MigrationStatus{Migration: m}
+		if a, ok := applied[m.Version]; ok {
+			s.AppliedAt = &a.AppliedAt
+			s.AppliedChecksum = a.Checksum
+			s.ChecksumMismatch = a.Checksum != m.Checksum
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// Returns an error describing any pending or modified migrations, or an
+// api schema that differs from the one last applied
+func CheckMigrations(ctx context.Context) error {
+	statuses, err := GetMigrationStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, s := range statuses {
+		if s.ChecksumMismatch {
+			return fmt.Errorf("migration %03d_%s was modified after being applied", s.Version, s.Name)
+		}
+		if s.AppliedAt == nil {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d pending migration(s), run the migrate up command", pending)
+	}
+
+	checksum, err := fileChecksum(apiSchemaFile)
+	if err != nil {
+		return fmt.Errorf("reading api schema: %w", err)
+	}
+	var current string
+	err = pool.QueryRow(ctx, "SELECT checksum FROM schema_repeatable_migrations WHERE name = $1", apiSchemaName).Scan(&current)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	if current != checksum {
+		return errors.New("api schema is out of date, run the migrate up command")
+	}
+	return nil
+}
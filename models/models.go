@@ -1,29 +1,99 @@
 package models
 
+import "encoding/json"
+
 type Brands map[string][]string
 
 func (b Brands) Letters() []string {
 	return []string{"A", "B", "C", "D", "E", "F", "G", "H", "I", "J", "K", "L", "M", "N", "O", "P", "Q", "R", "S", "T", "U", "V", "W", "X", "Y", "Z", "#"}
 }
 
+type Price struct {
+	Currency  string   `json:"currency"`
+	ListPrice float64  `json:"list_price"`
+	SalePrice *float64 `json:"sale_price"`
+	// What the item sells for now, the sale price when there is one
+	Price float64 `json:"price"`
+}
+
+type PriceChange struct {
+	Currency      string   `json:"currency"`
+	ListPrice     float64  `json:"list_price"`
+	SalePrice     *float64 `json:"sale_price"`
+	EffectiveFrom string   `json:"effective_from"`
+	EffectiveTo   *string  `json:"effective_to"`
+}
+
+type BrowseItem struct {
+	ItemName      string `json:"item_name"`
+	BrandName     string `json:"brand_name"`
+	Description   string `json:"description"`
+	ThumbnailUrl  string `json:"thumbnail_url"`
+	ThumbnailHash string `json:"thumbnail_hash"`
+	Price         *Price `json:"price"`
+	BaseItemID    int    `json:"base_item_id"`
+}
+
 type Browse struct {
-	Items []struct {
-		ItemName     string `json:"item_name"`
-		BrandName    string `json:"brand_name"`
-		Description  string `json:"description"`
-		ThumbnailUrl string `json:"thumbnail_url"`
-		BaseItemID   int    `json:"base_item_id"`
-	} `json:"items"`
-	TotalPages int `json:"total_pages"`
+	Items      []BrowseItem `json:"items"`
+	TotalPages int          `json:"total_pages"`
+	TotalCount int          `json:"total_count"`
+	Facets     BrowseFacets `json:"facets"`
+}
+
+// Items either side of a cursor from api.browse_cursor.  The cursors are
+// null at either end of the listing.
+type BrowseCursorPage struct {
+	Items      []BrowseItem    `json:"items"`
+	NextCursor json.RawMessage `json:"next_cursor"`
+	PrevCursor json.RawMessage `json:"prev_cursor"`
+}
+
+// What api.browse narrows items down by, besides tags.  Unset fields do not
+// filter.
+type BrowseFilters struct {
+	Brands    []string `json:"brands,omitempty"`
+	Sizes     []string `json:"sizes,omitempty"`
+	InStock   bool     `json:"in_stock,omitempty"`
+	MinRating *float64 `json:"min_rating,omitempty"`
+	MinPrice  *float64 `json:"min_price,omitempty"`
+	MaxPrice  *float64 `json:"max_price,omitempty"`
+}
+
+// How many items each filter value would leave, counted with the other
+// filters applied
+type BrowseFacets struct {
+	Brands []struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	} `json:"brands"`
+	Sizes []struct {
+		Size  string `json:"size"`
+		Count int    `json:"count"`
+	} `json:"sizes"`
+	Ratings []struct {
+		MinRating int `json:"min_rating"`
+		Count     int `json:"count"`
+	} `json:"ratings"`
+	InStock  int      `json:"in_stock"`
+	MinPrice *float64 `json:"min_price"`
+	MaxPrice *float64 `json:"max_price"`
 }
 
 type Detail struct {
-	ItemName            string   `json:"item_name"`
-	BrandName           string   `json:"brand_name"`
-	Rating              float64  `json:"rating"`
-	Description         string   `json:"description"`
-	ImageUrls           []string `json:"image_urls"`
-	ThumbnailUrl        string   `json:"thumbnail_url"`
+	ItemName     string        `json:"item_name"`
+	BrandName    string        `json:"brand_name"`
+	Rating       float64       `json:"rating"`
+	Discontinued bool          `json:"discontinued"`
+	Price        *Price        `json:"price"`
+	PriceHistory []PriceChange `json:"price_history"`
+	Description  string        `json:"description"`
+	ImageUrls    []string      `json:"image_urls"`
+	Images       []struct {
+		Url  string `json:"url"`
+		Hash string `json:"hash"`
+	} `json:"images"`
+	ThumbnailUrl        string `json:"thumbnail_url"`
 	ItemSpecificDetails []struct {
 		Size    string `json:"size"`
 		InStock bool   `json:"in_stock"`
@@ -31,18 +101,27 @@ type Detail struct {
 	Tags     []string `json:"tags"`
 	MoreLike struct {
 		SameBrand []struct {
-			ItemName     string `json:"item_name"`
-			BrandName    string `json:"brand_name"`
-			ThumbnailUrl string `json:"thumbnail_url"`
+			ItemName      string `json:"item_name"`
+			BrandName     string `json:"brand_name"`
+			ThumbnailUrl  string `json:"thumbnail_url"`
+			ThumbnailHash string `json:"thumbnail_hash"`
+			Price         *Price `json:"price"`
 		} `json:"more_from_brand"`
 		SimilarItems []struct {
-			ItemName     string `json:"item_name"`
-			BrandName    string `json:"brand_name"`
-			ThumbnailUrl string `json:"thumbnail_url"`
+			ItemName      string `json:"item_name"`
+			BrandName     string `json:"brand_name"`
+			ThumbnailUrl  string `json:"thumbnail_url"`
+			ThumbnailHash string `json:"thumbnail_hash"`
+			Price         *Price `json:"price"`
 		} `json:"similar_items"`
 	} `json:"more_like"`
 }
 
+type Tag struct {
+	Name      string `json:"name"`
+	ItemCount int    `json:"item_count"`
+}
+
 type SearchBar struct {
 	Tags   []string `json:"tags"`
 	Brands []string `json:"brands"`
@@ -56,6 +135,62 @@ type SiteUser struct {
 	Email     string `json:"email"`
 	IsStaff   bool   `json:"is_staff"`
 	IsAdmin   bool   `json:"is_admin"`
+	// Some actions wait for this, depending on the accounts config
+	EmailVerified bool `json:"email_verified"`
+	// Whether the session the user was found by is a "remember me" one
+	Remember bool `json:"remember"`
+}
+
+// One device a user is signed in on
+type Session struct {
+	ID         int     `json:"id"`
+	UserAgent  *string `json:"user_agent"`
+	IPAddress  *string `json:"ip_address"`
+	CreatedAt  string  `json:"created_at"`
+	LastSeenAt string  `json:"last_seen_at"`
+	ExpiresAt  string  `json:"expires_at"`
+	Remember   bool    `json:"remember"`
+	Current    bool    `json:"current"`
+}
+
+// What api.site_user_authenticate made of a sign in.  Status is ok, failed
+// or locked, with the session token or when the lock lifts to go with it.
+type SignIn struct {
+	Status       string  `json:"status"`
+	SessionToken string  `json:"session_token"`
+	LockedUntil  *string `json:"locked_until"`
+}
+
+// One line of the auth_event log
+type AuthEvent struct {
+	ID        int64   `json:"id"`
+	Event     string  `json:"event"`
+	Username  *string `json:"username"`
+	Email     *string `json:"email"`
+	IPAddress *string `json:"ip_address"`
+	UserAgent *string `json:"user_agent"`
+	Detail    *string `json:"detail"`
+	CreatedAt string  `json:"created_at"`
+}
+
+type AuthEventList struct {
+	Events     []AuthEvent `json:"events"`
+	TotalCount int         `json:"total_count"`
+	TotalPages int         `json:"total_pages"`
+}
+
+// Who a verification email goes to, from api.email_verification_send
+type EmailVerification struct {
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	Email     string `json:"email"`
+}
+
+// A reset link to email, from api.password_reset_request
+type PasswordResetRequest struct {
+	Token     string `json:"token"`
+	FirstName string `json:"first_name"`
+	Email     string `json:"email"`
 }
 
 type SiteUserCloset struct {
@@ -68,9 +203,269 @@ type SiteUserCloset struct {
 }
 
 type SiteUserClosetItem struct {
-	Notes        *string `json:"notes"`
-	AddedAt      string  `json:"added_at"`
-	BrandName    string  `json:"brand_name"`
-	ThumbnailUrl string  `json:"thumbnail_url"`
-	BaseItemName string  `json:"base_item_name"`
+	Notes         *string `json:"notes"`
+	AddedAt       string  `json:"added_at"`
+	BrandName     string  `json:"brand_name"`
+	ThumbnailUrl  string  `json:"thumbnail_url"`
+	ThumbnailHash string  `json:"thumbnail_hash"`
+	BaseItemName  string  `json:"base_item_name"`
+}
+
+type Cart struct {
+	// Only set for anonymous carts
+	CartToken *string    `json:"cart_token"`
+	Items     []CartItem `json:"items"`
+	ItemCount int        `json:"item_count"`
+	Currency  *string    `json:"currency"`
+	Subtotal  float64    `json:"subtotal"`
+}
+
+type CartItem struct {
+	ItemID        int    `json:"item_id"`
+	ItemName      string `json:"item_name"`
+	BrandName     string `json:"brand_name"`
+	Size          string `json:"size"`
+	Quantity      int    `json:"quantity"`
+	StockQuantity int    `json:"stock_quantity"`
+	// False when the item was discontinued or there is not enough stock
+	Available     bool     `json:"available"`
+	ThumbnailUrl  string   `json:"thumbnail_url"`
+	ThumbnailHash string   `json:"thumbnail_hash"`
+	Price         *Price   `json:"price"`
+	LineTotal     *float64 `json:"line_total"`
+}
+
+type Order struct {
+	// The order number customers see
+	ID               string              `json:"id"`
+	Status           string              `json:"status"`
+	CreatedAt        string              `json:"created_at"`
+	UpdatedAt        string              `json:"updated_at"`
+	Currency         string              `json:"currency"`
+	Subtotal         float64             `json:"subtotal"`
+	Total            float64             `json:"total"`
+	ShipToName       string              `json:"ship_to_name"`
+	ShipToAddress    string              `json:"ship_to_address"`
+	PaymentProvider  string              `json:"payment_provider"`
+	PaymentReference *string             `json:"payment_reference"`
+	ItemCount        int                 `json:"item_count"`
+	Lines            []OrderLine         `json:"lines"`
+	History          []OrderStatusChange `json:"history"`
+}
+
+// An order the back office has still to send, with the member who placed it
+type AdminOrder struct {
+	Order
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+type OrderLine struct {
+	ItemID        int     `json:"item_id"`
+	ItemName      string  `json:"item_name"`
+	BrandName     string  `json:"brand_name"`
+	Size          string  `json:"size"`
+	Quantity      int     `json:"quantity"`
+	UnitPrice     float64 `json:"unit_price"`
+	LineTotal     float64 `json:"line_total"`
+	ThumbnailUrl  string  `json:"thumbnail_url"`
+	ThumbnailHash string  `json:"thumbnail_hash"`
+}
+
+type OrderStatusChange struct {
+	Status    string  `json:"status"`
+	Note      *string `json:"note"`
+	ChangedAt string  `json:"changed_at"`
+}
+
+// Orders can only be cancelled until they ship
+func (o Order) Cancellable() bool {
+	return o.Status == "pending" || o.Status == "paid"
+}
+
+type RentalPlan struct {
+	Name         string `json:"name"`
+	ItemsAtATime int    `json:"items_at_a_time"`
+	// Nil means unlimited
+	SwapsPerMonth *int    `json:"swaps_per_month"`
+	RentalDays    int     `json:"rental_days"`
+	Currency      string  `json:"currency"`
+	MonthlyPrice  float64 `json:"monthly_price"`
+}
+
+type RentalSubscription struct {
+	Plan        RentalPlan `json:"plan"`
+	Status      string     `json:"status"`
+	StartedAt   string     `json:"started_at"`
+	CancelledAt *string    `json:"cancelled_at"`
+	// The current month, swap allowances reset at PeriodEnd
+	PeriodStart string `json:"period_start"`
+	PeriodEnd   string `json:"period_end"`
+	ItemsOut    int    `json:"items_out"`
+	SlotsLeft   int    `json:"slots_left"`
+	SwapsUsed   int    `json:"swaps_used"`
+	// Nil means unlimited
+	SwapsLeft *int `json:"swaps_left"`
+}
+
+type Rental struct {
+	ID              int     `json:"id"`
+	Status          string  `json:"status"`
+	ItemID          int     `json:"item_id"`
+	ItemName        string  `json:"item_name"`
+	BrandName       string  `json:"brand_name"`
+	Size            string  `json:"size"`
+	ClosetName      *string `json:"closet_name"`
+	RentedAt        string  `json:"rented_at"`
+	DueAt           string  `json:"due_at"`
+	Overdue         bool    `json:"overdue"`
+	ReturnStartedAt *string `json:"return_started_at"`
+	ReturnedAt      *string `json:"returned_at"`
+	ConditionNote   *string `json:"condition_note"`
+	ThumbnailUrl    string  `json:"thumbnail_url"`
+	ThumbnailHash   string  `json:"thumbnail_hash"`
+}
+
+// A rental the back office is waiting on, with the member who has it
+type AdminRental struct {
+	Rental
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+type SiteUserRentals struct {
+	// Nil when the user has no active plan
+	Subscription *RentalSubscription `json:"subscription"`
+	// Open rentals first, then the rest newest first
+	Rentals []Rental `json:"rentals"`
+}
+
+type ClosetRental struct {
+	Rented  []Rental           `json:"rented"`
+	Skipped []ClosetRentalSkip `json:"skipped"`
+}
+
+type ClosetRentalSkip struct {
+	ItemName  string `json:"item_name"`
+	BrandName string `json:"brand_name"`
+	Reason    string `json:"reason"`
+}
+
+type AdminItemList struct {
+	Items      []AdminItemSummary `json:"items"`
+	TotalCount int                `json:"total_count"`
+	TotalPages int                `json:"total_pages"`
+}
+
+type AdminItemSummary struct {
+	ID             int     `json:"id"`
+	Name           string  `json:"name"`
+	BrandName      *string `json:"brand_name"`
+	DiscontinuedAt *string `json:"discontinued_at"`
+	SizeCount      int     `json:"size_count"`
+	StockQuantity  int     `json:"stock_quantity"`
+	ThumbnailUrl   string  `json:"thumbnail_url"`
+	ThumbnailHash  string  `json:"thumbnail_hash"`
+}
+
+type AdminItem struct {
+	ID             int              `json:"id"`
+	Name           string           `json:"name"`
+	Description    *string          `json:"description"`
+	BrandName      *string          `json:"brand_name"`
+	Rating         *float64         `json:"rating"`
+	Source         *string          `json:"source"`
+	SourceID       *string          `json:"source_id"`
+	Added          string           `json:"added"`
+	UpdatedAt      *string          `json:"updated_at"`
+	DiscontinuedAt *string          `json:"discontinued_at"`
+	Price          *Price           `json:"price"`
+	Tags           []string         `json:"tags"`
+	Images         []AdminItemImage `json:"images"`
+	Sizes          []AdminItemSize  `json:"sizes"`
+}
+
+type AdminItemImage struct {
+	ImageID     int     `json:"image_id"`
+	Url         string  `json:"url"`
+	ContentHash string  `json:"content_hash"`
+	Alt         *string `json:"alt"`
+	IsThumbnail bool    `json:"is_thumbnail"`
+}
+
+type AdminItemSize struct {
+	ItemID           int    `json:"item_id"`
+	Size             string `json:"size"`
+	StockQuantity    int    `json:"stock_quantity"`
+	ReorderThreshold int    `json:"reorder_threshold"`
+}
+
+type LedgerEntry struct {
+	ID               int     `json:"id"`
+	TransactionDate  string  `json:"transaction_date"`
+	TransactionEvent string  `json:"transaction_event"`
+	ItemID           int     `json:"item_id"`
+	Size             *string `json:"size"`
+	DeltaQuantity    int     `json:"delta_quantity"`
+	// Stock of this size after the transaction
+	Balance     int     `json:"balance"`
+	OrderNumber *string `json:"order_number"`
+	RentalID    *int    `json:"rental_id"`
+}
+
+// A brand or tag in the back office
+type AdminName struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	ItemCount int    `json:"item_count"`
+}
+
+// One row of an inventory import as it was read, with what it does to stock
+type InventoryImportRow struct {
+	Line        int     `json:"line"`
+	Brand       string  `json:"brand"`
+	Item        string  `json:"item"`
+	Size        string  `json:"size"`
+	Event       string  `json:"event"`
+	Quantity    string  `json:"quantity"`
+	ItemID      *int    `json:"item_id"`
+	StockBefore *int    `json:"stock_before"`
+	StockAfter  *int    `json:"stock_after"`
+	Error       *string `json:"error"`
+}
+
+type InventoryImport struct {
+	Rows       []InventoryImportRow `json:"rows"`
+	RowCount   int                  `json:"row_count"`
+	ErrorCount int                  `json:"error_count"`
+	// False for dry runs and when any row has an error
+	Applied bool `json:"applied"`
+}
+
+// Stock of one size of an item
+type InventoryLevel struct {
+	Brand         string `json:"brand"`
+	Item          string `json:"item"`
+	Size          string `json:"size"`
+	ItemID        int    `json:"item_id"`
+	StockQuantity int    `json:"stock_quantity"`
+	// On the shelves, including what open orders have reserved
+	PhysicalStock int  `json:"physical_stock"`
+	Discontinued  bool `json:"discontinued"`
+}
+
+// A size that is low on or out of stock
+type StockAlert struct {
+	// Zero on the stock dashboard when the alert job has not seen it yet
+	ID               int     `json:"id"`
+	ItemID           int     `json:"item_id"`
+	BaseItemID       int     `json:"base_item_id"`
+	Brand            *string `json:"brand"`
+	Item             string  `json:"item"`
+	Size             *string `json:"size"`
+	Level            string  `json:"level"`
+	StockQuantity    int     `json:"stock_quantity"`
+	ReorderThreshold int     `json:"reorder_threshold"`
+	RaisedAt         *string `json:"raised_at"`
+	NotifiedAt       *string `json:"notified_at"`
 }
@@ -1,7 +0,0 @@
-DROP SCHEMA IF EXISTS public CASCADE;
-
-CREATE SCHEMA public;
-
-DROP SCHEMA IF EXISTS item CASCADE;
-
-DROP SCHEMA IF EXISTS api CASCADE;
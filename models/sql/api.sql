@@ -0,0 +1,3312 @@
+DROP SCHEMA IF EXISTS api CASCADE;
+
+CREATE SCHEMA api;
+
+-- Current price of a base item, or null when it has never been priced
+CREATE FUNCTION api.price (p_base_item_id INTEGER) RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT jsonb_build_object(
+    'currency',   currency,
+    'list_price', list_price,
+    'sale_price', sale_price,
+    'price',      price
+)
+FROM current_base_item_price
+WHERE base_item_id = p_base_item_id;
+$$;
+
+-- An item as browse listings show it
+CREATE FUNCTION api.browse_item (p_base_item_id INTEGER) RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT jsonb_build_object(
+    'base_item_id', base_item.base_item_id,
+    'brand_name', brand.name,
+    'item_name', base_item.name,
+    'description', base_item.description,
+    'thumbnail_url', image.url,
+    'thumbnail_hash', image.content_hash,
+    'price', api.price(base_item.base_item_id)
+)
+FROM base_item
+JOIN brand USING (brand_id)
+LEFT JOIN image ON base_item.thumbnail_image_id = image.image_id
+WHERE base_item.base_item_id = p_base_item_id;
+$$;
+
+/*
+Every item with all of p_include_tags, and matching p_query when there is
+one, with whether each filter lets it through and its place in the sort.
+
+Filters are {brands, sizes, in_stock, min_rating, min_price, max_price}, any
+of which can be left out.  A size only matches while it is in stock.
+
+p_sort is newest, rating, price-low, price-high, name or popular (most added
+to closets).  Null keeps catalogue order, or puts the best matches first when
+there is a p_query to match.
+
+Items are ordered by (sort_missing, sort_number, sort_text, base_item_id),
+all non-null so the tuple can be compared directly for keyset pagination.
+Descending sorts are negated to fit.
+*/
+CREATE FUNCTION api.browse_candidates (
+    p_include_tags TEXT[],
+    p_filters JSONB,
+    p_sort TEXT,
+    p_query TEXT
+) RETURNS TABLE (
+    base_item_id INTEGER,
+    brand_name CITEXT,
+    price NUMERIC,
+    available_sizes CITEXT[],
+    brand_ok BOOLEAN,
+    size_ok BOOLEAN,
+    stock_ok BOOLEAN,
+    rating_ok BOOLEAN,
+    price_ok BOOLEAN,
+    sort_missing BOOLEAN,
+    sort_number NUMERIC,
+    sort_text TEXT
+) AS $$
+#variable_conflict use_column
+DECLARE
+    v_brands           citext[];
+    v_sizes            citext[];
+    v_in_stock         boolean;
+    v_min_rating       numeric;
+    v_min_price        numeric;
+    v_max_price        numeric;
+
+    v_query            text;
+    v_tsquery          tsquery;
+BEGIN
+    p_sort := NULLIF(p_sort, '');
+    IF p_sort NOT IN ('newest', 'rating', 'price-low', 'price-high', 'name', 'popular') THEN
+        RAISE EXCEPTION 'Unknown sort "%"', p_sort USING ERRCODE = 'UE000';
+    END IF;
+
+    v_query := NULLIF(TRIM(immutable_unaccent(p_query)), '');
+    v_tsquery := websearch_to_tsquery('english', COALESCE(v_query, ''));
+
+    p_filters := COALESCE(p_filters, '{}'::jsonb);
+    v_brands := NULLIF(ARRAY(SELECT jsonb_array_elements_text(COALESCE(p_filters->'brands', '[]'::jsonb))), '{}')::citext[];
+    v_sizes := NULLIF(ARRAY(SELECT jsonb_array_elements_text(COALESCE(p_filters->'sizes', '[]'::jsonb))), '{}')::citext[];
+    v_in_stock := COALESCE((p_filters->>'in_stock')::boolean, FALSE);
+    v_min_rating := (p_filters->>'min_rating')::numeric;
+    v_min_price := (p_filters->>'min_price')::numeric;
+    v_max_price := (p_filters->>'max_price')::numeric;
+
+    RETURN QUERY
+    WITH
+    input_tags AS (
+        SELECT DISTINCT unnest(COALESCE(p_include_tags, ARRAY[]::text[]))::citext AS tag_name
+    ),
+    input_counts AS (
+        SELECT COUNT(*)::int AS n
+        FROM input_tags
+    ),
+    resolved_tags AS (
+        SELECT t.tag_id
+        FROM tag t
+        JOIN input_tags i ON i.tag_name = t.name  -- assumes tag.name is citext (or comparable)
+    ),
+    resolved_counts AS (
+        SELECT COUNT(*)::int AS n
+        FROM (SELECT DISTINCT tag_id FROM resolved_tags) s
+    ),
+    matched_base_items AS (
+        /*
+          If no tags were provided -> all base_item_ids.
+          Else -> items that have all resolved tags.
+        */
+        SELECT bi.base_item_id
+        FROM base_item bi
+        CROSS JOIN input_counts ic
+        CROSS JOIN resolved_counts rc
+        LEFT JOIN tag_item ti
+               ON ti.base_item_id = bi.base_item_id
+              AND ti.tag_id IN (SELECT tag_id FROM resolved_tags)
+        WHERE bi.discontinued_at IS NULL
+        GROUP BY bi.base_item_id, ic.n, rc.n
+        HAVING
+            (ic.n = 0)                             -- no filter
+            OR (
+                ic.n = rc.n                        -- strict: all input tags must exist
+                AND COUNT(DISTINCT ti.tag_id) = ic.n
+            )
+    ),
+    /*
+      Full text matches, plus trigram matches on name, brand and tags so a
+      misspelt word still finds something.
+    */
+    search_matches AS (
+        SELECT
+            bi.base_item_id,
+            ts_rank_cd(bi.search_document, v_tsquery) * 2 + word_similarity(v_query, bi.search_text) AS rank
+        FROM base_item bi
+        WHERE v_query IS NOT NULL
+          AND (bi.search_document @@ v_tsquery OR v_query <% bi.search_text)
+    ),
+    candidates AS (
+        SELECT
+            m.base_item_id,
+            b.name AS brand_name,
+            bi.rating,
+            p.price,
+            ARRAY(
+                SELECT ic.basic_size
+                FROM item i
+                JOIN item.clothing ic ON ic.item_id = i.item_id
+                JOIN inventory inv ON inv.item_id = i.item_id
+                WHERE i.base_item_id = m.base_item_id
+                  AND inv.stock_quantity > 0
+            )::citext[] AS available_sizes,
+            CASE p_sort
+                WHEN 'newest' THEN -EXTRACT(EPOCH FROM bi.added)
+                WHEN 'rating' THEN -bi.rating
+                WHEN 'price-low' THEN p.price
+                WHEN 'price-high' THEN -p.price
+                WHEN 'popular' THEN -(
+                    SELECT COUNT(*) FROM closet_item ci WHERE ci.item_id = m.base_item_id
+                )
+                ELSE -sm.rank::numeric
+            END AS sort_number,
+            CASE WHEN p_sort = 'name' THEN LOWER(bi.name) END AS sort_text
+        FROM matched_base_items m
+        JOIN base_item bi ON bi.base_item_id = m.base_item_id
+        JOIN brand b ON b.brand_id = bi.brand_id
+        LEFT JOIN current_base_item_price p ON p.base_item_id = m.base_item_id
+        LEFT JOIN search_matches sm ON sm.base_item_id = m.base_item_id
+        WHERE v_query IS NULL OR sm.base_item_id IS NOT NULL
+    )
+    SELECT
+        c.base_item_id,
+        c.brand_name,
+        c.price,
+        c.available_sizes,
+        (v_brands IS NULL OR c.brand_name = ANY (v_brands)),
+        (v_sizes IS NULL OR c.available_sizes && v_sizes),
+        (NOT v_in_stock OR cardinality(c.available_sizes) > 0),
+        (v_min_rating IS NULL OR c.rating >= v_min_rating),
+        (
+            (v_min_price IS NULL OR c.price >= v_min_price)
+            AND (v_max_price IS NULL OR c.price <= v_max_price)
+        ),
+        -- items without a price, rating and so on go last
+        c.sort_number IS NULL AND c.sort_text IS NULL,
+        COALESCE(c.sort_number, 0),
+        COALESCE(c.sort_text, '')
+    FROM candidates c;
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+/*
+A page of items by page number, with the total count and facets for the
+filter sidebar.  Each facet is counted with every filter applied except its
+own, so picking a brand still shows how many items the other brands have.
+See api.browse_candidates for the filters and sorts.
+*/
+CREATE FUNCTION api.browse (
+    p_page_index INTEGER,
+    p_items_per_page INTEGER,
+    p_include_tags TEXT[] DEFAULT NULL,
+    p_filters JSONB DEFAULT NULL,
+    p_sort TEXT DEFAULT NULL,
+    p_query TEXT DEFAULT NULL
+) RETURNS JSONB AS $$
+DECLARE
+    v_items            jsonb;
+    v_facets           jsonb;
+    v_total_count      integer;
+    v_total_pages      integer;
+BEGIN
+    IF p_page_index IS NULL OR p_page_index < 1 THEN
+        p_page_index := 1;
+    END IF;
+
+    IF p_items_per_page IS NULL OR p_items_per_page < 1 THEN
+        p_items_per_page := 24;
+    END IF;
+
+    WITH
+    checked AS (
+        SELECT * FROM api.browse_candidates(p_include_tags, p_filters, p_sort, p_query)
+    ),
+    filtered AS (
+        SELECT *
+        FROM checked
+        WHERE brand_ok AND size_ok AND stock_ok AND rating_ok AND price_ok
+    ),
+    total AS (
+        SELECT COUNT(*)::int AS total_count
+        FROM filtered
+    ),
+    page AS (
+        SELECT base_item_id, ordinal
+        FROM (
+            SELECT
+                f.base_item_id,
+                ROW_NUMBER() OVER (
+                    ORDER BY f.sort_missing, f.sort_number, f.sort_text, f.base_item_id
+                ) AS ordinal
+            FROM filtered f
+        ) ordered
+        WHERE ordinal > (p_page_index - 1) * p_items_per_page
+          AND ordinal <= p_page_index * p_items_per_page
+    ),
+    brand_facet AS (
+        SELECT COALESCE(jsonb_agg(jsonb_build_object('name', brand_name, 'count', n) ORDER BY brand_name), '[]'::jsonb) AS facet
+        FROM (
+            SELECT brand_name, COUNT(*) AS n
+            FROM checked
+            WHERE size_ok AND stock_ok AND rating_ok AND price_ok
+            GROUP BY brand_name
+        ) s
+    ),
+    size_facet AS (
+        SELECT COALESCE(jsonb_agg(jsonb_build_object('size', size, 'count', n) ORDER BY bs.relative_order), '[]'::jsonb) AS facet
+        FROM (
+            SELECT unnest(available_sizes) AS size, COUNT(*) AS n
+            FROM checked
+            WHERE brand_ok AND stock_ok AND rating_ok AND price_ok
+            GROUP BY 1
+        ) s
+        LEFT JOIN basic_size bs USING (size)
+    ),
+    rating_facet AS (
+        SELECT jsonb_agg(jsonb_build_object('min_rating', r.min_rating, 'count', (
+            SELECT COUNT(*)
+            FROM checked c
+            JOIN base_item bi ON bi.base_item_id = c.base_item_id
+            WHERE c.brand_ok AND c.size_ok AND c.stock_ok AND c.price_ok
+              AND bi.rating >= r.min_rating
+        )) ORDER BY r.min_rating DESC) AS facet
+        FROM generate_series(4, 1, -1) AS r (min_rating)
+    ),
+    other_facets AS (
+        SELECT
+            COUNT(*) FILTER (WHERE cardinality(available_sizes) > 0 AND brand_ok AND size_ok AND rating_ok AND price_ok) AS in_stock,
+            MIN(price) FILTER (WHERE brand_ok AND size_ok AND stock_ok AND rating_ok) AS min_price,
+            MAX(price) FILTER (WHERE brand_ok AND size_ok AND stock_ok AND rating_ok) AS max_price
+        FROM checked
+    )
+    SELECT
+        COALESCE((SELECT jsonb_agg(api.browse_item(page.base_item_id) ORDER BY page.ordinal) FROM page), '[]'::jsonb),
+        (SELECT total_count FROM total),
+        jsonb_build_object(
+            'brands', (SELECT facet FROM brand_facet),
+            'sizes', (SELECT facet FROM size_facet),
+            'ratings', (SELECT facet FROM rating_facet),
+            'in_stock', (SELECT in_stock FROM other_facets),
+            'min_price', (SELECT min_price FROM other_facets),
+            'max_price', (SELECT max_price FROM other_facets)
+        )
+    INTO
+        v_items,
+        v_total_count,
+        v_facets;
+
+    v_total_pages :=
+        CASE
+            WHEN v_total_count = 0 THEN 0
+            ELSE ((v_total_count + p_items_per_page - 1) / p_items_per_page)
+        END;
+
+    RETURN jsonb_build_object(
+        'total_pages', v_total_pages,
+        'total_count', v_total_count,
+        'items',       v_items,
+        'facets',      v_facets
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+/*
+The items after or before a cursor, for infinite scroll.  There is no count
+or facets and no offset to skip over, and items added while scrolling do
+not shift what comes next.
+
+A cursor is {"sort", "after" or "before": [sort_missing, sort_number,
+sort_text, base_item_id]}, as returned in next_cursor and prev_cursor.
+Callers should treat it as opaque.
+*/
+CREATE FUNCTION api.browse_cursor (
+    p_limit INTEGER,
+    p_cursor JSONB DEFAULT NULL,
+    p_include_tags TEXT[] DEFAULT NULL,
+    p_filters JSONB DEFAULT NULL,
+    p_sort TEXT DEFAULT NULL,
+    p_query TEXT DEFAULT NULL
+) RETURNS JSONB AS $$
+DECLARE
+    v_after   jsonb := p_cursor->'after';
+    v_before  jsonb := p_cursor->'before';
+    v_keys    jsonb;
+    v_count   integer;
+    v_more    boolean;
+    v_next    jsonb;
+    v_prev    jsonb;
+BEGIN
+    IF p_limit IS NULL OR p_limit < 1 THEN
+        p_limit := 24;
+    END IF;
+    p_sort := NULLIF(p_sort, '');
+
+    IF p_cursor IS NOT NULL AND (
+        COALESCE(p_cursor->>'sort', '') <> COALESCE(p_sort, '')
+        OR jsonb_typeof(COALESCE(v_after, v_before)) IS DISTINCT FROM 'array'
+        OR jsonb_array_length(COALESCE(v_after, v_before)) <> 4
+    ) THEN
+        RAISE EXCEPTION 'Invalid cursor' USING ERRCODE = 'UE000';
+    END IF;
+
+    -- the key is cast below, so a mistyped one is the client's error and
+    -- not a failed cast
+    v_keys := COALESCE(v_after, v_before);
+    IF v_keys IS NOT NULL AND NOT (
+        jsonb_typeof(v_keys->0) = 'boolean'
+        AND jsonb_typeof(v_keys->1) IN ('number', 'null')
+        AND (jsonb_typeof(v_keys->1) = 'null' OR v_keys->>1 ~ '^-?[0-9]{1,20}(\.[0-9]{1,20})?$')
+        AND jsonb_typeof(v_keys->2) IN ('string', 'null')
+        AND jsonb_typeof(v_keys->3) = 'number'
+        AND v_keys->>3 ~ '^[0-9]{1,9}$'
+    ) THEN
+        RAISE EXCEPTION 'Invalid cursor' USING ERRCODE = 'UE000';
+    END IF;
+
+    -- one more than asked for, to know whether there is more
+    IF v_before IS NULL THEN
+        SELECT COALESCE(jsonb_agg(k.key ORDER BY k.n), '[]'::jsonb)
+        INTO v_keys
+        FROM (
+            SELECT
+                jsonb_build_array(c.sort_missing, c.sort_number, c.sort_text, c.base_item_id) AS key,
+                ROW_NUMBER() OVER (ORDER BY c.sort_missing, c.sort_number, c.sort_text, c.base_item_id) AS n
+            FROM api.browse_candidates(p_include_tags, p_filters, p_sort, p_query) c
+            WHERE c.brand_ok AND c.size_ok AND c.stock_ok AND c.rating_ok AND c.price_ok
+              AND (
+                v_after IS NULL
+                OR (c.sort_missing, c.sort_number, c.sort_text, c.base_item_id)
+                   > ((v_after->>0)::boolean, (v_after->>1)::numeric, v_after->>2, (v_after->>3)::integer)
+              )
+            ORDER BY c.sort_missing, c.sort_number, c.sort_text, c.base_item_id
+            LIMIT p_limit + 1
+        ) k;
+    ELSE
+        SELECT COALESCE(jsonb_agg(k.key ORDER BY k.n DESC), '[]'::jsonb)
+        INTO v_keys
+        FROM (
+            SELECT
+                jsonb_build_array(c.sort_missing, c.sort_number, c.sort_text, c.base_item_id) AS key,
+                ROW_NUMBER() OVER (ORDER BY c.sort_missing DESC, c.sort_number DESC, c.sort_text DESC, c.base_item_id DESC) AS n
+            FROM api.browse_candidates(p_include_tags, p_filters, p_sort, p_query) c
+            WHERE c.brand_ok AND c.size_ok AND c.stock_ok AND c.rating_ok AND c.price_ok
+              AND (c.sort_missing, c.sort_number, c.sort_text, c.base_item_id)
+                  < ((v_before->>0)::boolean, (v_before->>1)::numeric, v_before->>2, (v_before->>3)::integer)
+            ORDER BY c.sort_missing DESC, c.sort_number DESC, c.sort_text DESC, c.base_item_id DESC
+            LIMIT p_limit + 1
+        ) k;
+    END IF;
+
+    v_count := jsonb_array_length(v_keys);
+    v_more := v_count > p_limit;
+    IF v_more THEN
+        -- the extra key is the one furthest in the direction of travel
+        IF v_before IS NULL THEN
+            v_keys := v_keys - p_limit;
+        ELSE
+            v_keys := v_keys - 0;
+        END IF;
+        v_count := p_limit;
+    END IF;
+
+    IF v_count > 0 THEN
+        IF v_before IS NULL AND v_more OR v_before IS NOT NULL THEN
+            v_next := jsonb_build_object('sort', COALESCE(p_sort, ''), 'after', v_keys->(v_count - 1));
+        END IF;
+        IF v_after IS NOT NULL OR v_before IS NOT NULL AND v_more THEN
+            v_prev := jsonb_build_object('sort', COALESCE(p_sort, ''), 'before', v_keys->0);
+        END IF;
+    END IF;
+
+    RETURN jsonb_build_object(
+        'items', (
+            SELECT COALESCE(jsonb_agg(api.browse_item((k.key->>3)::integer) ORDER BY k.n), '[]'::jsonb)
+            FROM jsonb_array_elements(v_keys) WITH ORDINALITY AS k (key, n)
+        ),
+        'next_cursor', v_next,
+        'prev_cursor', v_prev
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- Items matching p_query, best matches first unless p_sort says otherwise.
+-- api.browse does the work, so results, filters and facets look the same.
+CREATE FUNCTION api.search (
+    p_query TEXT,
+    p_page_index INTEGER,
+    p_items_per_page INTEGER,
+    p_filters JSONB DEFAULT NULL,
+    p_sort TEXT DEFAULT NULL
+) RETURNS JSONB AS $$
+BEGIN
+    IF NULLIF(TRIM(p_query), '') IS NULL THEN
+        RAISE EXCEPTION 'Enter something to search for' USING ERRCODE = 'UE000';
+    END IF;
+
+    RETURN api.browse(p_page_index, p_items_per_page, NULL, p_filters, p_sort, p_query);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.similar_items (
+    p_base_item_name CITEXT,
+    p_brand_name CITEXT,
+    p_limit INTEGER
+) RETURNS JSONB LANGUAGE sql STABLE AS $$
+WITH seed AS (
+    SELECT bi.base_item_id
+    FROM base_item bi
+    JOIN brand b ON b.brand_id = bi.brand_id
+    WHERE bi.name = p_base_item_name
+      AND b.name  = p_brand_name
+    LIMIT 1
+),
+seed_tags AS (
+    SELECT ti.tag_id
+    FROM tag_item ti
+    JOIN seed s ON s.base_item_id = ti.base_item_id
+),
+scored AS (
+    SELECT
+        bi.base_item_id,
+        bi.name AS item_name,
+        b.name  AS brand_name,
+        img.url AS thumbnail_url,
+        img.content_hash AS thumbnail_hash,
+        api.price(bi.base_item_id) AS price,
+        COUNT(*)::INT AS shared_tag_count
+    FROM seed s
+    JOIN seed_tags st ON TRUE
+    JOIN tag_item ti2
+      ON ti2.tag_id = st.tag_id
+     AND ti2.base_item_id <> s.base_item_id
+    JOIN base_item bi
+      ON bi.base_item_id = ti2.base_item_id
+     AND bi.discontinued_at IS NULL
+    LEFT JOIN brand b
+      ON b.brand_id = bi.brand_id
+    LEFT JOIN image img
+      ON img.image_id = bi.thumbnail_image_id
+    GROUP BY
+        bi.base_item_id, bi.name, b.name, img.url, img.content_hash
+)
+SELECT COALESCE(
+    jsonb_agg(
+        jsonb_build_object(
+            'item_name', item_name,
+            'brand_name', brand_name,
+            'thumbnail_url', thumbnail_url,
+            'thumbnail_hash', thumbnail_hash,
+            'price', price
+        )
+        ORDER BY
+            shared_tag_count DESC,
+            item_name ASC
+    ),
+    '[]'::jsonb
+)
+FROM (
+    SELECT item_name, brand_name, thumbnail_url, thumbnail_hash, price, shared_tag_count
+    FROM scored
+    ORDER BY
+        shared_tag_count DESC,
+        item_name ASC
+    LIMIT GREATEST(p_limit, 0)
+) t;
+$$;
+
+CREATE OR REPLACE FUNCTION api.more_from_brand (
+    p_base_item_name CITEXT,
+    p_brand_name CITEXT,
+    p_limit INTEGER DEFAULT 4
+) RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        jsonb_build_object(
+            'item_name',      item_name,
+            'brand_name',     brand_name,
+            'thumbnail_url',  thumbnail_url,
+            'thumbnail_hash', thumbnail_hash,
+            'price',          price
+        )
+        ORDER BY item_name
+    ),
+    '[]'::jsonb
+)
+FROM (
+    SELECT
+        bi.name AS item_name,
+        b.name  AS brand_name,
+        img.url AS thumbnail_url,
+        img.content_hash AS thumbnail_hash,
+        api.price(bi.base_item_id) AS price
+    FROM base_item bi
+    JOIN brand b USING (brand_id)
+    LEFT JOIN image img
+        ON img.image_id = bi.thumbnail_image_id
+    WHERE bi.name <> p_base_item_name
+      AND b.name  = p_brand_name
+      AND bi.discontinued_at IS NULL
+    ORDER BY bi.name
+    LIMIT GREATEST(p_limit, 0)
+) t;
+$$;
+
+CREATE FUNCTION api.more_like (
+    p_base_item_name CITEXT,
+    p_brand_name CITEXT,
+    p_limit INTEGER DEFAULT 4
+) RETURNS JSONB AS $$
+DECLARE
+    v_similar_items JSONB;
+    v_more_from_brand JSONB;
+BEGIN
+    v_similar_items := api.similar_items(p_base_item_name, p_brand_name, p_limit);
+    v_more_from_brand := api.more_from_brand(p_base_item_name, p_brand_name, p_limit);
+    RETURN jsonb_build_object(
+        'similar_items', v_similar_items,
+        'more_from_brand', v_more_from_brand
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- quick and dirty searching for tags, brands, and base items
+CREATE FUNCTION api.search_bar (p_string CITEXT) RETURNS JSONB AS $$
+DECLARE
+    v_matching_tags TEXT[];
+    v_matching_brands TEXT[];
+    v_matching_items TEXT[];
+    v_max_results INTEGER := 5;
+BEGIN
+    v_matching_tags := ARRAY(
+        SELECT name FROM tag
+        WHERE unaccent(name) ILIKE unaccent('%' || p_string || '%')
+        ORDER BY
+            CASE WHEN unaccent(name) ILIKE unaccent(p_string || '%') THEN 0 ELSE 1 END,
+            unaccent(name)
+        LIMIT v_max_results
+    );
+    v_matching_brands := ARRAY(
+        SELECT name FROM brand
+        WHERE unaccent(name) ILIKE unaccent('%' || p_string || '%')
+        ORDER BY
+            CASE WHEN unaccent(name) ILIKE unaccent(p_string || '%') THEN 0 ELSE 1 END,
+            unaccent(name)
+        LIMIT v_max_results
+    );
+    v_matching_items := ARRAY(
+        SELECT name FROM base_item
+        WHERE unaccent(name) ILIKE unaccent('%' || p_string || '%')
+          AND discontinued_at IS NULL
+        ORDER BY
+            CASE WHEN unaccent(name) ILIKE unaccent(p_string || '%') THEN 0 ELSE 1 END,
+            unaccent(name)
+        LIMIT v_max_results
+    );
+
+    RETURN jsonb_build_object(
+        'tags', v_matching_tags,
+        'brands', v_matching_brands,
+        'items', v_matching_items
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.brands () RETURNS JSONB AS $$
+DECLARE
+    brands JSONB;
+BEGIN
+    SELECT COALESCE(
+        jsonb_object_agg(
+            initial,
+            brand_names
+        ),
+        '{}'::jsonb
+    )
+    FROM (
+        SELECT CASE
+                 WHEN SUBSTRING(unaccent(name), 1, 1) ~ '^[0-9]' THEN '#'
+                 ELSE UPPER(SUBSTRING(unaccent(name), 1, 1))
+               END AS initial,
+               jsonb_agg(name ORDER BY unaccent(name)) AS brand_names
+        FROM brand
+        GROUP BY initial
+        ORDER BY initial
+    ) b INTO brands;
+    RETURN brands;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Every tag with how many items in the catalogue carry it
+CREATE FUNCTION api.tags () RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        jsonb_build_object(
+            'name', t.name,
+            'item_count', (
+                SELECT COUNT(*)
+                FROM tag_item ti
+                JOIN base_item bi USING (base_item_id)
+                WHERE ti.tag_id = t.tag_id AND bi.discontinued_at IS NULL
+            )
+        ) ORDER BY t.name
+    ),
+    '[]'::jsonb
+)
+FROM tag t;
+$$;
+
+CREATE FUNCTION api.detail (
+    p_base_item_name CITEXT,
+    p_brand_name CITEXT DEFAULT NULL
+) RETURNS JSONB AS $$
+DECLARE
+    v_base_item_id INTEGER;
+    v_brand_name CITEXT;
+    v_description TEXT;
+    v_rating NUMERIC(2, 1);
+    v_discontinued BOOLEAN;
+    v_price_history JSONB;
+    v_image_urls TEXT[];
+    v_images JSONB;
+    v_item_specific_details JSONB;
+BEGIN
+    IF p_base_item_name IS NULL THEN
+        RAISE EXCEPTION '"Base item name" is required';
+    END IF;
+
+    -- if brand is not provided
+    v_brand_name := p_brand_name;
+    IF v_brand_name IS NULL THEN
+        SELECT brand.name FROM brand
+        JOIN base_item USING (brand_id)
+        WHERE base_item.name = p_base_item_name
+        LIMIT 1 INTO v_brand_name;
+    END IF;
+    IF v_brand_name IS NULL THEN
+        RAISE EXCEPTION 'Could not determine brand for base item "%" - please provide brand name', p_base_item_name
+            USING ERRCODE = 'UE000';
+    END IF;
+    
+    v_base_item_id := (SELECT base_item_id FROM base_item
+                       JOIN brand USING (brand_id)
+                       WHERE base_item.name = p_base_item_name
+                         AND brand.name = v_brand_name);
+    IF v_base_item_id IS NULL THEN
+        RAISE EXCEPTION 'Could not find base item "%" for brand "%"', p_base_item_name, v_brand_name
+            USING ERRCODE = 'UE000';
+    END IF;
+
+    v_description := (SELECT description FROM base_item WHERE base_item_id = v_base_item_id);   
+
+    v_image_urls := (SELECT COALESCE(array_agg(url), '{}')
+    FROM image JOIN base_item_image USING (image_id)
+    WHERE base_item_image.base_item_id = v_base_item_id);
+
+    v_images := (SELECT COALESCE(
+        jsonb_agg(jsonb_build_object('url', url, 'hash', content_hash) ORDER BY url),
+        '[]'::jsonb
+    )
+    FROM image JOIN base_item_image USING (image_id)
+    WHERE base_item_image.base_item_id = v_base_item_id);
+
+    v_rating := (SELECT rating FROM base_item WHERE base_item_id = v_base_item_id);
+
+    v_discontinued := (SELECT discontinued_at IS NOT NULL FROM base_item WHERE base_item_id = v_base_item_id);
+
+    v_price_history := (SELECT COALESCE(
+        jsonb_agg(
+            jsonb_build_object(
+                'currency', currency,
+                'list_price', list_price,
+                'sale_price', sale_price,
+                'effective_from', effective_from,
+                'effective_to', effective_to
+            ) ORDER BY effective_from DESC
+        ),
+        '[]'::jsonb
+    )
+    FROM base_item_price
+    WHERE base_item_id = v_base_item_id);
+
+    -- BEGIN KLUDGE
+    -- This assumes it is always item.clothing
+    v_item_specific_details := (
+        SELECT COALESCE(
+            jsonb_agg(
+                jsonb_build_object(
+                    'size', ic.basic_size,
+                    'in_stock', COALESCE(inv.stock_quantity, 0) > 0
+                ) ORDER BY bs.relative_order
+            ),
+            '[]'::jsonb
+        )
+        FROM item.clothing ic
+        JOIN item i ON ic.item_id = i.item_id
+        JOIN basic_size bs ON ic.basic_size = bs.size
+        LEFT JOIN inventory inv ON i.item_id = inv.item_id
+        WHERE i.base_item_id = v_base_item_id
+    ); -- END KLUDGE
+
+    RETURN jsonb_build_object(
+        'item_name', p_base_item_name,
+        'brand_name', v_brand_name,
+        'description', v_description,
+        'image_urls', v_image_urls,
+        'images', v_images,
+        'rating', v_rating,
+        'discontinued', v_discontinued,
+        'price', api.price(v_base_item_id),
+        'price_history', v_price_history,
+        'item_specific_details', v_item_specific_details,
+        'more_like', api.more_like(p_base_item_name, v_brand_name, 4)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- The item for one size of a base item, null when it isn't made in that size
+CREATE FUNCTION api.clothing_item_id (
+    p_base_item_name CITEXT,
+    p_brand_name CITEXT,
+    p_size CITEXT
+) RETURNS INTEGER LANGUAGE sql STABLE AS $$
+SELECT ic.item_id
+FROM item.clothing ic
+JOIN item i ON i.item_id = ic.item_id
+JOIN base_item bi ON bi.base_item_id = i.base_item_id
+JOIN brand b ON b.brand_id = bi.brand_id
+WHERE bi.name = p_base_item_name
+  AND b.name = p_brand_name
+  AND ic.basic_size = p_size
+ORDER BY ic.item_id
+LIMIT 1;
+$$;
+
+CREATE FUNCTION api.stock_quantity (p_item_id INTEGER) RETURNS INTEGER LANGUAGE sql STABLE AS $$
+SELECT COALESCE((SELECT stock_quantity FROM inventory WHERE item_id = p_item_id), 0)::INTEGER;
+$$;
+
+-- What is on the shelves, which still includes stock reserved for orders that
+-- have not shipped.  Audits count this, not what is left to sell.
+CREATE FUNCTION api.physical_stock (p_item_id INTEGER) RETURNS INTEGER LANGUAGE sql STABLE AS $$
+SELECT COALESCE(SUM(delta_quantity), 0)::INTEGER
+FROM inventory_transaction
+WHERE item_id = p_item_id
+  AND transaction_event NOT IN ('reserve', 'release');
+$$;
+
+-- Modify inventory
+CREATE FUNCTION api.transaction (
+    p_transaction_event TEXT,
+    p_item_id INTEGER,
+    p_quantity INTEGER DEFAULT 1
+) RETURNS VOID AS $$
+DECLARE
+    v_delta_quantity INTEGER;
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM transaction_event WHERE transaction_event = p_transaction_event)
+    THEN
+        RAISE EXCEPTION 'Invalid transaction event: %', p_transaction_event USING ERRCODE = 'UE000';
+    END IF;
+
+    -- reservations belong to an order, api.checkout makes them and
+    -- api.order_set_status releases or ships them
+    IF p_transaction_event IN ('reserve', 'release') THEN
+        RAISE EXCEPTION 'Stock is only reserved and released by orders' USING ERRCODE = 'UE000';
+    END IF;
+
+    IF p_transaction_event = 'audit' THEN
+        IF p_quantity IS NULL OR p_quantity < 0 THEN
+            RAISE EXCEPTION 'Audit sets inventory to this value.  It cannot be negative: %', p_quantity USING ERRCODE = 'UE000';
+        END IF;
+        -- the count is of the shelves, leave open reservations standing
+        v_delta_quantity := p_quantity - api.physical_stock(p_item_id);
+    
+    ELSIF p_quantity IS NULL OR p_quantity < 1 THEN
+        RAISE EXCEPTION 'Quantity must be at least 1' USING ERRCODE = 'UE000';
+
+    ELSIF p_transaction_event IN ('ship-out', 'scrap') THEN
+        v_delta_quantity := -p_quantity;
+    
+    ELSE
+        v_delta_quantity := p_quantity;
+    END IF;
+
+    INSERT INTO inventory_transaction (transaction_event, item_id, delta_quantity)
+    VALUES (p_transaction_event, p_item_id, v_delta_quantity);
+END;
+$$ LANGUAGE plpgsql;
+
+-- Staff and admin are loaded through the command line with this
+CREATE FUNCTION api.site_user_create (
+    p_first_name TEXT,
+    p_last_name TEXT,
+    p_username TEXT,
+    p_email CITEXT,
+    p_password TEXT,
+    p_is_staff BOOLEAN DEFAULT FALSE,
+    p_is_admin BOOLEAN DEFAULT FALSE,
+    p_email_verified BOOLEAN DEFAULT FALSE
+) RETURNS VOID AS $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM site_user WHERE username = p_username) THEN
+        RAISE EXCEPTION 'The username "%" is taken', p_username USING ERRCODE = 'UE000';
+    END IF;
+    IF EXISTS (SELECT 1 FROM site_user WHERE email = p_email) THEN
+        RAISE EXCEPTION 'There is already an account for %', p_email USING ERRCODE = 'UE000';
+    END IF;
+
+    INSERT INTO site_user (first_name, last_name, username, email, password_hash, is_staff, is_admin, email_verified_at)
+    VALUES (
+        p_first_name,
+        p_last_name,
+        p_username,
+        p_email,
+        crypt(p_password, gen_salt('bf')),
+        p_is_staff,
+        p_is_admin,
+        CASE WHEN p_email_verified THEN NOW() END
+    );
+
+    PERFORM api.site_user_add_closet(p_username, 'Favorites');
+END;
+$$ LANGUAGE plpgsql;
+
+-- The caller signs the new user in with api.site_user_authenticate, which
+-- knows the device
+CREATE FUNCTION api.site_user_signup (
+    p_first_name TEXT,
+    p_last_name TEXT,
+    p_username TEXT,
+    p_email CITEXT,
+    p_password TEXT
+) RETURNS VOID AS $$
+BEGIN
+    PERFORM api.site_user_create(p_first_name, p_last_name, p_username, p_email, p_password);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.site_users (p_staff_only BOOLEAN DEFAULT FALSE) RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        jsonb_build_object(
+            'first_name', su.first_name,
+            'last_name', su.last_name,
+            'username', su.username,
+            'email', su.email,
+            'is_staff', su.is_staff,
+            'is_admin', su.is_admin,
+            'email_verified', su.email_verified_at IS NOT NULL,
+            'created_at', su.created_at
+        ) ORDER BY su.username
+    ),
+    '[]'::jsonb
+)
+FROM site_user su
+WHERE NOT p_staff_only OR su.is_staff OR su.is_admin;
+$$;
+
+-- Grants or takes away 'staff' or 'admin'
+CREATE FUNCTION api.site_user_set_role (p_username TEXT, p_role TEXT, p_enabled BOOLEAN) RETURNS VOID AS $$
+BEGIN
+    IF p_role NOT IN ('staff', 'admin') THEN
+        RAISE EXCEPTION 'Unknown role "%", expected staff or admin', p_role USING ERRCODE = 'UE000';
+    END IF;
+
+    UPDATE site_user SET
+        is_staff = CASE WHEN p_role = 'staff' THEN p_enabled ELSE is_staff END,
+        is_admin = CASE WHEN p_role = 'admin' THEN p_enabled ELSE is_admin END,
+        updated_at = NOW()
+    WHERE username = p_username;
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'There is no user called "%"', p_username USING ERRCODE = 'UE000';
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Signs the user out everywhere
+CREATE FUNCTION api.site_user_set_password (p_username TEXT, p_password TEXT) RETURNS VOID AS $$
+DECLARE
+    v_site_user_id INTEGER;
+BEGIN
+    UPDATE site_user SET password_hash = crypt(p_password, gen_salt('bf')), updated_at = NOW()
+    WHERE username = p_username
+    RETURNING site_user_id INTO v_site_user_id;
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'There is no user called "%"', p_username USING ERRCODE = 'UE000';
+    END IF;
+
+    DELETE FROM session WHERE site_user_id = v_site_user_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.password_reset_token_hash (p_token TEXT) RETURNS TEXT LANGUAGE sql IMMUTABLE AS $$
+SELECT encode(digest(p_token, 'sha256'), 'hex');
+$$;
+
+/*
+Starts a password reset for the account with p_email, replacing any earlier
+link.  Returns the token to email along with who to send it to, or null when
+there is no such account, which callers should not reveal.
+*/
+CREATE FUNCTION api.password_reset_request (p_email CITEXT) RETURNS JSONB AS $$
+DECLARE
+    v_site_user site_user%ROWTYPE;
+    v_token TEXT := encode(gen_random_bytes(32), 'hex');
+BEGIN
+    SELECT * INTO v_site_user FROM site_user WHERE email = p_email;
+    IF NOT FOUND THEN
+        RETURN NULL;
+    END IF;
+
+    UPDATE password_reset SET used_at = NOW()
+    WHERE site_user_id = v_site_user.site_user_id AND used_at IS NULL;
+
+    INSERT INTO password_reset (site_user_id, token_hash, expires_at)
+    VALUES (v_site_user.site_user_id, api.password_reset_token_hash(v_token), NOW() + INTERVAL '1 hour');
+
+    RETURN jsonb_build_object(
+        'token', v_token,
+        'first_name', v_site_user.first_name,
+        'email', v_site_user.email
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- Whether p_token can still be used, so the form is not shown for dead links
+CREATE FUNCTION api.password_reset_valid (p_token TEXT) RETURNS BOOLEAN LANGUAGE sql STABLE AS $$
+SELECT EXISTS (
+    SELECT 1 FROM password_reset
+    WHERE token_hash = api.password_reset_token_hash(p_token)
+      AND used_at IS NULL
+      AND expires_at > NOW()
+);
+$$;
+
+-- Sets the password with a reset token, used up in doing so, and signs the
+-- user out everywhere
+CREATE FUNCTION api.password_reset (
+    p_token TEXT,
+    p_password TEXT,
+    p_ip_address TEXT DEFAULT NULL,
+    p_user_agent TEXT DEFAULT NULL
+) RETURNS VOID AS $$
+DECLARE
+    v_password_reset password_reset%ROWTYPE;
+BEGIN
+    SELECT * INTO v_password_reset
+    FROM password_reset
+    WHERE token_hash = api.password_reset_token_hash(p_token)
+    FOR UPDATE;
+    IF NOT FOUND OR v_password_reset.used_at IS NOT NULL OR v_password_reset.expires_at <= NOW() THEN
+        RAISE EXCEPTION 'This reset link has expired or has already been used' USING ERRCODE = 'UE000';
+    END IF;
+    IF COALESCE(p_password, '') = '' THEN
+        RAISE EXCEPTION 'Enter a new password' USING ERRCODE = 'UE000';
+    END IF;
+
+    UPDATE site_user SET
+        password_hash = crypt(p_password, gen_salt('bf')),
+        updated_at = NOW()
+    WHERE site_user_id = v_password_reset.site_user_id;
+
+    -- proving control of the email is enough to lift lockouts too
+    DELETE FROM sign_in_failure WHERE site_user_id = v_password_reset.site_user_id;
+
+    UPDATE password_reset SET used_at = NOW()
+    WHERE site_user_id = v_password_reset.site_user_id AND used_at IS NULL;
+
+    DELETE FROM session WHERE site_user_id = v_password_reset.site_user_id;
+
+    PERFORM api.auth_event_record('password_reset', NULL, p_ip_address, p_user_agent, NULL, v_password_reset.site_user_id);
+END;
+$$ LANGUAGE plpgsql;
+
+-- How long a session lasts from when it was last used
+CREATE FUNCTION api.session_lifetime (p_remember BOOLEAN) RETURNS INTERVAL LANGUAGE sql IMMUTABLE AS $$
+SELECT CASE WHEN p_remember THEN INTERVAL '30 days' ELSE INTERVAL '1 day' END;
+$$;
+
+/*
+Adds to the auth_event log.  Whichever of the email and account id is missing
+is filled in from the other, and there may be no account for the email.
+*/
+CREATE FUNCTION api.auth_event_record (
+    p_event TEXT,
+    p_email CITEXT,
+    p_ip_address TEXT DEFAULT NULL,
+    p_user_agent TEXT DEFAULT NULL,
+    p_detail TEXT DEFAULT NULL,
+    p_site_user_id INTEGER DEFAULT NULL
+) RETURNS VOID AS $$
+BEGIN
+    IF p_site_user_id IS NULL AND p_email IS NOT NULL THEN
+        SELECT site_user_id INTO p_site_user_id FROM site_user WHERE email = p_email;
+    ELSIF p_email IS NULL AND p_site_user_id IS NOT NULL THEN
+        SELECT email INTO p_email FROM site_user WHERE site_user_id = p_site_user_id;
+    END IF;
+
+    INSERT INTO auth_event (event, site_user_id, email, ip_address, user_agent, detail)
+    VALUES (
+        p_event,
+        p_site_user_id,
+        NULLIF(LEFT(p_email, 320), ''),
+        NULLIF(p_ip_address, '')::INET,
+        NULLIF(LEFT(p_user_agent, 512), ''),
+        p_detail
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- How long an address is locked out of an account after this many wrong
+-- passwords in a row.  Null for the first few, then a minute doubling with
+-- each one up to a day.
+CREATE FUNCTION api.sign_in_lockout (p_failed_sign_ins INTEGER) RETURNS INTERVAL LANGUAGE sql IMMUTABLE AS $$
+SELECT CASE
+    WHEN p_failed_sign_ins < 5 THEN NULL
+    ELSE LEAST(INTERVAL '1 minute' * power(2, LEAST(p_failed_sign_ins - 5, 11)), INTERVAL '1 day')
+END;
+$$;
+
+-- How long addresses new to an account wait between tries once this many
+-- wrong passwords have come from all addresses in the last day.  Slows
+-- guessing spread over many addresses, each of which gets its own
+-- sign_in_lockout.  Null below twenty, then a minute doubling with every ten
+-- more up to an hour.
+CREATE FUNCTION api.sign_in_account_lockout (p_failed_sign_ins INTEGER) RETURNS INTERVAL LANGUAGE sql IMMUTABLE AS $$
+SELECT CASE
+    WHEN p_failed_sign_ins < 20 THEN NULL
+    ELSE LEAST(INTERVAL '1 minute' * power(2, LEAST((p_failed_sign_ins - 20) / 10, 6)), INTERVAL '1 hour')
+END;
+$$;
+
+/*
+Starts a new session on the device signing in, leaving the user's other
+sessions alone.  The result has a status of ok with the session_token, failed
+when the email or password is wrong, or locked with locked_until when too
+many wrong passwords have been tried from p_ip_address, or from everywhere
+when p_ip_address has never signed in to the account.  Every attempt goes in
+auth_event.
+*/
+CREATE FUNCTION api.site_user_authenticate (
+    p_email CITEXT,
+    p_password TEXT,
+    p_user_agent TEXT DEFAULT NULL,
+    p_ip_address TEXT DEFAULT NULL,
+    p_remember BOOLEAN DEFAULT FALSE
+) RETURNS JSONB AS $$
+DECLARE
+    v_site_user site_user%ROWTYPE;
+    v_ip_address TEXT := COALESCE(p_ip_address, '');
+    v_failure sign_in_failure%ROWTYPE;
+    v_account_failures INTEGER;
+    v_account_locked_until TIMESTAMPTZ;
+    v_lockout INTERVAL;
+    v_session_token TEXT;
+BEGIN
+    SELECT * INTO v_site_user
+    FROM site_user
+    WHERE email = p_email
+    FOR UPDATE;
+    IF NOT FOUND THEN
+        PERFORM api.auth_event_record('sign_in_failed', p_email, p_ip_address, p_user_agent, 'No account with this email');
+        RETURN jsonb_build_object('status', 'failed');
+    END IF;
+
+    SELECT * INTO v_failure
+    FROM sign_in_failure
+    WHERE site_user_id = v_site_user.site_user_id AND ip_address = v_ip_address
+    FOR UPDATE;
+
+    -- a locked out address does not get the password checked at all, so
+    -- guessing while locked gets nowhere.  Other addresses carry on.
+    IF v_failure.locked_until > NOW() THEN
+        PERFORM api.auth_event_record('sign_in_locked', p_email, p_ip_address, p_user_agent, NULL, v_site_user.site_user_id);
+        RETURN jsonb_build_object('status', 'locked', 'locked_until', v_failure.locked_until);
+    END IF;
+
+    -- guessing from many addresses slows down for every address but the
+    -- ones the owner has signed in from before, so they can't be kept out
+    SELECT SUM(failed_sign_ins), MAX(updated_at) + api.sign_in_account_lockout(SUM(failed_sign_ins)::INTEGER)
+    INTO v_account_failures, v_account_locked_until
+    FROM sign_in_failure
+    WHERE site_user_id = v_site_user.site_user_id
+      AND updated_at > NOW() - INTERVAL '1 day';
+    IF v_account_locked_until > NOW() AND NOT EXISTS (
+        SELECT 1 FROM auth_event
+        WHERE site_user_id = v_site_user.site_user_id
+          AND event = 'sign_in'
+          AND ip_address = NULLIF(p_ip_address, '')::INET
+          AND created_at > NOW() - INTERVAL '90 days'
+    ) THEN
+        PERFORM api.auth_event_record(
+            'sign_in_locked', p_email, p_ip_address, p_user_agent,
+            format('%s wrong passwords for this account from addresses tried in the last day', v_account_failures),
+            v_site_user.site_user_id
+        );
+        RETURN jsonb_build_object('status', 'locked', 'locked_until', v_account_locked_until);
+    END IF;
+
+    IF v_site_user.password_hash IS NULL OR crypt(p_password, v_site_user.password_hash) <> v_site_user.password_hash THEN
+        INSERT INTO sign_in_failure (site_user_id, ip_address, failed_sign_ins)
+        VALUES (v_site_user.site_user_id, v_ip_address, 1)
+        ON CONFLICT (site_user_id, ip_address) DO UPDATE SET
+            failed_sign_ins = sign_in_failure.failed_sign_ins + 1,
+            updated_at = NOW()
+        RETURNING failed_sign_ins INTO v_failure.failed_sign_ins;
+
+        v_lockout := api.sign_in_lockout(v_failure.failed_sign_ins);
+        IF v_lockout IS NOT NULL THEN
+            UPDATE sign_in_failure SET locked_until = NOW() + v_lockout
+            WHERE site_user_id = v_site_user.site_user_id AND ip_address = v_ip_address;
+        END IF;
+
+        PERFORM api.auth_event_record('sign_in_failed', p_email, p_ip_address, p_user_agent, 'Wrong password', v_site_user.site_user_id);
+        IF v_lockout IS NULL THEN
+            RETURN jsonb_build_object('status', 'failed');
+        END IF;
+
+        PERFORM api.auth_event_record(
+            'account_locked', p_email, p_ip_address, p_user_agent,
+            format('Locked for %s after %s wrong passwords from this address', v_lockout, v_failure.failed_sign_ins),
+            v_site_user.site_user_id
+        );
+        RETURN jsonb_build_object('status', 'locked', 'locked_until', NOW() + v_lockout);
+    END IF;
+
+    DELETE FROM sign_in_failure
+    WHERE site_user_id = v_site_user.site_user_id AND ip_address = v_ip_address;
+
+    -- tidy up sessions that have run out while we are here
+    DELETE FROM session
+    WHERE site_user_id = v_site_user.site_user_id AND expires_at <= NOW();
+
+    INSERT INTO session (site_user_id, session_token, expires_at, user_agent, ip_address, remember)
+    VALUES (
+        v_site_user.site_user_id,
+        gen_random_uuid()::TEXT,
+        NOW() + api.session_lifetime(COALESCE(p_remember, FALSE)),
+        NULLIF(LEFT(p_user_agent, 512), ''),
+        NULLIF(p_ip_address, '')::INET,
+        COALESCE(p_remember, FALSE)
+    ) RETURNING session_token INTO v_session_token;
+
+    PERFORM api.auth_event_record('sign_in', p_email, p_ip_address, p_user_agent, NULL, v_site_user.site_user_id);
+    RETURN jsonb_build_object('status', 'ok', 'session_token', v_session_token);
+END;
+$$ LANGUAGE plpgsql;
+
+/*
+Takes a token from the rate limit bucket p_key, which holds up to p_burst
+tokens and gains one every p_interval_seconds.  Returns how many seconds to
+wait before trying again, zero when a token was taken.  Buckets not touched
+for a day are dropped now and then, so no limit should take longer than that
+to refill.
+*/
+CREATE FUNCTION api.rate_limit_take (
+    p_key TEXT,
+    p_burst INTEGER,
+    p_interval_seconds DOUBLE PRECISION
+) RETURNS DOUBLE PRECISION AS $$
+DECLARE
+    v_now TIMESTAMPTZ := clock_timestamp();
+    v_tokens DOUBLE PRECISION;
+BEGIN
+    INSERT INTO rate_limit_bucket (bucket_key, tokens, updated_at)
+    VALUES (p_key, p_burst, v_now)
+    ON CONFLICT (bucket_key) DO NOTHING;
+
+    SELECT LEAST(p_burst, tokens + GREATEST(EXTRACT(EPOCH FROM v_now - updated_at), 0) / p_interval_seconds)
+    INTO v_tokens
+    FROM rate_limit_bucket
+    WHERE bucket_key = p_key
+    FOR UPDATE;
+
+    IF v_tokens < 1 THEN
+        RETURN (1 - v_tokens) * p_interval_seconds;
+    END IF;
+
+    UPDATE rate_limit_bucket SET tokens = v_tokens - 1, updated_at = GREATEST(updated_at, v_now)
+    WHERE bucket_key = p_key;
+
+    IF random() < 0.01 THEN
+        DELETE FROM rate_limit_bucket WHERE updated_at < v_now - INTERVAL '1 day';
+    END IF;
+
+    RETURN 0;
+END;
+$$ LANGUAGE plpgsql;
+
+-- The auth_event log newest first, narrowed to one kind of event and to
+-- events whose email, username or address contain p_query
+CREATE FUNCTION api.admin_auth_events (
+    p_query TEXT,
+    p_event TEXT,
+    p_page_index INTEGER,
+    p_items_per_page INTEGER
+) RETURNS JSONB AS $$
+DECLARE
+    v_events JSONB;
+    v_total_count INTEGER;
+BEGIN
+    IF p_page_index IS NULL OR p_page_index < 1 THEN
+        p_page_index := 1;
+    END IF;
+
+    IF p_items_per_page IS NULL OR p_items_per_page < 1 THEN
+        p_items_per_page := 50;
+    END IF;
+
+    SELECT COUNT(*) INTO v_total_count
+    FROM auth_event ae
+    LEFT JOIN site_user su ON su.site_user_id = ae.site_user_id
+    WHERE (COALESCE(p_event, '') = '' OR ae.event = p_event)
+      AND (
+        COALESCE(p_query, '') = ''
+        OR ae.email ILIKE '%' || p_query || '%'
+        OR su.username ILIKE '%' || p_query || '%'
+        OR host(ae.ip_address) LIKE p_query || '%'
+      );
+
+    SELECT COALESCE(
+        jsonb_agg(
+            jsonb_build_object(
+                'id', page.auth_event_id,
+                'event', page.event,
+                'username', page.username,
+                'email', page.email,
+                'ip_address', host(page.ip_address),
+                'user_agent', page.user_agent,
+                'detail', page.detail,
+                'created_at', page.created_at
+            ) ORDER BY page.created_at DESC, page.auth_event_id DESC
+        ),
+        '[]'::jsonb
+    ) INTO v_events
+    FROM (
+        SELECT ae.*, su.username
+        FROM auth_event ae
+        LEFT JOIN site_user su ON su.site_user_id = ae.site_user_id
+        WHERE (COALESCE(p_event, '') = '' OR ae.event = p_event)
+          AND (
+            COALESCE(p_query, '') = ''
+            OR ae.email ILIKE '%' || p_query || '%'
+            OR su.username ILIKE '%' || p_query || '%'
+            OR host(ae.ip_address) LIKE p_query || '%'
+          )
+        ORDER BY ae.created_at DESC, ae.auth_event_id DESC
+        LIMIT p_items_per_page
+        OFFSET (p_page_index - 1) * p_items_per_page
+    ) page;
+
+    RETURN jsonb_build_object(
+        'events', v_events,
+        'total_count', v_total_count,
+        'total_pages', GREATEST(CEIL(v_total_count::NUMERIC / p_items_per_page)::INTEGER, 1)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+/*
+The user a session belongs to, or null when it has expired.  Using a session
+pushes its expiry back, at most once a minute so every page view is not a
+write.
+*/
+CREATE FUNCTION api.user_validate_session (p_session_token TEXT) RETURNS JSONB AS $$
+DECLARE
+    v_session session%ROWTYPE;
+BEGIN
+    SELECT * INTO v_session
+    FROM session
+    WHERE session_token = p_session_token
+      AND expires_at > NOW();
+    IF NOT FOUND THEN
+        RETURN NULL;
+    END IF;
+
+    IF v_session.last_seen_at < NOW() - INTERVAL '1 minute' THEN
+        UPDATE session SET
+            last_seen_at = NOW(),
+            expires_at = NOW() + api.session_lifetime(remember)
+        WHERE session_id = v_session.session_id;
+    END IF;
+
+    RETURN jsonb_build_object(
+        'first_name', su.first_name,
+        'last_name', su.last_name,
+        'username', su.username,
+        'email', su.email,
+        'is_staff', su.is_staff,
+        'is_admin', su.is_admin,
+        'email_verified', su.email_verified_at IS NOT NULL,
+        'created_at', su.created_at,
+        'updated_at', su.updated_at,
+        'session_id', v_session.session_id,
+        'remember', v_session.remember
+    )
+    FROM site_user su
+    WHERE su.site_user_id = v_session.site_user_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.user_signout (p_session_token TEXT) RETURNS VOID AS $$
+BEGIN
+    DELETE FROM session
+    WHERE session_token = p_session_token;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Every live session of the user signed in with p_session_token, most
+-- recently used first
+CREATE FUNCTION api.user_sessions (p_session_token TEXT) RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        jsonb_build_object(
+            'id', s.session_id,
+            'user_agent', s.user_agent,
+            'ip_address', host(s.ip_address),
+            'created_at', s.created_at,
+            'last_seen_at', s.last_seen_at,
+            'expires_at', s.expires_at,
+            'remember', s.remember,
+            'current', s.session_token = p_session_token
+        ) ORDER BY s.last_seen_at DESC, s.session_id DESC
+    ),
+    '[]'::jsonb
+)
+FROM session s
+WHERE s.expires_at > NOW()
+  AND s.site_user_id = (SELECT site_user_id FROM session WHERE session_token = p_session_token);
+$$;
+
+-- Signs out one of the sessions of the user signed in with p_session_token
+CREATE FUNCTION api.user_revoke_session (p_session_token TEXT, p_session_id INTEGER) RETURNS VOID AS $$
+BEGIN
+    DELETE FROM session
+    WHERE session_id = p_session_id
+      AND site_user_id = (SELECT site_user_id FROM session WHERE session_token = p_session_token);
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'That device is already signed out' USING ERRCODE = 'UE000';
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Signs the user with p_session_token out of every device, this one included
+CREATE FUNCTION api.user_signout_everywhere (p_session_token TEXT) RETURNS VOID AS $$
+BEGIN
+    DELETE FROM session
+    WHERE site_user_id = (SELECT site_user_id FROM session WHERE session_token = p_session_token);
+END;
+$$ LANGUAGE plpgsql;
+
+/*
+Records a verification email about to be sent to p_username and returns who
+to send it to.  Raises when the address is already verified, or when too
+many have been sent: one a minute and five a day.
+*/
+CREATE FUNCTION api.email_verification_send (p_username TEXT) RETURNS JSONB AS $$
+DECLARE
+    v_site_user site_user%ROWTYPE;
+BEGIN
+    SELECT * INTO v_site_user FROM site_user WHERE username = p_username FOR UPDATE;
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'There is no user called "%"', p_username USING ERRCODE = 'UE000';
+    END IF;
+    IF v_site_user.email_verified_at IS NOT NULL THEN
+        RAISE EXCEPTION 'Your email address is already verified' USING ERRCODE = 'UE000';
+    END IF;
+
+    IF EXISTS (
+        SELECT 1 FROM email_verification_sent
+        WHERE site_user_id = v_site_user.site_user_id AND sent_at > NOW() - INTERVAL '1 minute'
+    ) THEN
+        RAISE EXCEPTION 'We sent you a verification email less than a minute ago, check your inbox before asking for another'
+            USING ERRCODE = 'UE000';
+    END IF;
+    IF (
+        SELECT COUNT(*) FROM email_verification_sent
+        WHERE site_user_id = v_site_user.site_user_id AND sent_at > NOW() - INTERVAL '1 day'
+    ) >= 5 THEN
+        RAISE EXCEPTION 'We have sent you too many verification emails today, try again tomorrow' USING ERRCODE = 'UE000';
+    END IF;
+
+    INSERT INTO email_verification_sent (site_user_id, email)
+    VALUES (v_site_user.site_user_id, v_site_user.email);
+
+    RETURN jsonb_build_object(
+        'username', v_site_user.username,
+        'first_name', v_site_user.first_name,
+        'email', v_site_user.email
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- Marks the address verified, from a signed link naming both user and
+-- address, so a link stops working if the address is changed.  Returns
+-- false when it was verified already.
+CREATE FUNCTION api.email_verify (p_username TEXT, p_email CITEXT) RETURNS BOOLEAN AS $$
+DECLARE
+    v_site_user site_user%ROWTYPE;
+BEGIN
+    SELECT * INTO v_site_user FROM site_user WHERE username = p_username FOR UPDATE;
+    IF NOT FOUND OR v_site_user.email <> p_email THEN
+        RAISE EXCEPTION 'This verification link is for an address that is no longer on the account' USING ERRCODE = 'UE000';
+    END IF;
+    IF v_site_user.email_verified_at IS NOT NULL THEN
+        RETURN FALSE;
+    END IF;
+
+    UPDATE site_user SET email_verified_at = NOW(), updated_at = NOW()
+    WHERE site_user_id = v_site_user.site_user_id;
+    RETURN TRUE;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.site_user_add_closet (p_username TEXT, p_closet_name TEXT) RETURNS VOID AS $$
+DECLARE
+    v_site_user_id INTEGER;
+BEGIN
+    SELECT su.site_user_id INTO v_site_user_id
+    FROM site_user su
+    WHERE su.username = p_username;
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'Invalid username: %', p_username;
+    END IF;
+    INSERT INTO closet (site_user_id, name)
+    VALUES (v_site_user_id, p_closet_name);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.site_user_remove_closet (p_username TEXT, p_closet_name TEXT) RETURNS VOID AS $$
+DECLARE
+    v_site_user_id INTEGER;
+    v_closet_id INTEGER;
+BEGIN
+    SELECT su.site_user_id INTO v_site_user_id
+    FROM site_user su
+    WHERE su.username = p_username;
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'Invalid username: %', p_username;
+    END IF;
+    SELECT c.closet_id INTO v_closet_id
+    FROM closet c
+    WHERE c.site_user_id = v_site_user_id
+        AND c.name = p_closet_name;
+    IF v_closet_id IS NULL THEN
+        RAISE EXCEPTION 'Closet "%" not found for user "%"', p_closet_name, p_username;
+    END IF;
+    DELETE FROM closet
+    WHERE closet_id = v_closet_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.site_user_add_item_to_closet (
+    p_username TEXT,
+    p_closet_name TEXT,
+    p_base_item_name CITEXT,
+    p_brand_name CITEXT
+) RETURNS VOID AS $$
+DECLARE
+    v_site_user_id INTEGER;
+    v_closet_id INTEGER;
+    v_base_item_id INTEGER;
+BEGIN
+    SELECT su.site_user_id INTO v_site_user_id
+    FROM site_user su
+    WHERE su.username = p_username;
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'Invalid username: %', p_username;
+    END IF;
+
+    SELECT c.closet_id INTO v_closet_id
+    FROM closet c
+    WHERE c.site_user_id = v_site_user_id
+        AND c.name = p_closet_name;
+    IF v_closet_id IS NULL THEN
+        RAISE EXCEPTION 'Closet "%" not found for user "%"', p_closet_name, p_username;
+    END IF;
+    SELECT bi.base_item_id INTO v_base_item_id
+    FROM base_item bi
+    JOIN brand b ON bi.brand_id = b.brand_id
+    WHERE bi.name = p_base_item_name
+        AND b.name = p_brand_name;
+    IF v_base_item_id IS NULL THEN
+        RAISE EXCEPTION 'Base item "%" for brand "%" not found', p_base_item_name, p_brand_name;
+    END IF;
+    INSERT INTO closet_item (closet_id, item_id)
+    VALUES (v_closet_id, v_base_item_id)
+    ON CONFLICT (closet_id, item_id) DO NOTHING;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.site_user_get_closets (p_username TEXT) RETURNS JSONB AS $$
+DECLARE
+    v_site_user_id INTEGER;
+    v_closets JSONB;
+BEGIN
+    SELECT su.site_user_id INTO v_site_user_id
+    FROM site_user su
+    WHERE su.username = p_username;
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'Invalid username: %', p_username;
+    END IF;
+
+    -- get a list of closets with all the items in them
+    SELECT COALESCE(
+        jsonb_agg(
+            jsonb_build_object(
+                'closet_id', c.closet_id,
+                'name', c.name,
+                'description', c.description,
+                'created_at', c.created_at,
+                'updated_at', c.updated_at,
+                'items', (
+                    SELECT COALESCE(
+                        jsonb_agg(
+                            jsonb_build_object(
+                                'base_item_name', bi.name,
+                                'brand_name', b.name,
+                                'thumbnail_url', img.url,
+                                'thumbnail_hash', img.content_hash,
+                                'notes', ci.notes,
+                                'added_at', ci.added_at
+                            ) ORDER BY bi.name
+                        ),
+                        '[]'::jsonb
+                    )
+                    FROM closet_item ci
+                    JOIN base_item bi ON ci.item_id = bi.base_item_id
+                    JOIN brand b ON bi.brand_id = b.brand_id
+                    LEFT JOIN image img ON bi.thumbnail_image_id = img.image_id
+                    WHERE ci.closet_id = c.closet_id
+                )
+            ) ORDER BY c.name
+        ),
+        '[]'::jsonb
+    ) INTO v_closets
+    FROM closet c
+    WHERE c.site_user_id = v_site_user_id;
+    RETURN v_closets;
+END;
+$$ LANGUAGE plpgsql;
+-- The cart for a signed in user, or else the anonymous cart for the token.
+-- Returns null when there is no cart yet, unless p_create is set.
+CREATE FUNCTION api.cart_id (
+    p_username TEXT,
+    p_cart_token TEXT,
+    p_create BOOLEAN DEFAULT FALSE
+) RETURNS INTEGER AS $$
+DECLARE
+    v_site_user_id INTEGER;
+    v_cart_id INTEGER;
+BEGIN
+    IF p_username IS NOT NULL THEN
+        SELECT su.site_user_id INTO v_site_user_id
+        FROM site_user su
+        WHERE su.username = p_username;
+        IF v_site_user_id IS NULL THEN
+            RAISE EXCEPTION 'Invalid username: %', p_username;
+        END IF;
+
+        SELECT cart_id INTO v_cart_id FROM cart WHERE site_user_id = v_site_user_id;
+        IF v_cart_id IS NULL AND p_create THEN
+            INSERT INTO cart (site_user_id) VALUES (v_site_user_id)
+            ON CONFLICT (site_user_id) DO NOTHING
+            RETURNING cart_id INTO v_cart_id;
+            -- created by a concurrent request
+            IF v_cart_id IS NULL THEN
+                SELECT cart_id INTO v_cart_id FROM cart WHERE site_user_id = v_site_user_id;
+            END IF;
+        END IF;
+        RETURN v_cart_id;
+    END IF;
+
+    IF p_cart_token IS NOT NULL THEN
+        SELECT cart_id INTO v_cart_id
+        FROM cart
+        WHERE cart_token = p_cart_token
+          AND site_user_id IS NULL;
+    END IF;
+    IF v_cart_id IS NULL AND p_create THEN
+        INSERT INTO cart DEFAULT VALUES RETURNING cart_id INTO v_cart_id;
+    END IF;
+    RETURN v_cart_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Errors raised with SQLSTATE UE000 are safe to show to the user as is
+CREATE FUNCTION api.cart_check_stock (p_item_id INTEGER, p_quantity INTEGER) RETURNS VOID AS $$
+DECLARE
+    v_stock_quantity INTEGER;
+BEGIN
+    v_stock_quantity := COALESCE((SELECT stock_quantity FROM inventory WHERE item_id = p_item_id), 0);
+    IF p_quantity > v_stock_quantity THEN
+        IF v_stock_quantity <= 0 THEN
+            RAISE EXCEPTION 'That size is out of stock' USING ERRCODE = 'UE000';
+        END IF;
+        RAISE EXCEPTION 'Only % left in stock', v_stock_quantity USING ERRCODE = 'UE000';
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.cart_json (p_cart_id INTEGER) RETURNS JSONB AS $$
+DECLARE
+    v_cart_token TEXT;
+    v_items JSONB;
+BEGIN
+    -- the token is only handed out for anonymous carts
+    SELECT CASE WHEN site_user_id IS NULL THEN cart_token END INTO v_cart_token
+    FROM cart
+    WHERE cart_id = p_cart_id;
+
+    SELECT COALESCE(
+        jsonb_agg(
+            jsonb_build_object(
+                'item_id', ci.item_id,
+                'item_name', bi.name,
+                'brand_name', b.name,
+                'size', ic.basic_size,
+                'quantity', ci.quantity,
+                'stock_quantity', COALESCE(inv.stock_quantity, 0),
+                'available', bi.discontinued_at IS NULL AND ci.quantity <= COALESCE(inv.stock_quantity, 0),
+                'thumbnail_url', img.url,
+                'thumbnail_hash', img.content_hash,
+                'price', api.price(bi.base_item_id),
+                'line_total', cp.price * ci.quantity
+            ) ORDER BY ci.added_at, ci.item_id
+        ),
+        '[]'::jsonb
+    ) INTO v_items
+    FROM cart_item ci
+    JOIN item.clothing ic ON ic.item_id = ci.item_id
+    JOIN item i ON i.item_id = ci.item_id
+    JOIN base_item bi ON bi.base_item_id = i.base_item_id
+    JOIN brand b ON b.brand_id = bi.brand_id
+    LEFT JOIN image img ON img.image_id = bi.thumbnail_image_id
+    LEFT JOIN inventory inv ON inv.item_id = ci.item_id
+    LEFT JOIN current_base_item_price cp ON cp.base_item_id = bi.base_item_id
+    WHERE ci.cart_id = p_cart_id;
+
+    RETURN jsonb_build_object(
+        'cart_token', v_cart_token,
+        'items', v_items,
+        'item_count', (SELECT COALESCE(SUM(quantity), 0) FROM cart_item WHERE cart_id = p_cart_id),
+        'currency', (SELECT MIN(line->'price'->>'currency') FROM jsonb_array_elements(v_items) line),
+        'subtotal', (SELECT COALESCE(SUM((line->>'line_total')::NUMERIC), 0) FROM jsonb_array_elements(v_items) line)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.cart_get (p_username TEXT, p_cart_token TEXT) RETURNS JSONB AS $$
+BEGIN
+    RETURN api.cart_json(api.cart_id(p_username, p_cart_token));
+END;
+$$ LANGUAGE plpgsql;
+
+-- Adds to the quantity already in the cart, creating the cart if needed
+CREATE FUNCTION api.cart_add_item (
+    p_username TEXT,
+    p_cart_token TEXT,
+    p_base_item_name CITEXT,
+    p_brand_name CITEXT,
+    p_size CITEXT,
+    p_quantity INTEGER DEFAULT 1
+) RETURNS JSONB AS $$
+DECLARE
+    v_item_id INTEGER;
+    v_cart_id INTEGER;
+    v_quantity INTEGER;
+BEGIN
+    IF p_quantity IS NULL OR p_quantity < 1 THEN
+        RAISE EXCEPTION 'Quantity must be at least 1' USING ERRCODE = 'UE000';
+    END IF;
+
+    SELECT ic.item_id INTO v_item_id
+    FROM item.clothing ic
+    JOIN item i ON i.item_id = ic.item_id
+    JOIN base_item bi ON bi.base_item_id = i.base_item_id
+    JOIN brand b ON b.brand_id = bi.brand_id
+    WHERE bi.name = p_base_item_name
+      AND b.name = p_brand_name
+      AND ic.basic_size = p_size
+      AND bi.discontinued_at IS NULL
+    ORDER BY ic.item_id
+    LIMIT 1;
+    IF v_item_id IS NULL THEN
+        RAISE EXCEPTION 'Size % of "%" is not available', p_size, p_base_item_name USING ERRCODE = 'UE000';
+    END IF;
+
+    v_cart_id := api.cart_id(p_username, p_cart_token, TRUE);
+
+    v_quantity := p_quantity + COALESCE(
+        (SELECT quantity FROM cart_item WHERE cart_id = v_cart_id AND item_id = v_item_id),
+        0
+    );
+    PERFORM api.cart_check_stock(v_item_id, v_quantity);
+
+    INSERT INTO cart_item (cart_id, item_id, quantity)
+    VALUES (v_cart_id, v_item_id, v_quantity)
+    ON CONFLICT (cart_id, item_id) DO UPDATE SET quantity = EXCLUDED.quantity;
+
+    UPDATE cart SET updated_at = NOW() WHERE cart_id = v_cart_id;
+
+    RETURN api.cart_json(v_cart_id);
+END;
+$$ LANGUAGE plpgsql;
+
+-- A quantity of zero removes the line
+CREATE FUNCTION api.cart_set_quantity (
+    p_username TEXT,
+    p_cart_token TEXT,
+    p_item_id INTEGER,
+    p_quantity INTEGER
+) RETURNS JSONB AS $$
+DECLARE
+    v_cart_id INTEGER;
+BEGIN
+    v_cart_id := api.cart_id(p_username, p_cart_token);
+    IF v_cart_id IS NULL OR NOT EXISTS (
+        SELECT 1 FROM cart_item WHERE cart_id = v_cart_id AND item_id = p_item_id
+    ) THEN
+        RAISE EXCEPTION 'That item is not in your cart' USING ERRCODE = 'UE000';
+    END IF;
+
+    IF p_quantity IS NULL OR p_quantity <= 0 THEN
+        DELETE FROM cart_item WHERE cart_id = v_cart_id AND item_id = p_item_id;
+    ELSE
+        PERFORM api.cart_check_stock(p_item_id, p_quantity);
+        UPDATE cart_item SET quantity = p_quantity
+        WHERE cart_id = v_cart_id AND item_id = p_item_id;
+    END IF;
+
+    UPDATE cart SET updated_at = NOW() WHERE cart_id = v_cart_id;
+
+    RETURN api.cart_json(v_cart_id);
+END;
+$$ LANGUAGE plpgsql;
+
+-- Called on sign in.  The anonymous cart becomes the user's cart when they
+-- have none, otherwise its lines are added to theirs without going over the
+-- stock on hand.
+CREATE FUNCTION api.cart_merge (p_session_token TEXT, p_cart_token TEXT) RETURNS VOID AS $$
+DECLARE
+    v_site_user_id INTEGER;
+    v_anonymous_cart_id INTEGER;
+    v_user_cart_id INTEGER;
+BEGIN
+    SELECT site_user_id INTO v_site_user_id
+    FROM session
+    WHERE session_token = p_session_token
+      AND expires_at > NOW();
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'Invalid session';
+    END IF;
+
+    v_anonymous_cart_id := api.cart_id(NULL, p_cart_token);
+    IF v_anonymous_cart_id IS NULL THEN
+        RETURN;
+    END IF;
+
+    SELECT cart_id INTO v_user_cart_id FROM cart WHERE site_user_id = v_site_user_id;
+    IF v_user_cart_id IS NULL THEN
+        UPDATE cart SET site_user_id = v_site_user_id, updated_at = NOW()
+        WHERE cart_id = v_anonymous_cart_id;
+        RETURN;
+    END IF;
+
+    INSERT INTO cart_item AS ci (cart_id, item_id, quantity, added_at)
+    SELECT v_user_cart_id, a.item_id, a.quantity, a.added_at
+    FROM cart_item a
+    WHERE a.cart_id = v_anonymous_cart_id
+    ON CONFLICT (cart_id, item_id) DO UPDATE SET quantity = GREATEST(
+        ci.quantity,
+        LEAST(
+            ci.quantity + EXCLUDED.quantity,
+            COALESCE((SELECT stock_quantity FROM inventory WHERE item_id = EXCLUDED.item_id), 0)
+        )
+    );
+
+    DELETE FROM cart WHERE cart_id = v_anonymous_cart_id;
+    UPDATE cart SET updated_at = NOW() WHERE cart_id = v_user_cart_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.order_json (p_customer_order_id INTEGER) RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT jsonb_build_object(
+    'id', co.order_number,
+    'status', co.status,
+    'created_at', co.created_at,
+    'updated_at', co.updated_at,
+    'currency', co.currency,
+    'subtotal', co.subtotal,
+    'total', co.total,
+    'ship_to_name', co.ship_to_name,
+    'ship_to_address', co.ship_to_address,
+    'payment_provider', co.payment_provider,
+    'payment_reference', co.payment_reference,
+    'item_count', (
+        SELECT COALESCE(SUM(quantity), 0)
+        FROM customer_order_line
+        WHERE customer_order_id = co.customer_order_id
+    ),
+    'lines', (
+        SELECT COALESCE(
+            jsonb_agg(
+                jsonb_build_object(
+                    'item_id', col.item_id,
+                    'item_name', bi.name,
+                    'brand_name', b.name,
+                    'size', ic.basic_size,
+                    'quantity', col.quantity,
+                    'unit_price', col.unit_price,
+                    'line_total', col.unit_price * col.quantity,
+                    'thumbnail_url', img.url,
+                    'thumbnail_hash', img.content_hash
+                ) ORDER BY bi.name, col.item_id
+            ),
+            '[]'::jsonb
+        )
+        FROM customer_order_line col
+        JOIN item i ON i.item_id = col.item_id
+        LEFT JOIN item.clothing ic ON ic.item_id = col.item_id
+        JOIN base_item bi ON bi.base_item_id = i.base_item_id
+        JOIN brand b ON b.brand_id = bi.brand_id
+        LEFT JOIN image img ON img.image_id = bi.thumbnail_image_id
+        WHERE col.customer_order_id = co.customer_order_id
+    ),
+    'history', (
+        SELECT COALESCE(
+            jsonb_agg(
+                jsonb_build_object(
+                    'status', h.status,
+                    'note', h.note,
+                    'changed_at', h.changed_at
+                ) ORDER BY h.changed_at, h.customer_order_status_history_id
+            ),
+            '[]'::jsonb
+        )
+        FROM customer_order_status_history h
+        WHERE h.customer_order_id = co.customer_order_id
+    )
+)
+FROM customer_order co
+WHERE co.customer_order_id = p_customer_order_id;
+$$;
+
+-- Turns the user's cart into a pending order, reserving the stock for every
+-- line.  Nothing is reserved unless the whole cart can be.
+CREATE FUNCTION api.checkout (
+    p_username TEXT,
+    p_ship_to_name TEXT,
+    p_ship_to_address TEXT,
+    p_payment_provider TEXT
+) RETURNS JSONB AS $$
+DECLARE
+    v_site_user_id INTEGER;
+    v_cart_id INTEGER;
+    v_customer_order_id INTEGER;
+    v_currency TEXT;
+    v_line RECORD;
+BEGIN
+    IF COALESCE(TRIM(p_ship_to_name), '') = '' OR COALESCE(TRIM(p_ship_to_address), '') = '' THEN
+        RAISE EXCEPTION 'A name and shipping address are required' USING ERRCODE = 'UE000';
+    END IF;
+
+    SELECT su.site_user_id INTO v_site_user_id
+    FROM site_user su
+    WHERE su.username = p_username;
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'Invalid username: %', p_username;
+    END IF;
+
+    v_cart_id := api.cart_id(p_username, NULL);
+    IF v_cart_id IS NULL OR NOT EXISTS (SELECT 1 FROM cart_item WHERE cart_id = v_cart_id) THEN
+        RAISE EXCEPTION 'Your cart is empty' USING ERRCODE = 'UE000';
+    END IF;
+
+    -- concurrent checkouts of the same items wait here, so the stock they
+    -- see below already has the other reservations taken out
+    PERFORM 1 FROM item
+    WHERE item_id IN (SELECT item_id FROM cart_item WHERE cart_id = v_cart_id)
+    ORDER BY item_id
+    FOR UPDATE;
+
+    FOR v_line IN
+        SELECT
+            ci.item_id,
+            ci.quantity,
+            bi.name,
+            bi.discontinued_at,
+            ic.basic_size,
+            cp.currency,
+            cp.price,
+            COALESCE(inv.stock_quantity, 0) AS stock_quantity
+        FROM cart_item ci
+        JOIN item.clothing ic ON ic.item_id = ci.item_id
+        JOIN item i ON i.item_id = ci.item_id
+        JOIN base_item bi ON bi.base_item_id = i.base_item_id
+        LEFT JOIN inventory inv ON inv.item_id = ci.item_id
+        LEFT JOIN current_base_item_price cp ON cp.base_item_id = bi.base_item_id
+        WHERE ci.cart_id = v_cart_id
+        ORDER BY ci.item_id
+    LOOP
+        IF v_line.discontinued_at IS NOT NULL THEN
+            RAISE EXCEPTION '"%" is no longer available', v_line.name USING ERRCODE = 'UE000';
+        END IF;
+        IF v_line.price IS NULL THEN
+            RAISE EXCEPTION '"%" is not for sale', v_line.name USING ERRCODE = 'UE000';
+        END IF;
+        IF v_currency IS NOT NULL AND v_currency <> v_line.currency THEN
+            RAISE EXCEPTION 'Items priced in different currencies must be ordered separately' USING ERRCODE = 'UE000';
+        END IF;
+        v_currency := v_line.currency;
+        IF v_line.quantity > v_line.stock_quantity THEN
+            IF v_line.stock_quantity <= 0 THEN
+                RAISE EXCEPTION 'Size % of "%" is out of stock', v_line.basic_size, v_line.name USING ERRCODE = 'UE000';
+            END IF;
+            RAISE EXCEPTION 'Only % of "%" in size % left in stock', v_line.stock_quantity, v_line.name, v_line.basic_size USING ERRCODE = 'UE000';
+        END IF;
+    END LOOP;
+
+    INSERT INTO customer_order (site_user_id, currency, ship_to_name, ship_to_address, payment_provider)
+    VALUES (v_site_user_id, v_currency, TRIM(p_ship_to_name), TRIM(p_ship_to_address), p_payment_provider)
+    RETURNING customer_order_id INTO v_customer_order_id;
+
+    INSERT INTO customer_order_line (customer_order_id, item_id, quantity, unit_price)
+    SELECT v_customer_order_id, ci.item_id, ci.quantity, cp.price
+    FROM cart_item ci
+    JOIN item i ON i.item_id = ci.item_id
+    JOIN current_base_item_price cp ON cp.base_item_id = i.base_item_id
+    WHERE ci.cart_id = v_cart_id;
+
+    UPDATE customer_order SET
+        subtotal = totals.subtotal,
+        total = totals.subtotal
+    FROM (
+        SELECT SUM(unit_price * quantity) AS subtotal
+        FROM customer_order_line
+        WHERE customer_order_id = v_customer_order_id
+    ) totals
+    WHERE customer_order_id = v_customer_order_id;
+
+    INSERT INTO inventory_transaction (transaction_event, item_id, delta_quantity, customer_order_id)
+    SELECT 'reserve', item_id, -quantity, v_customer_order_id
+    FROM customer_order_line
+    WHERE customer_order_id = v_customer_order_id;
+
+    INSERT INTO customer_order_status_history (customer_order_id, status)
+    VALUES (v_customer_order_id, 'pending');
+
+    RETURN api.order_json(v_customer_order_id);
+END;
+$$ LANGUAGE plpgsql;
+
+-- Moves an order along order_status_transition, releasing or shipping its
+-- reserved stock on the way.  Setting the status it already has does nothing.
+CREATE FUNCTION api.order_set_status (
+    p_order_number TEXT,
+    p_status TEXT,
+    p_note TEXT DEFAULT NULL
+) RETURNS JSONB AS $$
+DECLARE
+    v_order customer_order;
+BEGIN
+    SELECT * INTO v_order
+    FROM customer_order
+    WHERE order_number = p_order_number
+    FOR UPDATE;
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Order % not found', p_order_number USING ERRCODE = 'UE000';
+    END IF;
+
+    IF v_order.status = p_status THEN
+        RETURN api.order_json(v_order.customer_order_id);
+    END IF;
+
+    IF NOT EXISTS (
+        SELECT 1 FROM order_status_transition
+        WHERE from_status = v_order.status
+          AND to_status = p_status
+    ) THEN
+        RAISE EXCEPTION 'An order that is % cannot become %', v_order.status, p_status USING ERRCODE = 'UE000';
+    END IF;
+
+    IF p_status = 'cancelled' THEN
+        INSERT INTO inventory_transaction (transaction_event, item_id, delta_quantity, customer_order_id)
+        SELECT 'release', item_id, quantity, v_order.customer_order_id
+        FROM customer_order_line
+        WHERE customer_order_id = v_order.customer_order_id;
+    ELSIF p_status = 'fulfilled' THEN
+        -- the reservation already took the stock out, this only records why
+        INSERT INTO inventory_transaction (transaction_event, item_id, delta_quantity, customer_order_id)
+        SELECT e.transaction_event, l.item_id, e.sign * l.quantity, v_order.customer_order_id
+        FROM customer_order_line l
+        CROSS JOIN (VALUES ('release', 1), ('ship-out', -1)) AS e (transaction_event, sign)
+        WHERE l.customer_order_id = v_order.customer_order_id;
+    END IF;
+
+    UPDATE customer_order SET status = p_status, updated_at = NOW()
+    WHERE customer_order_id = v_order.customer_order_id;
+
+    INSERT INTO customer_order_status_history (customer_order_id, status, note)
+    VALUES (v_order.customer_order_id, p_status, p_note);
+
+    RETURN api.order_json(v_order.customer_order_id);
+END;
+$$ LANGUAGE plpgsql;
+
+-- Records a successful payment and takes what was ordered out of the cart
+CREATE FUNCTION api.order_mark_paid (p_order_number TEXT, p_payment_reference TEXT) RETURNS JSONB AS $$
+DECLARE
+    v_result JSONB;
+    v_customer_order_id INTEGER;
+    v_cart_id INTEGER;
+BEGIN
+    UPDATE customer_order SET payment_reference = p_payment_reference
+    WHERE order_number = p_order_number
+    RETURNING customer_order_id INTO v_customer_order_id;
+
+    v_result := api.order_set_status(p_order_number, 'paid');
+
+    SELECT c.cart_id INTO v_cart_id
+    FROM cart c
+    JOIN customer_order co ON co.site_user_id = c.site_user_id
+    WHERE co.customer_order_id = v_customer_order_id;
+
+    DELETE FROM cart_item ci
+    USING customer_order_line l
+    WHERE ci.cart_id = v_cart_id
+      AND l.customer_order_id = v_customer_order_id
+      AND l.item_id = ci.item_id
+      AND ci.quantity <= l.quantity;
+
+    UPDATE cart_item ci SET quantity = ci.quantity - l.quantity
+    FROM customer_order_line l
+    WHERE ci.cart_id = v_cart_id
+      AND l.customer_order_id = v_customer_order_id
+      AND l.item_id = ci.item_id;
+
+    RETURN v_result;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.site_user_get_orders (p_username TEXT) RETURNS JSONB AS $$
+DECLARE
+    v_site_user_id INTEGER;
+BEGIN
+    SELECT su.site_user_id INTO v_site_user_id
+    FROM site_user su
+    WHERE su.username = p_username;
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'Invalid username: %', p_username;
+    END IF;
+
+    RETURN (
+        SELECT COALESCE(
+            jsonb_agg(api.order_json(customer_order_id) ORDER BY created_at DESC),
+            '[]'::jsonb
+        )
+        FROM customer_order
+        WHERE site_user_id = v_site_user_id
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.site_user_get_order (p_username TEXT, p_order_number TEXT) RETURNS JSONB AS $$
+DECLARE
+    v_customer_order_id INTEGER;
+BEGIN
+    SELECT co.customer_order_id INTO v_customer_order_id
+    FROM customer_order co
+    JOIN site_user su ON su.site_user_id = co.site_user_id
+    WHERE su.username = p_username
+      AND co.order_number = p_order_number;
+    IF v_customer_order_id IS NULL THEN
+        RAISE EXCEPTION 'Order % not found', p_order_number USING ERRCODE = 'UE000';
+    END IF;
+
+    RETURN api.order_json(v_customer_order_id);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.rental_plans () RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        jsonb_build_object(
+            'name', rp.name,
+            'items_at_a_time', rp.items_at_a_time,
+            'swaps_per_month', rp.swaps_per_month,
+            'rental_days', rp.rental_days,
+            'currency', rp.currency,
+            'monthly_price', rp.monthly_price
+        ) ORDER BY rp.monthly_price, rp.name
+    ),
+    '[]'::jsonb
+)
+FROM rental_plan rp
+WHERE rp.is_active;
+$$;
+
+-- Start of the subscription month NOW() falls in
+CREATE FUNCTION api.rental_period_start (p_started_at TIMESTAMPTZ) RETURNS TIMESTAMPTZ LANGUAGE sql STABLE AS $$
+SELECT p_started_at + (
+    EXTRACT(YEAR FROM age(NOW(), p_started_at)) * 12 + EXTRACT(MONTH FROM age(NOW(), p_started_at))
+)::INTEGER * INTERVAL '1 month';
+$$;
+
+CREATE FUNCTION api.rental_json (p_rental_id INTEGER) RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT jsonb_build_object(
+    'id', r.rental_id,
+    'status', r.status,
+    'item_id', r.item_id,
+    'item_name', bi.name,
+    'brand_name', b.name,
+    'size', ic.basic_size,
+    'closet_name', c.name,
+    'rented_at', r.rented_at,
+    'due_at', r.due_at,
+    'overdue', r.status = 'out' AND r.due_at < NOW(),
+    'return_started_at', r.return_started_at,
+    'returned_at', r.returned_at,
+    'condition_note', r.condition_note,
+    'thumbnail_url', img.url,
+    'thumbnail_hash', img.content_hash
+)
+FROM rental r
+JOIN item i ON i.item_id = r.item_id
+LEFT JOIN item.clothing ic ON ic.item_id = r.item_id
+JOIN base_item bi ON bi.base_item_id = i.base_item_id
+JOIN brand b ON b.brand_id = bi.brand_id
+LEFT JOIN closet c ON c.closet_id = r.closet_id
+LEFT JOIN image img ON img.image_id = bi.thumbnail_image_id
+WHERE r.rental_id = p_rental_id;
+$$;
+
+-- A swap is any rental in the month past the first items_at_a_time
+CREATE FUNCTION api.rental_subscription_json (p_rental_subscription_id INTEGER) RETURNS JSONB AS $$
+DECLARE
+    v_subscription rental_subscription;
+    v_plan rental_plan;
+    v_period_start TIMESTAMPTZ;
+    v_items_out INTEGER;
+    v_rented_this_period INTEGER;
+    v_swaps_used INTEGER;
+BEGIN
+    SELECT * INTO v_subscription
+    FROM rental_subscription
+    WHERE rental_subscription_id = p_rental_subscription_id;
+    IF NOT FOUND THEN
+        RETURN NULL;
+    END IF;
+
+    SELECT * INTO v_plan
+    FROM rental_plan
+    WHERE rental_plan_id = v_subscription.rental_plan_id;
+
+    v_period_start := api.rental_period_start(v_subscription.started_at);
+
+    SELECT
+        COUNT(*) FILTER (WHERE status = 'out'),
+        COUNT(*) FILTER (WHERE rented_at >= v_period_start)
+    INTO v_items_out, v_rented_this_period
+    FROM rental
+    WHERE rental_subscription_id = p_rental_subscription_id;
+
+    v_swaps_used := GREATEST(v_rented_this_period - v_plan.items_at_a_time, 0);
+
+    RETURN jsonb_build_object(
+        'plan', jsonb_build_object(
+            'name', v_plan.name,
+            'items_at_a_time', v_plan.items_at_a_time,
+            'swaps_per_month', v_plan.swaps_per_month,
+            'rental_days', v_plan.rental_days,
+            'currency', v_plan.currency,
+            'monthly_price', v_plan.monthly_price
+        ),
+        'status', v_subscription.status,
+        'started_at', v_subscription.started_at,
+        'cancelled_at', v_subscription.cancelled_at,
+        'period_start', v_period_start,
+        'period_end', v_period_start + INTERVAL '1 month',
+        'items_out', v_items_out,
+        'slots_left', GREATEST(v_plan.items_at_a_time - v_items_out, 0),
+        'swaps_used', v_swaps_used,
+        'swaps_left', CASE
+            WHEN v_plan.swaps_per_month IS NOT NULL THEN GREATEST(v_plan.swaps_per_month - v_swaps_used, 0)
+        END
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.site_user_get_rentals (p_username TEXT) RETURNS JSONB AS $$
+DECLARE
+    v_site_user_id INTEGER;
+BEGIN
+    SELECT su.site_user_id INTO v_site_user_id
+    FROM site_user su
+    WHERE su.username = p_username;
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'Invalid username: %', p_username;
+    END IF;
+
+    RETURN jsonb_build_object(
+        'subscription', (
+            SELECT api.rental_subscription_json(rental_subscription_id)
+            FROM rental_subscription
+            WHERE site_user_id = v_site_user_id
+              AND status = 'active'
+        ),
+        'rentals', (
+            SELECT COALESCE(
+                jsonb_agg(
+                    api.rental_json(rental_id)
+                    ORDER BY status IN ('out', 'returning') DESC, rented_at DESC
+                ),
+                '[]'::jsonb
+            )
+            FROM rental
+            WHERE site_user_id = v_site_user_id
+        )
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- Subscribing again switches plans.  A smaller plan keeps the items already
+-- out but no more can be rented until enough come back.
+CREATE FUNCTION api.site_user_subscribe (p_username TEXT, p_plan_name CITEXT) RETURNS JSONB AS $$
+DECLARE
+    v_site_user_id INTEGER;
+    v_rental_plan_id INTEGER;
+BEGIN
+    SELECT su.site_user_id INTO v_site_user_id
+    FROM site_user su
+    WHERE su.username = p_username;
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'Invalid username: %', p_username;
+    END IF;
+
+    SELECT rental_plan_id INTO v_rental_plan_id
+    FROM rental_plan
+    WHERE name = p_plan_name
+      AND is_active;
+    IF v_rental_plan_id IS NULL THEN
+        RAISE EXCEPTION 'There is no "%" plan', p_plan_name USING ERRCODE = 'UE000';
+    END IF;
+
+    UPDATE rental_subscription SET rental_plan_id = v_rental_plan_id
+    WHERE site_user_id = v_site_user_id
+      AND status = 'active';
+    IF NOT FOUND THEN
+        INSERT INTO rental_subscription (site_user_id, rental_plan_id)
+        VALUES (v_site_user_id, v_rental_plan_id);
+    END IF;
+
+    RETURN api.site_user_get_rentals(p_username);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.site_user_cancel_subscription (p_username TEXT) RETURNS JSONB AS $$
+DECLARE
+    v_rental_subscription_id INTEGER;
+BEGIN
+    SELECT rs.rental_subscription_id INTO v_rental_subscription_id
+    FROM rental_subscription rs
+    JOIN site_user su ON su.site_user_id = rs.site_user_id
+    WHERE su.username = p_username
+      AND rs.status = 'active'
+    FOR UPDATE OF rs;
+    IF v_rental_subscription_id IS NULL THEN
+        RAISE EXCEPTION 'You are not subscribed to a rental plan' USING ERRCODE = 'UE000';
+    END IF;
+
+    IF EXISTS (
+        SELECT 1 FROM rental
+        WHERE rental_subscription_id = v_rental_subscription_id
+          AND status = 'out'
+    ) THEN
+        RAISE EXCEPTION 'Send back everything you have rented before cancelling' USING ERRCODE = 'UE000';
+    END IF;
+
+    UPDATE rental_subscription SET status = 'cancelled', cancelled_at = NOW()
+    WHERE rental_subscription_id = v_rental_subscription_id;
+
+    RETURN api.site_user_get_rentals(p_username);
+END;
+$$ LANGUAGE plpgsql;
+
+-- Checks the plan's limits and the stock, then ships the item out to the
+-- member.  Returns the new rental_id.
+CREATE FUNCTION api.rental_start (
+    p_site_user_id INTEGER,
+    p_item_id INTEGER,
+    p_closet_id INTEGER DEFAULT NULL
+) RETURNS INTEGER AS $$
+DECLARE
+    v_subscription rental_subscription;
+    v_plan rental_plan;
+    v_item RECORD;
+    v_period_start TIMESTAMPTZ;
+    v_items_out INTEGER;
+    v_rented_this_period INTEGER;
+    v_rental_id INTEGER;
+BEGIN
+    -- one rental at a time per member so the limits below hold
+    SELECT * INTO v_subscription
+    FROM rental_subscription
+    WHERE site_user_id = p_site_user_id
+      AND status = 'active'
+    FOR UPDATE;
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Subscribe to a rental plan to rent clothes' USING ERRCODE = 'UE000';
+    END IF;
+
+    SELECT * INTO v_plan
+    FROM rental_plan
+    WHERE rental_plan_id = v_subscription.rental_plan_id;
+
+    PERFORM 1 FROM item WHERE item_id = p_item_id FOR UPDATE;
+
+    SELECT
+        bi.base_item_id,
+        bi.name,
+        bi.discontinued_at,
+        ic.basic_size,
+        COALESCE(inv.stock_quantity, 0) AS stock_quantity
+    INTO v_item
+    FROM item i
+    JOIN base_item bi ON bi.base_item_id = i.base_item_id
+    LEFT JOIN item.clothing ic ON ic.item_id = i.item_id
+    LEFT JOIN inventory inv ON inv.item_id = i.item_id
+    WHERE i.item_id = p_item_id;
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Invalid item: %', p_item_id;
+    END IF;
+
+    IF v_item.discontinued_at IS NOT NULL THEN
+        RAISE EXCEPTION '"%" is no longer available', v_item.name USING ERRCODE = 'UE000';
+    END IF;
+    IF EXISTS (
+        SELECT 1 FROM rental r
+        JOIN item i ON i.item_id = r.item_id
+        WHERE r.site_user_id = p_site_user_id
+          AND r.status = 'out'
+          AND i.base_item_id = v_item.base_item_id
+    ) THEN
+        RAISE EXCEPTION 'You already have "%" out', v_item.name USING ERRCODE = 'UE000';
+    END IF;
+    IF v_item.stock_quantity <= 0 THEN
+        RAISE EXCEPTION 'Size % of "%" is out of stock', v_item.basic_size, v_item.name USING ERRCODE = 'UE000';
+    END IF;
+
+    v_period_start := api.rental_period_start(v_subscription.started_at);
+
+    SELECT
+        COUNT(*) FILTER (WHERE status = 'out'),
+        COUNT(*) FILTER (WHERE rented_at >= v_period_start)
+    INTO v_items_out, v_rented_this_period
+    FROM rental
+    WHERE rental_subscription_id = v_subscription.rental_subscription_id;
+
+    IF v_items_out >= v_plan.items_at_a_time THEN
+        RAISE EXCEPTION 'Your plan allows % items at a time, send one back first', v_plan.items_at_a_time USING ERRCODE = 'UE000';
+    END IF;
+    IF v_plan.swaps_per_month IS NOT NULL
+        AND v_rented_this_period >= v_plan.items_at_a_time + v_plan.swaps_per_month
+    THEN
+        RAISE EXCEPTION 'You have used all % swaps for this month', v_plan.swaps_per_month USING ERRCODE = 'UE000';
+    END IF;
+
+    INSERT INTO rental (site_user_id, rental_subscription_id, item_id, closet_id, due_at)
+    VALUES (
+        p_site_user_id,
+        v_subscription.rental_subscription_id,
+        p_item_id,
+        p_closet_id,
+        NOW() + v_plan.rental_days * INTERVAL '1 day'
+    )
+    RETURNING rental_id INTO v_rental_id;
+
+    INSERT INTO inventory_transaction (transaction_event, item_id, delta_quantity, rental_id)
+    VALUES ('ship-out', p_item_id, -1, v_rental_id);
+
+    RETURN v_rental_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.rent_item (
+    p_username TEXT,
+    p_base_item_name CITEXT,
+    p_brand_name CITEXT,
+    p_size CITEXT
+) RETURNS JSONB AS $$
+DECLARE
+    v_site_user_id INTEGER;
+    v_item_id INTEGER;
+BEGIN
+    SELECT su.site_user_id INTO v_site_user_id
+    FROM site_user su
+    WHERE su.username = p_username;
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'Invalid username: %', p_username;
+    END IF;
+
+    v_item_id := api.clothing_item_id(p_base_item_name, p_brand_name, p_size);
+    IF v_item_id IS NULL THEN
+        RAISE EXCEPTION 'Size % of "%" is not available', p_size, p_base_item_name USING ERRCODE = 'UE000';
+    END IF;
+
+    RETURN api.rental_json(api.rental_start(v_site_user_id, v_item_id));
+END;
+$$ LANGUAGE plpgsql;
+
+-- Rents everything it can from a closet in one size, oldest additions
+-- first.  Items that can't be rented are listed with the reason.
+CREATE FUNCTION api.rent_from_closet (p_username TEXT, p_closet_name TEXT, p_size CITEXT) RETURNS JSONB AS $$
+DECLARE
+    v_site_user_id INTEGER;
+    v_closet_id INTEGER;
+    v_closet_item RECORD;
+    v_item_id INTEGER;
+    v_rented JSONB := '[]'::jsonb;
+    v_skipped JSONB := '[]'::jsonb;
+BEGIN
+    SELECT su.site_user_id INTO v_site_user_id
+    FROM site_user su
+    WHERE su.username = p_username;
+    IF v_site_user_id IS NULL THEN
+        RAISE EXCEPTION 'Invalid username: %', p_username;
+    END IF;
+
+    SELECT c.closet_id INTO v_closet_id
+    FROM closet c
+    WHERE c.site_user_id = v_site_user_id
+        AND c.name = p_closet_name;
+    IF v_closet_id IS NULL THEN
+        RAISE EXCEPTION 'Closet "%" not found for user "%"', p_closet_name, p_username;
+    END IF;
+
+    IF NOT EXISTS (
+        SELECT 1 FROM rental_subscription
+        WHERE site_user_id = v_site_user_id
+          AND status = 'active'
+    ) THEN
+        RAISE EXCEPTION 'Subscribe to a rental plan to rent clothes' USING ERRCODE = 'UE000';
+    END IF;
+
+    FOR v_closet_item IN
+        SELECT bi.base_item_id, bi.name AS base_item_name, b.name AS brand_name
+        FROM closet_item ci
+        JOIN base_item bi ON bi.base_item_id = ci.item_id
+        JOIN brand b ON b.brand_id = bi.brand_id
+        WHERE ci.closet_id = v_closet_id
+        ORDER BY ci.added_at, ci.closet_item_id
+    LOOP
+        -- prefer whichever copy of the size has the most stock
+        SELECT ic.item_id INTO v_item_id
+        FROM item.clothing ic
+        JOIN item i ON i.item_id = ic.item_id
+        LEFT JOIN inventory inv ON inv.item_id = ic.item_id
+        WHERE i.base_item_id = v_closet_item.base_item_id
+          AND ic.basic_size = p_size
+        ORDER BY COALESCE(inv.stock_quantity, 0) DESC, ic.item_id
+        LIMIT 1;
+
+        IF v_item_id IS NULL THEN
+            v_skipped := v_skipped || jsonb_build_object(
+                'item_name', v_closet_item.base_item_name,
+                'brand_name', v_closet_item.brand_name,
+                'reason', format('Not made in size %s', p_size)
+            );
+            CONTINUE;
+        END IF;
+
+        BEGIN
+            v_rented := v_rented || api.rental_json(api.rental_start(v_site_user_id, v_item_id, v_closet_id));
+        EXCEPTION WHEN SQLSTATE 'UE000' THEN
+            v_skipped := v_skipped || jsonb_build_object(
+                'item_name', v_closet_item.base_item_name,
+                'brand_name', v_closet_item.brand_name,
+                'reason', SQLERRM
+            );
+        END;
+    END LOOP;
+
+    RETURN jsonb_build_object(
+        'rented', v_rented,
+        'skipped', v_skipped
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- The member has sent the item back.  It stops counting against their plan
+-- straight away and is checked in when it arrives.
+CREATE FUNCTION api.rental_start_return (p_username TEXT, p_rental_id INTEGER) RETURNS JSONB AS $$
+BEGIN
+    UPDATE rental r SET status = 'returning', return_started_at = NOW()
+    FROM site_user su
+    WHERE su.site_user_id = r.site_user_id
+      AND su.username = p_username
+      AND r.rental_id = p_rental_id
+      AND r.status = 'out';
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Rental % is not out with you', p_rental_id USING ERRCODE = 'UE000';
+    END IF;
+
+    RETURN api.rental_json(p_rental_id);
+END;
+$$ LANGUAGE plpgsql;
+
+-- Sends one item back and rents another in its place
+CREATE FUNCTION api.rental_swap (
+    p_username TEXT,
+    p_rental_id INTEGER,
+    p_base_item_name CITEXT,
+    p_brand_name CITEXT,
+    p_size CITEXT
+) RETURNS JSONB AS $$
+BEGIN
+    PERFORM api.rental_start_return(p_username, p_rental_id);
+    RETURN api.rent_item(p_username, p_base_item_name, p_brand_name, p_size);
+END;
+$$ LANGUAGE plpgsql;
+
+-- Staff receiving a returned item puts it back into stock
+CREATE FUNCTION api.rental_check_in (p_rental_id INTEGER, p_condition_note TEXT DEFAULT NULL) RETURNS JSONB AS $$
+DECLARE
+    v_item_id INTEGER;
+BEGIN
+    UPDATE rental SET
+        status = 'returned',
+        returned_at = NOW(),
+        return_started_at = COALESCE(return_started_at, NOW()),
+        condition_note = NULLIF(TRIM(p_condition_note), '')
+    WHERE rental_id = p_rental_id
+      AND status IN ('out', 'returning')
+    RETURNING item_id INTO v_item_id;
+    IF v_item_id IS NULL THEN
+        RAISE EXCEPTION 'Rental % is not waiting to be returned', p_rental_id USING ERRCODE = 'UE000';
+    END IF;
+
+    INSERT INTO inventory_transaction (transaction_event, item_id, delta_quantity, rental_id)
+    VALUES ('ship-in', v_item_id, 1, p_rental_id);
+
+    RETURN api.rental_json(p_rental_id);
+END;
+$$ LANGUAGE plpgsql;
+
+-- The item never came back.  It already left the stock when it was rented.
+CREATE FUNCTION api.rental_mark_lost (p_rental_id INTEGER, p_condition_note TEXT DEFAULT NULL) RETURNS JSONB AS $$
+BEGIN
+    UPDATE rental SET status = 'lost', condition_note = NULLIF(TRIM(p_condition_note), '')
+    WHERE rental_id = p_rental_id
+      AND status IN ('out', 'returning');
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Rental % is not waiting to be returned', p_rental_id USING ERRCODE = 'UE000';
+    END IF;
+
+    RETURN api.rental_json(p_rental_id);
+END;
+$$ LANGUAGE plpgsql;
+
+-- Back office.  These trust the caller, the /admin routes check the role.
+
+-- Rentals still to come back, the ones on their way first and then the
+-- longest overdue, for checking in or writing off
+CREATE FUNCTION api.admin_open_rentals () RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        api.rental_json(r.rental_id) || jsonb_build_object('username', su.username, 'email', su.email)
+        ORDER BY r.status = 'returning' DESC, r.due_at, r.rental_id
+    ),
+    '[]'::jsonb
+)
+FROM rental r
+JOIN site_user su ON su.site_user_id = r.site_user_id
+WHERE r.status IN ('out', 'returning');
+$$;
+
+-- Paid orders waiting to be sent, oldest first
+CREATE FUNCTION api.admin_orders_to_fulfil () RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        api.order_json(co.customer_order_id) || jsonb_build_object('username', su.username, 'email', su.email)
+        ORDER BY co.created_at, co.customer_order_id
+    ),
+    '[]'::jsonb
+)
+FROM customer_order co
+JOIN site_user su ON su.site_user_id = co.site_user_id
+WHERE co.status = 'paid';
+$$;
+
+CREATE FUNCTION api.admin_base_items (
+    p_query TEXT,
+    p_page_index INTEGER,
+    p_items_per_page INTEGER
+) RETURNS JSONB AS $$
+DECLARE
+    v_items JSONB;
+    v_total_count INTEGER;
+BEGIN
+    IF p_page_index IS NULL OR p_page_index < 1 THEN
+        p_page_index := 1;
+    END IF;
+
+    IF p_items_per_page IS NULL OR p_items_per_page < 1 THEN
+        p_items_per_page := 50;
+    END IF;
+
+    SELECT COUNT(*) INTO v_total_count
+    FROM base_item bi
+    LEFT JOIN brand b ON b.brand_id = bi.brand_id
+    WHERE COALESCE(p_query, '') = ''
+       OR bi.name ILIKE '%' || p_query || '%'
+       OR b.name ILIKE '%' || p_query || '%';
+
+    SELECT COALESCE(
+        jsonb_agg(
+            jsonb_build_object(
+                'id', page.base_item_id,
+                'name', page.name,
+                'brand_name', page.brand_name,
+                'discontinued_at', page.discontinued_at,
+                'size_count', page.size_count,
+                'stock_quantity', page.stock_quantity,
+                'thumbnail_url', page.thumbnail_url,
+                'thumbnail_hash', page.thumbnail_hash
+            ) ORDER BY page.brand_name, page.name, page.base_item_id
+        ),
+        '[]'::jsonb
+    ) INTO v_items
+    FROM (
+        SELECT
+            bi.base_item_id,
+            bi.name,
+            b.name AS brand_name,
+            bi.discontinued_at,
+            img.url AS thumbnail_url,
+            img.content_hash AS thumbnail_hash,
+            (SELECT COUNT(*) FROM item i WHERE i.base_item_id = bi.base_item_id) AS size_count,
+            (
+                SELECT COALESCE(SUM(inv.stock_quantity), 0)
+                FROM item i
+                JOIN inventory inv ON inv.item_id = i.item_id
+                WHERE i.base_item_id = bi.base_item_id
+            ) AS stock_quantity
+        FROM base_item bi
+        LEFT JOIN brand b ON b.brand_id = bi.brand_id
+        LEFT JOIN image img ON img.image_id = bi.thumbnail_image_id
+        WHERE COALESCE(p_query, '') = ''
+           OR bi.name ILIKE '%' || p_query || '%'
+           OR b.name ILIKE '%' || p_query || '%'
+        ORDER BY b.name, bi.name, bi.base_item_id
+        LIMIT p_items_per_page
+        OFFSET (p_page_index - 1) * p_items_per_page
+    ) page;
+
+    RETURN jsonb_build_object(
+        'items', v_items,
+        'total_count', v_total_count,
+        'total_pages', GREATEST(CEIL(v_total_count::NUMERIC / p_items_per_page)::INTEGER, 1)
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.admin_base_item (p_base_item_id INTEGER) RETURNS JSONB AS $$
+DECLARE
+    v_result JSONB;
+BEGIN
+    SELECT jsonb_build_object(
+        'id', bi.base_item_id,
+        'name', bi.name,
+        'description', bi.description,
+        'brand_name', b.name,
+        'rating', bi.rating,
+        'source', bi.source,
+        'source_id', bi.source_id,
+        'added', bi.added,
+        'updated_at', bi.updated_at,
+        'discontinued_at', bi.discontinued_at,
+        'price', api.price(bi.base_item_id),
+        'tags', (
+            SELECT COALESCE(jsonb_agg(t.name ORDER BY t.name), '[]'::jsonb)
+            FROM tag_item ti
+            JOIN tag t ON t.tag_id = ti.tag_id
+            WHERE ti.base_item_id = bi.base_item_id
+        ),
+        'images', (
+            SELECT COALESCE(
+                jsonb_agg(
+                    jsonb_build_object(
+                        'image_id', img.image_id,
+                        'url', img.url,
+                        'content_hash', img.content_hash,
+                        'alt', img.alt,
+                        'is_thumbnail', img.image_id = bi.thumbnail_image_id
+                    ) ORDER BY img.image_id
+                ),
+                '[]'::jsonb
+            )
+            FROM image img
+            WHERE img.image_id IN (
+                SELECT image_id FROM base_item_image WHERE base_item_id = bi.base_item_id
+                UNION
+                SELECT bi.thumbnail_image_id
+            )
+        ),
+        'sizes', (
+            SELECT COALESCE(
+                jsonb_agg(
+                    jsonb_build_object(
+                        'item_id', ic.item_id,
+                        'size', ic.basic_size,
+                        'stock_quantity', COALESCE(inv.stock_quantity, 0),
+                        'reorder_threshold', i.reorder_threshold
+                    ) ORDER BY bs.relative_order, ic.item_id
+                ),
+                '[]'::jsonb
+            )
+            FROM item i
+            JOIN item.clothing ic ON ic.item_id = i.item_id
+            LEFT JOIN basic_size bs ON bs.size = ic.basic_size
+            LEFT JOIN inventory inv ON inv.item_id = ic.item_id
+            WHERE i.base_item_id = bi.base_item_id
+        )
+    ) INTO v_result
+    FROM base_item bi
+    LEFT JOIN brand b ON b.brand_id = bi.brand_id
+    WHERE bi.base_item_id = p_base_item_id;
+
+    IF v_result IS NULL THEN
+        RAISE EXCEPTION 'Item % not found', p_base_item_id USING ERRCODE = 'UE000';
+    END IF;
+
+    RETURN v_result;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Creates the base item when p_base_item_id is null.  Returns its id.
+CREATE FUNCTION api.admin_save_base_item (
+    p_base_item_id INTEGER,
+    p_name CITEXT,
+    p_description TEXT,
+    p_brand_name CITEXT,
+    p_rating NUMERIC(2, 1),
+    p_tags TEXT[],
+    p_discontinued BOOLEAN
+) RETURNS INTEGER AS $$
+DECLARE
+    v_brand_id INTEGER;
+    v_base_item_id INTEGER := p_base_item_id;
+BEGIN
+    IF COALESCE(TRIM(p_name), '') = '' THEN
+        RAISE EXCEPTION 'A name is required' USING ERRCODE = 'UE000';
+    END IF;
+    IF p_rating IS NOT NULL AND (p_rating < 0 OR p_rating > 5) THEN
+        RAISE EXCEPTION 'Rating must be between 0 and 5' USING ERRCODE = 'UE000';
+    END IF;
+
+    SELECT brand_id INTO v_brand_id FROM brand WHERE name = p_brand_name;
+    IF v_brand_id IS NULL THEN
+        RAISE EXCEPTION 'There is no brand called "%"', p_brand_name USING ERRCODE = 'UE000';
+    END IF;
+
+    -- items are looked up by brand and name everywhere else
+    IF EXISTS (
+        SELECT 1 FROM base_item
+        WHERE brand_id = v_brand_id
+          AND name = TRIM(p_name)
+          AND base_item_id IS DISTINCT FROM p_base_item_id
+    ) THEN
+        RAISE EXCEPTION '% already has an item called "%"', p_brand_name, TRIM(p_name) USING ERRCODE = 'UE000';
+    END IF;
+
+    IF v_base_item_id IS NULL THEN
+        INSERT INTO base_item (name, description, brand_id, rating)
+        VALUES (TRIM(p_name), NULLIF(TRIM(p_description), ''), v_brand_id, p_rating)
+        RETURNING base_item_id INTO v_base_item_id;
+    ELSE
+        UPDATE base_item SET
+            name = TRIM(p_name),
+            description = NULLIF(TRIM(p_description), ''),
+            brand_id = v_brand_id,
+            rating = p_rating,
+            updated_at = NOW()
+        WHERE base_item_id = v_base_item_id;
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'Item % not found', v_base_item_id USING ERRCODE = 'UE000';
+        END IF;
+    END IF;
+
+    UPDATE base_item SET discontinued_at = CASE
+        WHEN p_discontinued THEN COALESCE(discontinued_at, NOW())
+    END
+    WHERE base_item_id = v_base_item_id;
+
+    INSERT INTO tag (name)
+    SELECT DISTINCT TRIM(t) FROM unnest(COALESCE(p_tags, '{}'::text[])) t
+    WHERE TRIM(t) <> ''
+    ON CONFLICT (name) DO NOTHING;
+
+    DELETE FROM tag_item ti
+    USING tag t
+    WHERE ti.tag_id = t.tag_id
+      AND ti.base_item_id = v_base_item_id
+      AND NOT (t.name = ANY(COALESCE(p_tags, '{}'::text[])::citext[]));
+
+    INSERT INTO tag_item (tag_id, base_item_id)
+    SELECT t.tag_id, v_base_item_id
+    FROM tag t
+    WHERE t.name = ANY(COALESCE(p_tags, '{}'::text[])::citext[])
+    ON CONFLICT DO NOTHING;
+
+    RETURN v_base_item_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.admin_add_base_item_size (p_base_item_id INTEGER, p_size CITEXT) RETURNS INTEGER AS $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM basic_size WHERE size = p_size) THEN
+        RAISE EXCEPTION 'Unknown size: %', p_size USING ERRCODE = 'UE000';
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM base_item WHERE base_item_id = p_base_item_id) THEN
+        RAISE EXCEPTION 'Item % not found', p_base_item_id USING ERRCODE = 'UE000';
+    END IF;
+
+    RETURN upsert_clothing_item(p_base_item_id, p_size);
+END;
+$$ LANGUAGE plpgsql;
+
+-- The first image added becomes the thumbnail
+CREATE FUNCTION api.admin_add_base_item_image (p_base_item_id INTEGER, p_url TEXT, p_alt TEXT) RETURNS VOID AS $$
+DECLARE
+    v_image_id INTEGER;
+BEGIN
+    IF COALESCE(TRIM(p_url), '') = '' THEN
+        RAISE EXCEPTION 'An image is required' USING ERRCODE = 'UE000';
+    END IF;
+
+    INSERT INTO image (url, alt) VALUES (TRIM(p_url), NULLIF(TRIM(p_alt), ''))
+    ON CONFLICT (url) DO UPDATE SET alt = COALESCE(EXCLUDED.alt, image.alt)
+    RETURNING image_id INTO v_image_id;
+
+    INSERT INTO base_item_image (base_item_id, image_id)
+    VALUES (p_base_item_id, v_image_id)
+    ON CONFLICT DO NOTHING;
+
+    UPDATE base_item SET thumbnail_image_id = v_image_id, updated_at = NOW()
+    WHERE base_item_id = p_base_item_id
+      AND thumbnail_image_id IS NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.admin_remove_base_item_image (p_base_item_id INTEGER, p_image_id INTEGER) RETURNS VOID AS $$
+BEGIN
+    DELETE FROM base_item_image
+    WHERE base_item_id = p_base_item_id
+      AND image_id = p_image_id;
+
+    UPDATE base_item SET
+        thumbnail_image_id = (
+            SELECT MIN(image_id) FROM base_item_image WHERE base_item_id = p_base_item_id
+        ),
+        updated_at = NOW()
+    WHERE base_item_id = p_base_item_id
+      AND thumbnail_image_id = p_image_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.admin_set_base_item_thumbnail (p_base_item_id INTEGER, p_image_id INTEGER) RETURNS VOID AS $$
+BEGIN
+    IF NOT EXISTS (
+        SELECT 1 FROM base_item_image
+        WHERE base_item_id = p_base_item_id
+          AND image_id = p_image_id
+    ) THEN
+        RAISE EXCEPTION 'That image does not belong to this item' USING ERRCODE = 'UE000';
+    END IF;
+
+    UPDATE base_item SET thumbnail_image_id = p_image_id, updated_at = NOW()
+    WHERE base_item_id = p_base_item_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Every inventory transaction for every size of a base item, newest first,
+-- with the stock of that size after each one
+CREATE FUNCTION api.admin_item_ledger (p_base_item_id INTEGER) RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        jsonb_build_object(
+            'id', ledger.inventory_transaction_id,
+            'transaction_date', ledger.transaction_date,
+            'transaction_event', ledger.transaction_event,
+            'item_id', ledger.item_id,
+            'size', ledger.basic_size,
+            'delta_quantity', ledger.delta_quantity,
+            'balance', ledger.balance,
+            'order_number', ledger.order_number,
+            'rental_id', ledger.rental_id
+        ) ORDER BY ledger.transaction_date DESC, ledger.inventory_transaction_id DESC
+    ),
+    '[]'::jsonb
+)
+FROM (
+    SELECT
+        it.inventory_transaction_id,
+        it.transaction_date,
+        it.transaction_event,
+        it.item_id,
+        ic.basic_size,
+        it.delta_quantity,
+        SUM(it.delta_quantity) OVER (
+            PARTITION BY it.item_id
+            ORDER BY it.transaction_date, it.inventory_transaction_id
+        ) AS balance,
+        co.order_number,
+        it.rental_id
+    FROM inventory_transaction it
+    JOIN item i ON i.item_id = it.item_id
+    LEFT JOIN item.clothing ic ON ic.item_id = it.item_id
+    LEFT JOIN customer_order co ON co.customer_order_id = it.customer_order_id
+    WHERE i.base_item_id = p_base_item_id
+) ledger;
+$$;
+
+CREATE FUNCTION api.admin_brands () RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        jsonb_build_object(
+            'id', b.brand_id,
+            'name', b.name,
+            'item_count', (SELECT COUNT(*) FROM base_item bi WHERE bi.brand_id = b.brand_id)
+        ) ORDER BY b.name
+    ),
+    '[]'::jsonb
+)
+FROM brand b;
+$$;
+
+-- Creates the brand when p_brand_id is null, otherwise renames it
+CREATE FUNCTION api.admin_save_brand (p_brand_id INTEGER, p_name CITEXT) RETURNS VOID AS $$
+BEGIN
+    IF COALESCE(TRIM(p_name), '') = '' THEN
+        RAISE EXCEPTION 'A name is required' USING ERRCODE = 'UE000';
+    END IF;
+    IF EXISTS (SELECT 1 FROM brand WHERE name = TRIM(p_name) AND brand_id IS DISTINCT FROM p_brand_id) THEN
+        RAISE EXCEPTION 'There is already a brand called "%"', TRIM(p_name) USING ERRCODE = 'UE000';
+    END IF;
+
+    IF p_brand_id IS NULL THEN
+        INSERT INTO brand (name) VALUES (TRIM(p_name));
+    ELSE
+        UPDATE brand SET name = TRIM(p_name) WHERE brand_id = p_brand_id;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.admin_tags () RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        jsonb_build_object(
+            'id', t.tag_id,
+            'name', t.name,
+            'item_count', (SELECT COUNT(*) FROM tag_item ti WHERE ti.tag_id = t.tag_id)
+        ) ORDER BY t.name
+    ),
+    '[]'::jsonb
+)
+FROM tag t;
+$$;
+
+-- Creates the tag when p_tag_id is null, otherwise renames it
+CREATE FUNCTION api.admin_save_tag (p_tag_id INTEGER, p_name CITEXT) RETURNS VOID AS $$
+BEGIN
+    IF COALESCE(TRIM(p_name), '') = '' THEN
+        RAISE EXCEPTION 'A name is required' USING ERRCODE = 'UE000';
+    END IF;
+    IF EXISTS (SELECT 1 FROM tag WHERE name = TRIM(p_name) AND tag_id IS DISTINCT FROM p_tag_id) THEN
+        RAISE EXCEPTION 'There is already a tag called "%"', TRIM(p_name) USING ERRCODE = 'UE000';
+    END IF;
+
+    IF p_tag_id IS NULL THEN
+        INSERT INTO tag (name) VALUES (TRIM(p_name));
+    ELSE
+        UPDATE tag SET name = TRIM(p_name) WHERE tag_id = p_tag_id;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Removes the tag from every item that has it
+CREATE FUNCTION api.admin_delete_tag (p_tag_id INTEGER) RETURNS VOID AS $$
+BEGIN
+    DELETE FROM tag WHERE tag_id = p_tag_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Applies rows of {line, brand, item, size, event, quantity}, all as text
+-- straight from a spreadsheet.  Every row is checked first and nothing is
+-- applied if any row has an error, or when p_dry_run is set.
+CREATE FUNCTION api.inventory_import (p_rows JSONB, p_dry_run BOOLEAN DEFAULT TRUE) RETURNS JSONB AS $$
+DECLARE
+    v_row JSONB;
+    v_line INTEGER := 0;
+    v_event TEXT;
+    v_quantity INTEGER;
+    v_item_id INTEGER;
+    v_before INTEGER;
+    v_after INTEGER;
+    v_reserved INTEGER;
+    v_error TEXT;
+    v_error_count INTEGER := 0;
+    -- item_id to stock after the rows so far, so repeated items add up
+    v_stock JSONB := '{}'::jsonb;
+    v_results JSONB := '[]'::jsonb;
+    v_result JSONB;
+BEGIN
+    FOR v_row IN SELECT value FROM jsonb_array_elements(COALESCE(p_rows, '[]'::jsonb))
+    LOOP
+        v_line := COALESCE((v_row->>'line')::INTEGER, v_line + 1);
+        v_event := LOWER(TRIM(v_row->>'event'));
+        v_quantity := NULL;
+        v_item_id := NULL;
+        v_before := NULL;
+        v_after := NULL;
+        v_error := NULL;
+
+        IF TRIM(v_row->>'quantity') ~ '^-?[0-9]{1,9}$' THEN
+            v_quantity := TRIM(v_row->>'quantity')::INTEGER;
+        END IF;
+
+        IF v_event IS NULL OR v_event NOT IN ('audit', 'ship-in', 'ship-out', 'scrap') THEN
+            v_error := format('Unknown event "%s", expected audit, ship-in, ship-out or scrap', COALESCE(v_event, ''));
+        ELSIF v_quantity IS NULL THEN
+            v_error := format('Quantity "%s" is not a whole number', COALESCE(v_row->>'quantity', ''));
+        ELSIF v_event = 'audit' AND v_quantity < 0 THEN
+            v_error := 'An audit quantity cannot be negative';
+        ELSIF v_event <> 'audit' AND v_quantity < 1 THEN
+            v_error := 'Quantity must be at least 1';
+        ELSE
+            v_item_id := api.clothing_item_id(TRIM(v_row->>'item'), TRIM(v_row->>'brand'), TRIM(v_row->>'size'));
+            IF v_item_id IS NULL THEN
+                v_error := format('%s "%s" does not come in size %s', v_row->>'brand', v_row->>'item', v_row->>'size');
+            END IF;
+        END IF;
+
+        IF v_error IS NULL THEN
+            v_before := COALESCE((v_stock->>v_item_id::TEXT)::INTEGER, api.stock_quantity(v_item_id));
+            -- stock counts what is left to sell, an audit counts the
+            -- shelves which still hold what open orders have reserved
+            v_reserved := api.physical_stock(v_item_id) - api.stock_quantity(v_item_id);
+            v_after := CASE v_event
+                WHEN 'audit' THEN v_quantity - v_reserved
+                WHEN 'ship-in' THEN v_before + v_quantity
+                ELSE v_before - v_quantity
+            END;
+            IF v_after < 0 AND v_event = 'audit' THEN
+                v_error := format('%s are reserved for orders, count at least that many', v_reserved);
+            ELSIF v_after < 0 THEN
+                v_error := format('Only %s in stock', v_before);
+            ELSE
+                v_stock := jsonb_set(v_stock, ARRAY[v_item_id::TEXT], to_jsonb(v_after));
+            END IF;
+        END IF;
+
+        IF v_error IS NOT NULL THEN
+            v_error_count := v_error_count + 1;
+        END IF;
+
+        v_results := v_results || jsonb_build_object(
+            'line', v_line,
+            'brand', v_row->>'brand',
+            'item', v_row->>'item',
+            'size', v_row->>'size',
+            'event', v_row->>'event',
+            'quantity', v_row->>'quantity',
+            'item_id', v_item_id,
+            'stock_before', v_before,
+            'stock_after', v_after,
+            'error', v_error
+        );
+    END LOOP;
+
+    IF v_error_count = 0 AND NOT p_dry_run THEN
+        FOR v_result IN SELECT value FROM jsonb_array_elements(v_results)
+        LOOP
+            PERFORM api.transaction(
+                LOWER(TRIM(v_result->>'event')),
+                (v_result->>'item_id')::INTEGER,
+                TRIM(v_result->>'quantity')::INTEGER
+            );
+        END LOOP;
+    END IF;
+
+    RETURN jsonb_build_object(
+        'rows', v_results,
+        'row_count', jsonb_array_length(v_results),
+        'error_count', v_error_count,
+        'applied', v_error_count = 0 AND NOT p_dry_run
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+-- Current stock of every size of every item, including sizes with none
+CREATE FUNCTION api.inventory_export () RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        jsonb_build_object(
+            'brand', b.name,
+            'item', bi.name,
+            'size', ic.basic_size,
+            'item_id', ic.item_id,
+            'stock_quantity', COALESCE(inv.stock_quantity, 0),
+            'physical_stock', api.physical_stock(ic.item_id),
+            'discontinued', bi.discontinued_at IS NOT NULL
+        ) ORDER BY b.name, bi.name, bs.relative_order, ic.item_id
+    ),
+    '[]'::jsonb
+)
+FROM item.clothing ic
+JOIN item i ON i.item_id = ic.item_id
+JOIN base_item bi ON bi.base_item_id = i.base_item_id
+JOIN brand b ON b.brand_id = bi.brand_id
+LEFT JOIN basic_size bs ON bs.size = ic.basic_size
+LEFT JOIN inventory inv ON inv.item_id = ic.item_id;
+$$;
+
+-- What an alert is about, for notifications and the stock dashboard
+CREATE FUNCTION api.stock_alert_json (p_stock_alert_id INTEGER) RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT jsonb_build_object(
+    'id', sa.stock_alert_id,
+    'item_id', sa.item_id,
+    'base_item_id', bi.base_item_id,
+    'brand', b.name,
+    'item', bi.name,
+    'size', ic.basic_size,
+    'level', sa.level,
+    'stock_quantity', sa.stock_quantity,
+    'reorder_threshold', sa.reorder_threshold,
+    'raised_at', sa.raised_at,
+    'notified_at', sa.notified_at
+)
+FROM stock_alert sa
+JOIN item i ON i.item_id = sa.item_id
+JOIN base_item bi ON bi.base_item_id = i.base_item_id
+LEFT JOIN brand b ON b.brand_id = bi.brand_id
+LEFT JOIN item.clothing ic ON ic.item_id = sa.item_id
+WHERE sa.stock_alert_id = p_stock_alert_id;
+$$;
+
+-- Whether stock is out, low or fine (null)
+CREATE FUNCTION api.stock_level (p_stock_quantity INTEGER, p_reorder_threshold INTEGER) RETURNS TEXT LANGUAGE sql IMMUTABLE AS $$
+SELECT CASE
+    WHEN p_stock_quantity <= 0 THEN 'out'
+    WHEN p_stock_quantity <= p_reorder_threshold THEN 'low'
+END;
+$$;
+
+-- Stock of every size that has ever been stocked and is not discontinued,
+-- so scraped items nobody carries stay quiet
+CREATE FUNCTION api.watched_stock () RETURNS TABLE (
+    item_id INTEGER,
+    stock_quantity INTEGER,
+    reorder_threshold INTEGER,
+    level TEXT
+) LANGUAGE sql STABLE AS $$
+SELECT
+    inv.item_id,
+    inv.stock_quantity::INTEGER,
+    i.reorder_threshold,
+    api.stock_level(inv.stock_quantity::INTEGER, i.reorder_threshold)
+FROM inventory inv
+JOIN item i ON i.item_id = inv.item_id
+JOIN base_item bi ON bi.base_item_id = i.base_item_id
+WHERE bi.discontinued_at IS NULL;
+$$;
+
+-- Resolves alerts that no longer apply and raises new ones, then returns
+-- every open alert the notification sinks have not been told about yet
+CREATE FUNCTION api.stock_alerts_scan () RETURNS JSONB AS $$
+BEGIN
+    UPDATE stock_alert sa
+    SET resolved_at = CURRENT_TIMESTAMP
+    WHERE sa.resolved_at IS NULL
+      AND NOT EXISTS (
+        SELECT 1 FROM api.watched_stock() ws
+        WHERE ws.item_id = sa.item_id AND ws.level = sa.level
+      );
+
+    INSERT INTO stock_alert (item_id, level, stock_quantity, reorder_threshold)
+    SELECT ws.item_id, ws.level, ws.stock_quantity, ws.reorder_threshold
+    FROM api.watched_stock() ws
+    WHERE ws.level IS NOT NULL
+    ON CONFLICT (item_id) WHERE resolved_at IS NULL DO NOTHING;
+
+    RETURN (
+        SELECT COALESCE(jsonb_agg(api.stock_alert_json(sa.stock_alert_id) ORDER BY sa.stock_alert_id), '[]'::jsonb)
+        FROM stock_alert sa
+        WHERE sa.resolved_at IS NULL
+          AND sa.notified_at IS NULL
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE FUNCTION api.stock_alerts_notified (p_stock_alert_ids INTEGER[]) RETURNS VOID LANGUAGE sql AS $$
+UPDATE stock_alert
+SET notified_at = CURRENT_TIMESTAMP
+WHERE stock_alert_id = ANY (p_stock_alert_ids)
+  AND notified_at IS NULL;
+$$;
+
+-- Every watched size that is low or out right now, out of stock first, with
+-- its open alert if the job has seen it
+CREATE FUNCTION api.admin_low_stock () RETURNS JSONB LANGUAGE sql STABLE AS $$
+SELECT COALESCE(
+    jsonb_agg(
+        jsonb_build_object(
+            'id', sa.stock_alert_id,
+            'item_id', ws.item_id,
+            'base_item_id', bi.base_item_id,
+            'brand', b.name,
+            'item', bi.name,
+            'size', ic.basic_size,
+            'level', ws.level,
+            'stock_quantity', ws.stock_quantity,
+            'reorder_threshold', ws.reorder_threshold,
+            'raised_at', sa.raised_at,
+            'notified_at', sa.notified_at
+        ) ORDER BY ws.stock_quantity, b.name, bi.name, bs.relative_order
+    ),
+    '[]'::jsonb
+)
+FROM api.watched_stock() ws
+JOIN item i ON i.item_id = ws.item_id
+JOIN base_item bi ON bi.base_item_id = i.base_item_id
+LEFT JOIN brand b ON b.brand_id = bi.brand_id
+LEFT JOIN item.clothing ic ON ic.item_id = ws.item_id
+LEFT JOIN basic_size bs ON bs.size = ic.basic_size
+LEFT JOIN stock_alert sa ON sa.item_id = ws.item_id AND sa.resolved_at IS NULL
+WHERE ws.level IS NOT NULL;
+$$;
+
+CREATE FUNCTION api.admin_set_reorder_threshold (p_item_id INTEGER, p_reorder_threshold INTEGER) RETURNS VOID AS $$
+BEGIN
+    IF p_reorder_threshold IS NULL OR p_reorder_threshold < 0 THEN
+        RAISE EXCEPTION 'The reorder threshold cannot be negative' USING ERRCODE = 'UE000';
+    END IF;
+
+    UPDATE item SET reorder_threshold = p_reorder_threshold WHERE item_id = p_item_id;
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'Item not found' USING ERRCODE = 'UE000';
+    END IF;
+
+    -- the alert job rescans as it would after a stock change
+    PERFORM pg_notify('inventory_changed', '');
+END;
+$$ LANGUAGE plpgsql;
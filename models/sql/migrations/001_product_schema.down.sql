@@ -0,0 +1,35 @@
+DROP SCHEMA IF EXISTS item CASCADE;
+
+DROP FUNCTION IF EXISTS add_clothing_item;
+
+DROP FUNCTION IF EXISTS add_base_item;
+
+DROP VIEW IF EXISTS inventory;
+
+DROP TABLE IF EXISTS inventory_transaction;
+
+DROP TABLE IF EXISTS transaction_event;
+
+DROP TABLE IF EXISTS tag_item;
+
+DROP TABLE IF EXISTS item;
+
+DROP TABLE IF EXISTS base_item_image;
+
+DROP TABLE IF EXISTS base_item;
+
+DROP TABLE IF EXISTS image;
+
+DROP TABLE IF EXISTS tag;
+
+DROP TABLE IF EXISTS brand;
+
+DROP TABLE IF EXISTS color;
+
+DROP TABLE IF EXISTS basic_size;
+
+DROP EXTENSION IF EXISTS pgcrypto;
+
+DROP EXTENSION IF EXISTS unaccent;
+
+DROP EXTENSION IF EXISTS citext;
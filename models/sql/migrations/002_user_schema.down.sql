@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS closet_item;
+
+DROP TABLE IF EXISTS closet;
+
+DROP TABLE IF EXISTS session;
+
+DROP TABLE IF EXISTS site_user;
+
+DROP DOMAIN IF EXISTS email;
@@ -0,0 +1,20 @@
+-- One row per scraper run so interrupted runs can resume where they left off
+CREATE TABLE scrape_run (
+    scrape_run_id SERIAL PRIMARY KEY,
+    source TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'running' CHECK (
+        status IN ('running', 'paused', 'failed', 'completed')
+    ),
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMPTZ,
+    last_completed_page INTEGER NOT NULL DEFAULT 0,
+    total_pages INTEGER,
+    items_seen INTEGER NOT NULL DEFAULT 0,
+    items_inserted INTEGER NOT NULL DEFAULT 0,
+    items_updated INTEGER NOT NULL DEFAULT 0,
+    items_failed INTEGER NOT NULL DEFAULT 0,
+    error TEXT
+);
+
+CREATE INDEX idx_scrape_run_source ON scrape_run (source, started_at DESC);
@@ -0,0 +1,12 @@
+DROP FUNCTION IF EXISTS upsert_clothing_item;
+
+DROP FUNCTION IF EXISTS upsert_base_item;
+
+ALTER TABLE base_item
+    DROP CONSTRAINT IF EXISTS base_item_source_unique,
+    DROP CONSTRAINT IF EXISTS base_item_source_check,
+    DROP COLUMN IF EXISTS discontinued_at,
+    DROP COLUMN IF EXISTS last_seen_at,
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS source_id,
+    DROP COLUMN IF EXISTS source;
@@ -0,0 +1,114 @@
+-- Scraped items are identified by where they came from so re-scrapes update
+-- them in place instead of creating duplicates
+ALTER TABLE base_item
+    ADD COLUMN source TEXT,
+    ADD COLUMN source_id TEXT,
+    ADD COLUMN updated_at TIMESTAMPTZ DEFAULT NOW(),
+    ADD COLUMN last_seen_at TIMESTAMPTZ,
+    ADD COLUMN discontinued_at TIMESTAMPTZ,
+    ADD CONSTRAINT base_item_source_check CHECK ((source IS NULL) = (source_id IS NULL)),
+    ADD CONSTRAINT base_item_source_unique UNIQUE (source, source_id);
+
+CREATE FUNCTION upsert_base_item (
+    p_source TEXT,
+    p_source_id TEXT,
+    p_name TEXT,
+    p_description TEXT,
+    p_brand_name TEXT,
+    p_thumbnail_url TEXT,
+    p_image_urls TEXT[] DEFAULT '{}'::text[],
+    p_rating NUMERIC(2, 1) DEFAULT NULL,
+    p_tags TEXT[] DEFAULT '{}'::text[],
+    OUT r_base_item_id INTEGER,
+    OUT r_inserted BOOLEAN
+) AS $$
+DECLARE
+    v_brand_id INTEGER;
+    v_thumbnail_id INTEGER;
+BEGIN
+    IF p_source IS NULL OR p_source_id IS NULL THEN
+        RAISE EXCEPTION 'Source and source id are required to upsert a base item';
+    END IF;
+
+    IF p_brand_name IS NOT NULL THEN
+        v_brand_id := (SELECT brand_id FROM brand WHERE name = p_brand_name);
+    END IF;
+
+    IF p_thumbnail_url IS NOT NULL THEN
+        INSERT INTO image (url) VALUES (p_thumbnail_url) ON CONFLICT (url) DO NOTHING;
+        v_thumbnail_id := (SELECT image_id FROM image WHERE url = p_thumbnail_url);
+    END IF;
+
+    -- xmax is only zero for a freshly inserted row
+    INSERT INTO base_item AS bi (source, source_id, name, description, brand_id, thumbnail_image_id, rating, last_seen_at)
+    VALUES (p_source, p_source_id, p_name, p_description, v_brand_id, v_thumbnail_id, p_rating, NOW())
+    ON CONFLICT (source, source_id) DO UPDATE SET
+        name = EXCLUDED.name,
+        description = EXCLUDED.description,
+        brand_id = EXCLUDED.brand_id,
+        thumbnail_image_id = EXCLUDED.thumbnail_image_id,
+        rating = EXCLUDED.rating,
+        last_seen_at = NOW(),
+        discontinued_at = NULL,
+        updated_at = NOW()
+    RETURNING bi.base_item_id, (bi.xmax = 0) INTO r_base_item_id, r_inserted;
+
+    -- replace the image links with exactly what the source has now
+    INSERT INTO image (url)
+    SELECT DISTINCT unnest(COALESCE(p_image_urls, '{}'::text[]))
+    ON CONFLICT (url) DO NOTHING;
+
+    DELETE FROM base_item_image bii
+    USING image img
+    WHERE bii.image_id = img.image_id
+      AND bii.base_item_id = r_base_item_id
+      AND NOT (img.url = ANY(COALESCE(p_image_urls, '{}'::text[])));
+
+    INSERT INTO base_item_image (base_item_id, image_id)
+    SELECT r_base_item_id, img.image_id
+    FROM image img
+    WHERE img.url = ANY(COALESCE(p_image_urls, '{}'::text[]))
+    ON CONFLICT DO NOTHING;
+
+    -- and the same for tags
+    INSERT INTO tag (name)
+    SELECT DISTINCT unnest(COALESCE(p_tags, '{}'::text[]))
+    ON CONFLICT (name) DO NOTHING;
+
+    DELETE FROM tag_item ti
+    USING tag t
+    WHERE ti.tag_id = t.tag_id
+      AND ti.base_item_id = r_base_item_id
+      AND NOT (t.name = ANY(COALESCE(p_tags, '{}'::text[])::citext[]));
+
+    INSERT INTO tag_item (tag_id, base_item_id)
+    SELECT t.tag_id, r_base_item_id
+    FROM tag t
+    WHERE t.name = ANY(COALESCE(p_tags, '{}'::text[])::citext[])
+    ON CONFLICT DO NOTHING;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Returns the existing item for this size, creating it the first time
+CREATE FUNCTION upsert_clothing_item (
+    p_base_item_id INTEGER,
+    p_basic_size CITEXT
+) RETURNS INT AS $$
+DECLARE
+    v_item_id INTEGER;
+BEGIN
+    SELECT i.item_id INTO v_item_id
+    FROM item i
+    JOIN item.clothing ic ON ic.item_id = i.item_id
+    WHERE i.base_item_id = p_base_item_id
+      AND ic.basic_size = p_basic_size
+    ORDER BY i.item_id
+    LIMIT 1;
+
+    IF v_item_id IS NULL THEN
+        v_item_id := add_clothing_item(p_base_item_id, p_basic_size);
+    END IF;
+
+    RETURN v_item_id;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS image_variant;
+
+DROP INDEX IF EXISTS idx_image_content_hash;
+
+ALTER TABLE image
+    DROP COLUMN IF EXISTS downloaded_at,
+    DROP COLUMN IF EXISTS byte_size,
+    DROP COLUMN IF EXISTS height,
+    DROP COLUMN IF EXISTS width,
+    DROP COLUMN IF EXISTS mime_type,
+    DROP COLUMN IF EXISTS local_path,
+    DROP COLUMN IF EXISTS content_hash;
@@ -0,0 +1,24 @@
+-- Downloaded image files are stored by the hash of their content, so many
+-- image urls can share one file and its resized variants
+ALTER TABLE image
+    ADD COLUMN content_hash TEXT,
+    ADD COLUMN local_path TEXT,
+    ADD COLUMN mime_type TEXT,
+    ADD COLUMN width INTEGER,
+    ADD COLUMN height INTEGER,
+    ADD COLUMN byte_size INTEGER,
+    ADD COLUMN downloaded_at TIMESTAMPTZ;
+
+CREATE INDEX idx_image_content_hash ON image (content_hash);
+
+CREATE TABLE image_variant (
+    content_hash TEXT NOT NULL,
+    size TEXT NOT NULL,
+    format TEXT NOT NULL CHECK (format IN ('jpeg', 'webp')),
+    local_path TEXT NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    byte_size INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (content_hash, size, format)
+);
@@ -0,0 +1,5 @@
+DROP FUNCTION IF EXISTS set_base_item_price;
+
+DROP VIEW IF EXISTS current_base_item_price;
+
+DROP TABLE IF EXISTS base_item_price;
@@ -0,0 +1,90 @@
+-- Every price an item has had.  A price change closes the current row and
+-- opens a new one, so the history is never rewritten.
+CREATE TABLE base_item_price (
+    base_item_price_id SERIAL PRIMARY KEY,
+    base_item_id INTEGER NOT NULL REFERENCES base_item (base_item_id) ON DELETE CASCADE,
+    -- ISO 4217 code
+    currency CHAR(3) NOT NULL DEFAULT 'USD' CHECK (currency ~ '^[A-Z]{3}$'),
+    list_price NUMERIC(10, 2) NOT NULL CHECK (list_price >= 0),
+    -- only set while the item is discounted
+    sale_price NUMERIC(10, 2) CHECK (
+        sale_price >= 0
+        AND sale_price < list_price
+    ),
+    -- what the source paid, never shown to customers
+    cost NUMERIC(10, 2) CHECK (cost >= 0),
+    effective_from TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    effective_to TIMESTAMPTZ CHECK (effective_to >= effective_from)
+);
+
+CREATE INDEX idx_base_item_price_item ON base_item_price (base_item_id, effective_from DESC);
+
+CREATE VIEW current_base_item_price AS
+SELECT DISTINCT ON (base_item_id)
+    base_item_id,
+    currency,
+    list_price,
+    sale_price,
+    COALESCE(sale_price, list_price) AS price,
+    effective_from
+FROM
+    base_item_price
+WHERE
+    effective_from <= NOW()
+    AND (effective_to IS NULL OR effective_to > NOW())
+ORDER BY
+    base_item_id,
+    effective_from DESC;
+
+-- Records the price if it differs from the current one.  Returns true when a
+-- new price was recorded.
+CREATE FUNCTION set_base_item_price (
+    p_base_item_id INTEGER,
+    p_currency TEXT,
+    p_list_price NUMERIC,
+    p_sale_price NUMERIC DEFAULT NULL,
+    p_cost NUMERIC DEFAULT NULL
+) RETURNS BOOLEAN AS $$
+DECLARE
+    v_current base_item_price;
+BEGIN
+    IF p_list_price IS NULL THEN
+        RAISE EXCEPTION 'A list price is required to price base item %', p_base_item_id;
+    END IF;
+
+    p_currency := UPPER(COALESCE(NULLIF(p_currency, ''), 'USD'));
+    p_list_price := ROUND(p_list_price, 2);
+    p_sale_price := ROUND(p_sale_price, 2);
+    p_cost := ROUND(p_cost, 2);
+
+    -- sources report "no sale" in different ways
+    IF p_sale_price <= 0 OR p_sale_price >= p_list_price THEN
+        p_sale_price := NULL;
+    END IF;
+
+    SELECT * INTO v_current
+    FROM base_item_price
+    WHERE base_item_id = p_base_item_id
+      AND effective_to IS NULL
+    ORDER BY effective_from DESC
+    LIMIT 1;
+
+    IF FOUND
+       AND v_current.currency = p_currency
+       AND v_current.list_price = p_list_price
+       AND v_current.sale_price IS NOT DISTINCT FROM p_sale_price
+       AND v_current.cost IS NOT DISTINCT FROM p_cost
+    THEN
+        RETURN FALSE;
+    END IF;
+
+    UPDATE base_item_price SET effective_to = NOW()
+    WHERE base_item_id = p_base_item_id
+      AND effective_to IS NULL;
+
+    INSERT INTO base_item_price (base_item_id, currency, list_price, sale_price, cost)
+    VALUES (p_base_item_id, p_currency, p_list_price, p_sale_price, p_cost);
+
+    RETURN TRUE;
+END;
+$$ LANGUAGE plpgsql;
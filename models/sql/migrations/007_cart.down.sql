@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS cart_item;
+
+DROP TABLE IF EXISTS cart;
@@ -0,0 +1,18 @@
+-- Anonymous carts are only known by their token, which lives in a cookie.
+-- Signing in merges the anonymous cart into the user's own cart.
+CREATE TABLE cart (
+    cart_id SERIAL PRIMARY KEY,
+    cart_token TEXT UNIQUE NOT NULL DEFAULT gen_random_uuid()::TEXT,
+    site_user_id INTEGER UNIQUE REFERENCES site_user (site_user_id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- One line per size of an item
+CREATE TABLE cart_item (
+    cart_id INTEGER REFERENCES cart (cart_id) ON DELETE CASCADE,
+    item_id INTEGER REFERENCES item.clothing (item_id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    added_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (cart_id, item_id)
+);
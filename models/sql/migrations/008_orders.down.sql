@@ -0,0 +1,18 @@
+ALTER TABLE inventory_transaction
+    DROP COLUMN IF EXISTS customer_order_id;
+
+DROP TABLE IF EXISTS customer_order_status_history;
+
+DROP TABLE IF EXISTS customer_order_line;
+
+DROP TABLE IF EXISTS customer_order;
+
+DROP TABLE IF EXISTS order_status_transition;
+
+DROP TABLE IF EXISTS order_status;
+
+DELETE FROM inventory_transaction
+WHERE transaction_event IN ('reserve', 'release');
+
+DELETE FROM transaction_event
+WHERE transaction_event IN ('reserve', 'release');
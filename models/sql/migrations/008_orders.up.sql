@@ -0,0 +1,76 @@
+-- Stock held for an order between checkout and fulfillment.  Reserving
+-- removes it from the inventory like ship-out does, releasing puts it back.
+INSERT INTO
+    transaction_event (transaction_event)
+VALUES
+    ('reserve'),
+    ('release');
+
+CREATE TABLE order_status (order_status TEXT PRIMARY KEY);
+
+INSERT INTO
+    order_status (order_status)
+VALUES
+    -- stock is reserved, waiting on payment
+    ('pending'),
+    ('paid'),
+    -- shipped, reserved stock became ship-out
+    ('fulfilled'),
+    -- reserved stock was released
+    ('cancelled');
+
+CREATE TABLE order_status_transition (
+    from_status TEXT REFERENCES order_status (order_status),
+    to_status TEXT REFERENCES order_status (order_status),
+    PRIMARY KEY (from_status, to_status)
+);
+
+INSERT INTO
+    order_status_transition (from_status, to_status)
+VALUES
+    ('pending', 'paid'),
+    ('pending', 'cancelled'),
+    ('paid', 'fulfilled'),
+    ('paid', 'cancelled');
+
+CREATE TABLE customer_order (
+    customer_order_id SERIAL PRIMARY KEY,
+    -- what customers see, CO000042
+    order_number TEXT UNIQUE NOT NULL GENERATED ALWAYS AS (
+        'CO' || LPAD(customer_order_id::TEXT, GREATEST(6, LENGTH(customer_order_id::TEXT)), '0')
+    ) STORED,
+    site_user_id INTEGER NOT NULL REFERENCES site_user (site_user_id) ON DELETE RESTRICT,
+    status TEXT NOT NULL DEFAULT 'pending' REFERENCES order_status (order_status),
+    currency CHAR(3) NOT NULL,
+    subtotal NUMERIC(10, 2) NOT NULL DEFAULT 0 CHECK (subtotal >= 0),
+    total NUMERIC(10, 2) NOT NULL DEFAULT 0 CHECK (total >= 0),
+    ship_to_name TEXT NOT NULL,
+    ship_to_address TEXT NOT NULL,
+    payment_provider TEXT NOT NULL,
+    payment_reference TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_customer_order_site_user ON customer_order (site_user_id, created_at DESC);
+
+-- Prices are copied from the catalog so later price changes leave the
+-- order alone
+CREATE TABLE customer_order_line (
+    customer_order_id INTEGER REFERENCES customer_order (customer_order_id) ON DELETE CASCADE,
+    item_id INTEGER REFERENCES item (item_id) ON DELETE RESTRICT,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    unit_price NUMERIC(10, 2) NOT NULL CHECK (unit_price >= 0),
+    PRIMARY KEY (customer_order_id, item_id)
+);
+
+CREATE TABLE customer_order_status_history (
+    customer_order_status_history_id SERIAL PRIMARY KEY,
+    customer_order_id INTEGER NOT NULL REFERENCES customer_order (customer_order_id) ON DELETE CASCADE,
+    status TEXT NOT NULL REFERENCES order_status (order_status),
+    note TEXT,
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE inventory_transaction
+    ADD COLUMN customer_order_id INTEGER REFERENCES customer_order (customer_order_id) ON DELETE RESTRICT;
@@ -0,0 +1,8 @@
+ALTER TABLE inventory_transaction
+    DROP COLUMN IF EXISTS rental_id;
+
+DROP TABLE IF EXISTS rental;
+
+DROP TABLE IF EXISTS rental_subscription;
+
+DROP TABLE IF EXISTS rental_plan;
@@ -0,0 +1,69 @@
+CREATE TABLE rental_plan (
+    rental_plan_id SERIAL PRIMARY KEY,
+    name CITEXT UNIQUE NOT NULL,
+    -- how many items a member can have out at once
+    items_at_a_time INTEGER NOT NULL CHECK (items_at_a_time > 0),
+    -- rentals allowed each month on top of the first items_at_a_time, null
+    -- for unlimited
+    swaps_per_month INTEGER CHECK (swaps_per_month >= 0),
+    -- days until a rented item is due back
+    rental_days INTEGER NOT NULL CHECK (rental_days > 0),
+    currency CHAR(3) NOT NULL DEFAULT 'USD' CHECK (currency ~ '^[A-Z]{3}$'),
+    monthly_price NUMERIC(10, 2) NOT NULL CHECK (monthly_price >= 0),
+    is_active BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+INSERT INTO
+    rental_plan (name, items_at_a_time, swaps_per_month, rental_days, monthly_price)
+VALUES
+    ('Essential', 4, 1, 30, 79.00),
+    ('Plus', 6, 3, 30, 119.00),
+    ('Unlimited', 8, NULL, 30, 159.00);
+
+CREATE TABLE rental_subscription (
+    rental_subscription_id SERIAL PRIMARY KEY,
+    site_user_id INTEGER NOT NULL REFERENCES site_user (site_user_id) ON DELETE CASCADE,
+    rental_plan_id INTEGER NOT NULL REFERENCES rental_plan (rental_plan_id) ON DELETE RESTRICT,
+    status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'cancelled')),
+    -- swap allowances reset every month on this day
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    cancelled_at TIMESTAMPTZ,
+    CHECK ((status = 'cancelled') = (cancelled_at IS NOT NULL))
+);
+
+-- at most one live subscription per user
+CREATE UNIQUE INDEX idx_rental_subscription_active ON rental_subscription (site_user_id) WHERE status = 'active';
+
+-- One physical item out with a member.  Renting posts a ship-out and
+-- checking the return in posts a ship-in.
+CREATE TABLE rental (
+    rental_id SERIAL PRIMARY KEY,
+    site_user_id INTEGER NOT NULL REFERENCES site_user (site_user_id) ON DELETE RESTRICT,
+    rental_subscription_id INTEGER NOT NULL REFERENCES rental_subscription (rental_subscription_id) ON DELETE RESTRICT,
+    item_id INTEGER NOT NULL REFERENCES item (item_id) ON DELETE RESTRICT,
+    -- the closet it was rented from, if any
+    closet_id INTEGER REFERENCES closet (closet_id) ON DELETE SET NULL,
+    status TEXT NOT NULL DEFAULT 'out' CHECK (
+        status IN (
+            -- with the member
+            'out',
+            -- the member has sent it back, it no longer counts against their plan
+            'returning',
+            -- checked back in to inventory
+            'returned',
+            'lost'
+        )
+    ),
+    rented_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    due_at TIMESTAMPTZ NOT NULL,
+    return_started_at TIMESTAMPTZ,
+    returned_at TIMESTAMPTZ,
+    condition_note TEXT
+);
+
+CREATE INDEX idx_rental_site_user ON rental (site_user_id, rented_at DESC);
+
+CREATE INDEX idx_rental_open ON rental (due_at) WHERE status IN ('out', 'returning');
+
+ALTER TABLE inventory_transaction
+    ADD COLUMN rental_id INTEGER REFERENCES rental (rental_id) ON DELETE RESTRICT;
@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS inventory_transaction_notify ON inventory_transaction;
+
+DROP FUNCTION IF EXISTS notify_inventory_changed ();
+
+DROP TABLE IF EXISTS stock_alert;
+
+ALTER TABLE item
+    DROP COLUMN IF EXISTS reorder_threshold;
@@ -0,0 +1,33 @@
+-- Stock at or below this raises a low stock alert, stock of zero or less is
+-- always out of stock
+ALTER TABLE item
+    ADD COLUMN reorder_threshold INTEGER NOT NULL DEFAULT 2 CHECK (reorder_threshold >= 0);
+
+CREATE TABLE stock_alert (
+    stock_alert_id SERIAL PRIMARY KEY,
+    item_id INTEGER NOT NULL REFERENCES item (item_id) ON DELETE CASCADE,
+    level TEXT NOT NULL CHECK (level IN ('low', 'out')),
+    -- as they were when the alert was raised
+    stock_quantity INTEGER NOT NULL,
+    reorder_threshold INTEGER NOT NULL,
+    raised_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    -- null until every notification sink has been told
+    notified_at TIMESTAMPTZ,
+    -- set once stock is back above the threshold or the level changes
+    resolved_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX stock_alert_open_idx ON stock_alert (item_id) WHERE resolved_at IS NULL;
+
+-- Wakes the alert job after stock changes.  Notifications with the same
+-- payload are merged, so a bulk import only wakes it once.
+CREATE FUNCTION notify_inventory_changed () RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('inventory_changed', '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER inventory_transaction_notify
+AFTER INSERT ON inventory_transaction
+FOR EACH STATEMENT EXECUTE FUNCTION notify_inventory_changed();
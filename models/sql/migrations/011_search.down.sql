@@ -0,0 +1,19 @@
+DROP TRIGGER IF EXISTS tag_search ON tag;
+
+DROP TRIGGER IF EXISTS brand_search ON brand;
+
+DROP TRIGGER IF EXISTS tag_item_search ON tag_item;
+
+DROP TRIGGER IF EXISTS base_item_search ON base_item;
+
+DROP FUNCTION IF EXISTS base_item_search_trigger ();
+
+DROP FUNCTION IF EXISTS base_item_search_refresh (INTEGER);
+
+ALTER TABLE base_item
+    DROP COLUMN IF EXISTS search_text,
+    DROP COLUMN IF EXISTS search_document;
+
+DROP FUNCTION IF EXISTS immutable_unaccent (TEXT);
+
+DROP EXTENSION IF EXISTS pg_trgm;
@@ -0,0 +1,83 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- unaccent is only STABLE because its dictionary could change, which keeps
+-- it out of indexes.  Naming the dictionary makes it safe to treat as
+-- immutable.
+CREATE FUNCTION immutable_unaccent (p_text TEXT) RETURNS TEXT LANGUAGE sql IMMUTABLE PARALLEL SAFE STRICT AS $$
+SELECT public.unaccent('public.unaccent'::regdictionary, p_text);
+$$;
+
+ALTER TABLE base_item
+    -- name, brand, tags then description, weighted in that order
+    ADD COLUMN search_document TSVECTOR,
+    -- name, brand and tags for typo tolerant trigram matching
+    ADD COLUMN search_text TEXT;
+
+CREATE INDEX idx_base_item_search_document ON base_item USING GIN (search_document);
+
+CREATE INDEX idx_base_item_search_text ON base_item USING GIN (search_text gin_trgm_ops);
+
+-- Rebuilds the search columns of a base item from it, its brand and its tags
+CREATE FUNCTION base_item_search_refresh (p_base_item_id INTEGER) RETURNS VOID LANGUAGE sql AS $$
+UPDATE base_item bi
+SET
+    search_document =
+        setweight(to_tsvector('english', immutable_unaccent(bi.name)), 'A')
+        || setweight(to_tsvector('english', immutable_unaccent(COALESCE(b.name, ''))), 'B')
+        || setweight(to_tsvector('english', immutable_unaccent(COALESCE(t.tags, ''))), 'C')
+        || setweight(to_tsvector('english', immutable_unaccent(COALESCE(bi.description, ''))), 'D'),
+    search_text = immutable_unaccent(concat_ws(' ', bi.name, b.name, t.tags))
+FROM base_item src
+LEFT JOIN brand b ON b.brand_id = src.brand_id
+LEFT JOIN LATERAL (
+    SELECT string_agg(tag.name, ' ' ORDER BY tag.name) AS tags
+    FROM tag_item ti
+    JOIN tag ON tag.tag_id = ti.tag_id
+    WHERE ti.base_item_id = src.base_item_id
+) t ON TRUE
+WHERE src.base_item_id = p_base_item_id
+  AND bi.base_item_id = src.base_item_id;
+$$;
+
+CREATE FUNCTION base_item_search_trigger () RETURNS TRIGGER AS $$
+BEGIN
+    CASE TG_TABLE_NAME
+        WHEN 'base_item' THEN
+            PERFORM base_item_search_refresh(NEW.base_item_id);
+        WHEN 'tag_item' THEN
+            IF TG_OP = 'DELETE' THEN
+                PERFORM base_item_search_refresh(OLD.base_item_id);
+            ELSE
+                PERFORM base_item_search_refresh(NEW.base_item_id);
+            END IF;
+        WHEN 'brand' THEN
+            PERFORM base_item_search_refresh(base_item_id)
+            FROM base_item
+            WHERE brand_id = NEW.brand_id;
+        WHEN 'tag' THEN
+            PERFORM base_item_search_refresh(base_item_id)
+            FROM tag_item
+            WHERE tag_id = NEW.tag_id;
+    END CASE;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Updates of the search columns themselves do not fire this
+CREATE TRIGGER base_item_search
+AFTER INSERT OR UPDATE OF name, description, brand_id ON base_item
+FOR EACH ROW EXECUTE FUNCTION base_item_search_trigger();
+
+CREATE TRIGGER tag_item_search
+AFTER INSERT OR DELETE ON tag_item
+FOR EACH ROW EXECUTE FUNCTION base_item_search_trigger();
+
+CREATE TRIGGER brand_search
+AFTER UPDATE OF name ON brand
+FOR EACH ROW EXECUTE FUNCTION base_item_search_trigger();
+
+CREATE TRIGGER tag_search
+AFTER UPDATE OF name ON tag
+FOR EACH ROW EXECUTE FUNCTION base_item_search_trigger();
+
+SELECT base_item_search_refresh(base_item_id) FROM base_item;
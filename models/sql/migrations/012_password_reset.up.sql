@@ -0,0 +1,13 @@
+-- Emailed links for choosing a new password.  Only a sha256 of the token is
+-- kept, the token itself is only ever in the email.
+CREATE TABLE password_reset (
+    password_reset_id SERIAL PRIMARY KEY,
+    site_user_id INTEGER NOT NULL REFERENCES site_user (site_user_id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    -- set when the token is used, or when a newer one replaces it
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX password_reset_site_user_idx ON password_reset (site_user_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS email_verification_sent;
+
+ALTER TABLE site_user
+    DROP COLUMN IF EXISTS email_verified_at;
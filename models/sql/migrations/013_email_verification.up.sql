@@ -0,0 +1,16 @@
+-- Null until the user follows the link in their verification email
+ALTER TABLE site_user
+    ADD COLUMN email_verified_at TIMESTAMPTZ;
+
+-- Accounts from before verification existed are trusted as they are
+UPDATE site_user SET email_verified_at = created_at;
+
+-- Each verification email sent, to rate limit resending
+CREATE TABLE email_verification_sent (
+    email_verification_sent_id SERIAL PRIMARY KEY,
+    site_user_id INTEGER NOT NULL REFERENCES site_user (site_user_id) ON DELETE CASCADE,
+    email CITEXT NOT NULL,
+    sent_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX email_verification_sent_site_user_idx ON email_verification_sent (site_user_id, sent_at);
@@ -0,0 +1,16 @@
+DROP INDEX IF EXISTS session_site_user_idx;
+
+-- only the most recent session of each user can be kept
+DELETE FROM session s
+WHERE EXISTS (
+    SELECT 1 FROM session newer
+    WHERE newer.site_user_id = s.site_user_id
+      AND (newer.created_at, newer.session_id) > (s.created_at, s.session_id)
+);
+
+ALTER TABLE session
+    DROP COLUMN IF EXISTS remember,
+    DROP COLUMN IF EXISTS last_seen_at,
+    DROP COLUMN IF EXISTS ip_address,
+    DROP COLUMN IF EXISTS user_agent,
+    ADD CONSTRAINT session_site_user_id_key UNIQUE (site_user_id);
@@ -0,0 +1,11 @@
+-- A user can be signed in on several devices at once, each with its own
+-- session
+ALTER TABLE session
+    DROP CONSTRAINT session_site_user_id_key,
+    ADD COLUMN user_agent TEXT,
+    ADD COLUMN ip_address INET,
+    ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    -- remembered sessions last 30 days from last use instead of 1
+    ADD COLUMN remember BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX session_site_user_idx ON session (site_user_id);
@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS auth_event;
+
+DROP TABLE IF EXISTS rate_limit_bucket;
+
+ALTER TABLE site_user
+    DROP COLUMN IF EXISTS locked_until,
+    DROP COLUMN IF EXISTS failed_sign_ins;
@@ -0,0 +1,30 @@
+-- Consecutive wrong passwords since the last good sign in.  Past a few of
+-- them the account is locked for longer and longer.
+ALTER TABLE site_user
+    ADD COLUMN failed_sign_ins INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN locked_until TIMESTAMPTZ;
+
+-- Token buckets for rate limiting, shared by every instance of the server
+-- when the postgres store is used
+CREATE TABLE rate_limit_bucket (
+    bucket_key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Sign ins, sign ups, lockouts and the like, for staff to look back over.
+-- email is what was typed, so it is kept even when no account matched.
+CREATE TABLE auth_event (
+    auth_event_id BIGSERIAL PRIMARY KEY,
+    event TEXT NOT NULL,
+    site_user_id INTEGER REFERENCES site_user (site_user_id) ON DELETE SET NULL,
+    email CITEXT,
+    ip_address INET,
+    user_agent TEXT,
+    detail TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX auth_event_created_at_idx ON auth_event (created_at);
+CREATE INDEX auth_event_site_user_idx ON auth_event (site_user_id, created_at);
+CREATE INDEX auth_event_ip_address_idx ON auth_event (ip_address, created_at);
@@ -0,0 +1,4 @@
+DELETE FROM scrape_run WHERE offline;
+
+ALTER TABLE scrape_run
+    DROP COLUMN IF EXISTS offline;
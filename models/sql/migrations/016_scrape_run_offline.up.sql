@@ -0,0 +1,3 @@
+-- Offline runs replay the cache, so an online run must never resume one
+ALTER TABLE scrape_run
+    ADD COLUMN offline BOOLEAN NOT NULL DEFAULT FALSE;
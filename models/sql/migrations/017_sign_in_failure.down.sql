@@ -0,0 +1,5 @@
+ALTER TABLE site_user
+    ADD COLUMN failed_sign_ins INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN locked_until TIMESTAMPTZ;
+
+DROP TABLE IF EXISTS sign_in_failure;
@@ -0,0 +1,16 @@
+-- Wrong passwords for an account from one address since the last good sign
+-- in from there.  Counted per address, so someone guessing locks out only
+-- themselves and not the owner signing in from elsewhere.
+CREATE TABLE sign_in_failure (
+    site_user_id INTEGER NOT NULL REFERENCES site_user (site_user_id) ON DELETE CASCADE,
+    -- as the server saw it, blank when it could not tell
+    ip_address TEXT NOT NULL,
+    failed_sign_ins INTEGER NOT NULL DEFAULT 0,
+    locked_until TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (site_user_id, ip_address)
+);
+
+ALTER TABLE site_user
+    DROP COLUMN failed_sign_ins,
+    DROP COLUMN locked_until;
@@ -0,0 +1,73 @@
+package payments
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Token that makes the fake provider decline a charge
+const FakeDeclineToken = "decline"
+
+/*
+Takes payments in memory so checkout can be exercised locally.  Every charge
+succeeds unless its token is FakeDeclineToken, and refunds succeed for any
+reference it handed out.
+*/
+type FakeProvider struct {
+	mu       sync.Mutex
+	charges  map[string]Charge
+	refunded map[string]bool
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		charges:  map[string]Charge{},
+		refunded: map[string]bool{},
+	}
+}
+
+func (*FakeProvider) Name() string {
+	return "fake"
+}
+
+func (f *FakeProvider) Charge(ctx context.Context, charge Charge) (string, error) {
+	if strings.EqualFold(strings.TrimSpace(charge.Token), FakeDeclineToken) {
+		return "", ErrDeclined
+	}
+	if charge.Amount < 0 {
+		return "", fmt.Errorf("cannot charge a negative amount: %.2f", charge.Amount)
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	reference := "fake_" + hex.EncodeToString(b)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.charges[reference] = charge
+	return reference, nil
+}
+
+func (f *FakeProvider) Refund(ctx context.Context, reference string, amount float64, currency string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	charge, ok := f.charges[reference]
+	if !ok {
+		return fmt.Errorf("no fake charge %s", reference)
+	}
+	if f.refunded[reference] {
+		return fmt.Errorf("fake charge %s was already refunded", reference)
+	}
+	if amount > charge.Amount || currency != charge.Currency {
+		return fmt.Errorf("cannot refund %.2f %s of a %.2f %s charge", amount, currency, charge.Amount, charge.Currency)
+	}
+	f.refunded[reference] = true
+	return nil
+}
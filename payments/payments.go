@@ -0,0 +1,68 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Returned when the provider refused the payment, as opposed to failing to
+// reach it
+var ErrDeclined = errors.New("payment was declined")
+
+type Charge struct {
+	OrderNumber string
+	Amount      float64
+	Currency    string
+	// Whatever the checkout form collected for the provider, usually a
+	// token from its client side library
+	Token string
+}
+
+// Something that can take money for an order and give it back
+type Provider interface {
+	Name() string
+	// Returns the provider's reference for the payment
+	Charge(ctx context.Context, charge Charge) (string, error)
+	Refund(ctx context.Context, reference string, amount float64, currency string) error
+}
+
+var providers = map[string]Provider{}
+
+func Register(p Provider) {
+	providers[p.Name()] = p
+}
+
+func ProviderNames() []string {
+	names := []string{}
+	for name := range providers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func init() {
+	Register(NewFakeProvider())
+}
+
+var active Provider
+
+// Picks the provider used for every checkout, called once at startup
+func Use(name string) error {
+	p, ok := providers[name]
+	if !ok {
+		return fmt.Errorf("unknown payment provider %q, expected one of %v", name, ProviderNames())
+	}
+	active = p
+	return nil
+}
+
+// The provider chosen with Use, or the fake one when none was
+func Active() Provider {
+	if active == nil {
+		return providers["fake"]
+	}
+	return active
+}
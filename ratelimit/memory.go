@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Buckets in this process only, each instance of the server counts on its own
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+func (m *Memory) Take(ctx context.Context, key string, limit Limit) (time.Duration, error) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		m.buckets[key] = b
+	}
+
+	tokens := refill(b.tokens, b.updated, now, limit)
+	if tokens < 1 {
+		return time.Duration((1 - tokens) * float64(limit.Every)), nil
+	}
+	b.tokens = tokens - 1
+	b.updated = now
+	return 0, nil
+}
+
+// Drops idle buckets, at most once a minute so busy keys are not walked on
+// every request
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if now.Sub(b.updated) > idleBucket {
+			delete(m.buckets, key)
+		}
+	}
+}
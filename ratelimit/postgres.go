@@ -0,0 +1,19 @@
+package ratelimit
+
+import (
+	"clothes/models"
+	"context"
+	"time"
+)
+
+// Buckets in the rate_limit_bucket table, shared by every instance of the
+// server using the same database
+type Postgres struct{}
+
+func (Postgres) Take(ctx context.Context, key string, limit Limit) (time.Duration, error) {
+	wait, err := models.ApiQuery[float64](ctx, "rate_limit_take", key, limit.Burst, limit.Every.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(*wait * float64(time.Second)), nil
+}
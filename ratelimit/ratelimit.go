@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Burst requests straight away, then one more every Every
+type Limit struct {
+	Burst int
+	Every time.Duration
+}
+
+/*
+Where the token buckets are kept.  Each key has a bucket holding up to a
+limit's burst of tokens, refilled one at a time at a steady rate, and every
+request takes one.  Memory suits a single server, Postgres lets several
+instances share the buckets.
+*/
+type Store interface {
+	// Takes a token from the bucket for key.  Returns how long to wait before
+	// trying again when the bucket is empty, zero when a token was taken.
+	Take(ctx context.Context, key string, limit Limit) (time.Duration, error)
+}
+
+// Buckets untouched for this long are full again for any limit worth
+// having, and are dropped
+const idleBucket = 24 * time.Hour
+
+var store Store = NewMemory()
+
+// Picks where buckets are kept, memory or postgres, called once at startup
+func Use(name string) error {
+	switch name {
+	case "", "memory":
+		store = NewMemory()
+	case "postgres":
+		store = Postgres{}
+	default:
+		return fmt.Errorf("unknown rate limit store %q, expected memory or postgres", name)
+	}
+	return nil
+}
+
+// Takes a token for key from the store chosen with Use
+func Take(ctx context.Context, key string, limit Limit) (time.Duration, error) {
+	return store.Take(ctx, key, limit)
+}
+
+// How full a bucket that had tokens at updated is at now, no fuller than
+// the burst
+func refill(tokens float64, updated, now time.Time, limit Limit) float64 {
+	if elapsed := now.Sub(updated); elapsed > 0 {
+		tokens += float64(elapsed) / float64(limit.Every)
+	}
+	return min(tokens, float64(limit.Burst))
+}
@@ -0,0 +1,119 @@
+package scraper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+type FashionPassResponse struct {
+	Success     bool `json:"success"`
+	ProductList struct {
+		Pages            int               `json:"pages"`
+		CurrentPage      int               `json:"current_page"`
+		PageItemsTotal   int               `json:"page_items_total"`
+		SearchItemsTotal int               `json:"search_items_total"`
+		VendorList       map[string]string `json:"vendor_list"`
+		TagList          []struct {
+			TagId       int    `json:"tag_id"`
+			TagName     string `json:"tag_name"`
+			WebsiteText string `json:"website_text"`
+		} `json:"tag_list"`
+		ResultItems []struct {
+			ID                  int     `json:"id"`
+			Title               string  `json:"title"`
+			Handle              string  `json:"handle"`
+			AverageReviewRating float64 `json:"averageReviewRating"`
+			// They misspelled "product_cost" in their API
+			PrductCost        float64         `json:"prduct_cost"`
+			Retail            float64         `json:"retail"`
+			Discount          float64         `json:"discount"`
+			SaleStockDiscount float64         `json:"sale_stock_discount"`
+			SalePrice         float64         `json:"sale_price"`
+			NewItemDiscount   float64         `json:"newitem_discount"`
+			UseItemDiscount   float64         `json:"useitem_discount"`
+			Vendor            string          `json:"vendor"`
+			VendorHandle      string          `json:"vendor_handle"`
+			ThumbnailImage    string          `json:"thumbnail_image"`
+			Images            []string        `json:"images"`
+			Sizes             map[string]uint `json:"sizes"`
+			// IDs to their tags
+			Tags []int `json:"tags"`
+		} `json:"result_items"`
+	} `json:"product_list"`
+}
+
+type fashionPassSource struct{}
+
+func (fashionPassSource) Name() string {
+	return "fashionpass"
+}
+
+func (fashionPassSource) PageURL(page int) string {
+	u := url.URL{}
+	u.Host = "collections.fashionpass.com"
+	u.Scheme = "https"
+	u.Path = "/api/v1/collections/SearchByHandle2/clothing"
+	q := u.Query()
+	q.Set("items_per_page", "48")
+	q.Set("sort_by", "pos")
+	q.Set("sort_order", "desc")
+	q.Set("page", strconv.Itoa(page))
+	u.RawQuery = q.Encode()
+
+	// http.Get("https://collections.fashionpass.com/api/v1/collections/SearchByHandle2/clothing?items_per_page=48&sort_by=pos&sort_order=desc&page=33&show_hidden_items=3&exclude_tags=bump-photo&flex_size=&default_size=&sort_by_size=false&in_stock=0&in_stock_sizes=0&isprice_for_customer=false&isSub=false&new_inStockFlag=true&auto_hide=true&is_customer_subscribed=false")
+	return u.String()
+}
+
+func fashionPassImageURL(name string) string {
+	return fmt.Sprintf("https://images.fashionpass.com/products/%s?profile=a", name)
+}
+
+func (fashionPassSource) Parse(pageURL *url.URL, body []byte) (*Page, error) {
+	j := FashionPassResponse{}
+	if err := json.Unmarshal(body, &j); err != nil {
+		return nil, err
+	}
+
+	page := &Page{TotalPages: j.ProductList.Pages}
+
+	fashionPassTagIds := map[int]string{}
+	for _, t := range j.ProductList.TagList {
+		page.Tags = append(page.Tags, t.WebsiteText)
+		fashionPassTagIds[t.TagId] = t.WebsiteText
+	}
+
+	for _, v := range j.ProductList.VendorList {
+		page.Brands = append(page.Brands, v)
+	}
+
+	for _, item := range j.ProductList.ResultItems {
+		p := Product{
+			SourceID: strconv.Itoa(item.ID),
+			Name:     item.Title,
+			Brand:    item.Vendor,
+			Rating:   item.AverageReviewRating,
+			Sizes:    item.Sizes,
+			// FashionPass only sells in the US
+			Currency:  "USD",
+			ListPrice: item.Retail,
+			SalePrice: item.SalePrice,
+			Cost:      item.PrductCost,
+		}
+		if item.ThumbnailImage != "" {
+			p.ThumbnailURL = fashionPassImageURL(item.ThumbnailImage)
+		}
+		for _, img := range item.Images {
+			p.ImageURLs = append(p.ImageURLs, fashionPassImageURL(img))
+		}
+		for _, tagID := range item.Tags {
+			if tagName, ok := fashionPassTagIds[tagID]; ok {
+				p.Tags = append(p.Tags, tagName)
+			}
+		}
+		page.Products = append(page.Products, p)
+	}
+
+	return page, nil
+}
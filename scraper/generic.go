@@ -0,0 +1,396 @@
+package scraper
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+/*
+A source described entirely by a JSON config file, so new retailers can be
+added without writing Go.  Each *.json file in the sources directory
+registers one source, for example:
+
+	{
+	  "name": "example",
+	  "format": "html",
+	  "page_url": "https://shop.example.com/clothing?page={page}",
+	  "total_pages": ".pagination li:last-child a",
+	  "products": ".product-tile",
+	  "brand": "Example",
+	  "fields": {
+	    "id": "@data-product-id",
+	    "name": ".product-name",
+	    "rating": ".stars@data-rating",
+	    "thumbnail": "img.primary@src",
+	    "images": ".gallery img@src",
+	    "tags": ".badge",
+	    "sizes": ".size:not(.sold-out)",
+	    "list_price": ".price-was",
+	    "sale_price": ".price-now"
+	  }
+	}
+
+For "html" sources selectors are CSS, optionally followed by @attribute to
+read an attribute instead of the text.  A selector that starts with @ reads
+from the product element itself.
+
+For "json" sources selectors are dot separated paths like
+"product_list.result_items".  Paths that pass through an array collect the
+value from every element.  A "sizes" path may point at an object of size to
+stock quantity, otherwise every listed size is treated as a single unit.
+
+Prices may include a currency symbol and thousands separators, which are
+ignored.  They are assumed to be in "currency", or USD when it is not set.
+*/
+type GenericConfig struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+	// Listing page URL with {page} in place of the page number
+	PageURL    string `json:"page_url"`
+	TotalPages string `json:"total_pages"`
+	Products   string `json:"products"`
+	// Used when a product has no brand of its own
+	Brand    string `json:"brand"`
+	Currency string `json:"currency"`
+	// Image values are substituted for {value} when set, otherwise they
+	// are resolved relative to the page
+	ImageURL string `json:"image_url"`
+	Fields   struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Brand       string `json:"brand"`
+		Rating      string `json:"rating"`
+		Thumbnail   string `json:"thumbnail"`
+		Images      string `json:"images"`
+		Tags        string `json:"tags"`
+		Sizes       string `json:"sizes"`
+		ListPrice   string `json:"list_price"`
+		SalePrice   string `json:"sale_price"`
+	} `json:"fields"`
+}
+
+type genericSource struct {
+	config GenericConfig
+}
+
+func NewGenericSource(config GenericConfig) (Source, error) {
+	if config.Name == "" {
+		return nil, errors.New("source is missing a name")
+	}
+	if config.Format != "html" && config.Format != "json" {
+		return nil, fmt.Errorf("source %q has unknown format %q, expected html or json", config.Name, config.Format)
+	}
+	if !strings.Contains(config.PageURL, "{page}") {
+		return nil, fmt.Errorf("source %q page_url must contain {page}", config.Name)
+	}
+	if config.Products == "" && config.Format == "html" {
+		return nil, fmt.Errorf("source %q is missing a products selector", config.Name)
+	}
+	if config.Fields.Name == "" {
+		return nil, fmt.Errorf("source %q is missing a name field", config.Name)
+	}
+	return &genericSource{config: config}, nil
+}
+
+// Registers a generic source for every *.json file in dir.  A missing
+// directory is not an error.
+func LoadSources(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("reading source config %s: %w", f, err)
+		}
+		var config GenericConfig
+		if err := json.Unmarshal(content, &config); err != nil {
+			return fmt.Errorf("parsing source config %s: %w", f, err)
+		}
+		s, err := NewGenericSource(config)
+		if err != nil {
+			return fmt.Errorf("source config %s: %w", f, err)
+		}
+		if _, exists := sources[s.Name()]; exists {
+			return fmt.Errorf("source config %s: source %q is already registered", f, s.Name())
+		}
+
+		slog.Info("Loaded scraper source", "name", s.Name(), "file", f)
+		Register(s)
+	}
+	return nil
+}
+
+func (s *genericSource) Name() string {
+	return s.config.Name
+}
+
+func (s *genericSource) PageURL(page int) string {
+	return strings.ReplaceAll(s.config.PageURL, "{page}", strconv.Itoa(page))
+}
+
+func (s *genericSource) Parse(pageURL *url.URL, body []byte) (*Page, error) {
+	if s.config.Format == "json" {
+		return s.parseJSON(pageURL, body)
+	}
+	return s.parseHTML(pageURL, body)
+}
+
+func (s *genericSource) imageURL(pageURL *url.URL, value string) string {
+	if s.config.ImageURL != "" {
+		return strings.ReplaceAll(s.config.ImageURL, "{value}", value)
+	}
+	ref, err := url.Parse(value)
+	if err != nil || pageURL == nil {
+		return value
+	}
+	return pageURL.ResolveReference(ref).String()
+}
+
+// Fills in the fields every format shares once the raw values are selected
+func (s *genericSource) buildProduct(pageURL *url.URL, fields map[string][]string, sizes map[string]uint) (Product, bool) {
+	first := func(name string) string {
+		if v := fields[name]; len(v) > 0 {
+			return strings.TrimSpace(v[0])
+		}
+		return ""
+	}
+
+	p := Product{
+		SourceID:    first("id"),
+		Name:        first("name"),
+		Description: first("description"),
+		Brand:       first("brand"),
+		Sizes:       sizes,
+	}
+	if p.Name == "" {
+		return p, false
+	}
+	if p.Brand == "" {
+		p.Brand = s.config.Brand
+	}
+	if p.SourceID == "" {
+		p.SourceID = p.Name
+	}
+	if rating, err := strconv.ParseFloat(first("rating"), 64); err == nil {
+		p.Rating = rating
+	}
+	p.Currency = s.config.Currency
+	p.ListPrice = parsePrice(first("list_price"))
+	p.SalePrice = parsePrice(first("sale_price"))
+	// a single listed price is the list price
+	if p.ListPrice == 0 {
+		p.ListPrice, p.SalePrice = p.SalePrice, 0
+	}
+	for _, img := range fields["images"] {
+		if img = strings.TrimSpace(img); img != "" {
+			p.ImageURLs = append(p.ImageURLs, s.imageURL(pageURL, img))
+		}
+	}
+	if thumbnail := first("thumbnail"); thumbnail != "" {
+		p.ThumbnailURL = s.imageURL(pageURL, thumbnail)
+	} else if len(p.ImageURLs) > 0 {
+		p.ThumbnailURL = p.ImageURLs[0]
+	}
+	for _, t := range fields["tags"] {
+		if t = strings.TrimSpace(t); t != "" {
+			p.Tags = append(p.Tags, t)
+		}
+	}
+	return p, true
+}
+
+func (s *genericSource) fieldSelectors() map[string]string {
+	f := s.config.Fields
+	return map[string]string{
+		"id":          f.ID,
+		"name":        f.Name,
+		"description": f.Description,
+		"brand":       f.Brand,
+		"rating":      f.Rating,
+		"thumbnail":   f.Thumbnail,
+		"images":      f.Images,
+		"tags":        f.Tags,
+		"list_price":  f.ListPrice,
+		"sale_price":  f.SalePrice,
+	}
+}
+
+// Reads a price like "$1,299.00", returning zero when there is none
+func parsePrice(s string) float64 {
+	s = strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || r == '.' {
+			return r
+		}
+		return -1
+	}, s)
+	price, err := strconv.ParseFloat(s, 64)
+	if err != nil || price < 0 {
+		return 0
+	}
+	return price
+}
+
+func selectHTML(sel *goquery.Selection, selector string) []string {
+	css, attr, hasAttr := strings.Cut(selector, "@")
+	css = strings.TrimSpace(css)
+
+	target := sel
+	if css != "" {
+		target = sel.Find(css)
+	}
+
+	values := []string{}
+	target.Each(func(_ int, el *goquery.Selection) {
+		if hasAttr {
+			if v, ok := el.Attr(attr); ok {
+				values = append(values, v)
+			}
+		} else {
+			values = append(values, strings.TrimSpace(el.Text()))
+		}
+	})
+	return values
+}
+
+func (s *genericSource) parseHTML(pageURL *url.URL, body []byte) (*Page, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{}
+	if s.config.TotalPages != "" {
+		if v := selectHTML(doc.Selection, s.config.TotalPages); len(v) > 0 {
+			page.TotalPages, _ = strconv.Atoi(strings.TrimSpace(v[0]))
+		}
+	}
+
+	doc.Find(s.config.Products).Each(func(_ int, el *goquery.Selection) {
+		fields := map[string][]string{}
+		for name, selector := range s.fieldSelectors() {
+			if selector != "" {
+				fields[name] = selectHTML(el, selector)
+			}
+		}
+
+		var sizes map[string]uint
+		if s.config.Fields.Sizes != "" {
+			sizes = map[string]uint{}
+			for _, size := range selectHTML(el, s.config.Fields.Sizes) {
+				if size != "" {
+					sizes[size] = 1
+				}
+			}
+		}
+
+		if p, ok := s.buildProduct(pageURL, fields, sizes); ok {
+			page.Products = append(page.Products, p)
+		}
+	})
+
+	return page, nil
+}
+
+// Follows a dot separated path, collecting every match when the path
+// passes through an array
+func selectJSON(v any, path string) []any {
+	if path == "" {
+		if arr, ok := v.([]any); ok {
+			return arr
+		}
+		return []any{v}
+	}
+
+	key, rest, _ := strings.Cut(path, ".")
+	switch node := v.(type) {
+	case map[string]any:
+		child, ok := node[key]
+		if !ok {
+			return nil
+		}
+		return selectJSON(child, rest)
+	case []any:
+		out := []any{}
+		for _, el := range node {
+			out = append(out, selectJSON(el, path)...)
+		}
+		return out
+	}
+	return nil
+}
+
+func jsonString(v any) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	}
+	return ""
+}
+
+func (s *genericSource) parseJSON(pageURL *url.URL, body []byte) (*Page, error) {
+	var root any
+	if err := json.Unmarshal(body, &root); err != nil {
+		return nil, err
+	}
+
+	page := &Page{}
+	if s.config.TotalPages != "" {
+		if v := selectJSON(root, s.config.TotalPages); len(v) > 0 {
+			page.TotalPages, _ = strconv.Atoi(jsonString(v[0]))
+		}
+	}
+
+	for _, item := range selectJSON(root, s.config.Products) {
+		fields := map[string][]string{}
+		for name, path := range s.fieldSelectors() {
+			if path == "" {
+				continue
+			}
+			for _, v := range selectJSON(item, path) {
+				if str := jsonString(v); str != "" {
+					fields[name] = append(fields[name], str)
+				}
+			}
+		}
+
+		var sizes map[string]uint
+		if s.config.Fields.Sizes != "" {
+			sizes = map[string]uint{}
+			for _, v := range selectJSON(item, s.config.Fields.Sizes) {
+				if counts, ok := v.(map[string]any); ok {
+					for size, count := range counts {
+						if n, ok := count.(float64); ok && n >= 0 {
+							sizes[size] = uint(n)
+						}
+					}
+				} else if size := jsonString(v); size != "" {
+					sizes[size] = 1
+				}
+			}
+		}
+
+		if p, ok := s.buildProduct(pageURL, fields, sizes); ok {
+			page.Products = append(page.Products, p)
+		}
+	}
+
+	return page, nil
+}
@@ -0,0 +1,130 @@
+package scraper
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Writes the tags, brands, products and stock levels of a page to the database
+func ingest(ctx context.Context, db *pgxpool.Pool, source string, page *Page) RunStats {
+	stats := RunStats{Seen: len(page.Products)}
+
+	_, err := db.Exec(ctx, "INSERT INTO tag (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING", page.Tags)
+	if err != nil {
+		slog.Error("Failed to insert tags", "error", err)
+	}
+
+	vendors := slices.Clone(page.Brands)
+	for _, p := range page.Products {
+		if p.Brand != "" {
+			vendors = append(vendors, p.Brand)
+		}
+	}
+	_, err = db.Exec(ctx, "INSERT INTO brand (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING", vendors)
+	if err != nil {
+		slog.Error("Failed to insert vendors", "error", err)
+	}
+
+	for _, item := range page.Products {
+		var thumbnail *string
+		if item.ThumbnailURL != "" {
+			thumbnail = &item.ThumbnailURL
+		}
+		images := item.ImageURLs
+		if images == nil {
+			images = []string{}
+		}
+		tags := item.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+
+		var baseID int64
+		var inserted bool
+		err := db.QueryRow(ctx, `
+			SELECT r_base_item_id, r_inserted FROM upsert_base_item($1, $2, $3, $4, $5, $6, $7, $8, $9);
+		`, source, item.SourceID, item.Name, item.Description, item.Brand, thumbnail, images, item.Rating, tags).Scan(&baseID, &inserted)
+		if err != nil {
+			slog.Error("Failed to upsert item", "error", err, "item", item)
+			stats.Failed++
+			continue
+		}
+		if inserted {
+			stats.Inserted++
+		} else {
+			stats.Updated++
+		}
+
+		if item.ListPrice > 0 {
+			var salePrice, cost *float64
+			if item.SalePrice > 0 {
+				salePrice = &item.SalePrice
+			}
+			if item.Cost > 0 {
+				cost = &item.Cost
+			}
+			_, err := db.Exec(ctx, `
+				SELECT set_base_item_price($1, $2, $3, $4, $5);
+			`, baseID, item.Currency, item.ListPrice, salePrice, cost)
+			if err != nil {
+				slog.Error("Failed to set price", "error", err, "item", item)
+			}
+		}
+
+		sizes := []string{}
+		for size, count := range item.Sizes {
+			sizes = append(sizes, size)
+
+			var clothingID int64
+			err := db.QueryRow(ctx, `
+			   SELECT upsert_clothing_item($1, $2);
+			`, baseID, size).Scan(&clothingID)
+			if err != nil {
+				slog.Error("Failed to upsert clothing item", "error", err, "item", item, "size", size)
+				continue
+			}
+
+			_, err = db.Exec(ctx, `
+				SELECT api.transaction('audit', $1, $2);
+			`, clothingID, count)
+			if err != nil {
+				slog.Error("Failed to insert stock audit", "error", err, "item", item, "size", size)
+			}
+		}
+
+		// sizes the source no longer lists are out of stock
+		_, err = db.Exec(ctx, `
+			SELECT api.transaction('audit', inv.item_id, 0)
+			FROM item i
+			JOIN item.clothing ic ON ic.item_id = i.item_id
+			JOIN inventory inv ON inv.item_id = i.item_id
+			WHERE i.base_item_id = $1
+			  AND NOT (ic.basic_size = ANY($2::citext[]))
+			  AND api.physical_stock(inv.item_id) <> 0
+		`, baseID, sizes)
+		if err != nil {
+			slog.Error("Failed to clear stock for removed sizes", "error", err, "item", item)
+		}
+	}
+
+	return stats
+}
+
+// Flags every item from the source that was not seen since the given time,
+// called once a run has covered every page
+func discontinueMissing(ctx context.Context, db *pgxpool.Pool, source string, seenSince time.Time) (int64, error) {
+	tag, err := db.Exec(ctx, `
+		UPDATE base_item SET discontinued_at = NOW(), updated_at = NOW()
+		WHERE source = $1
+		  AND discontinued_at IS NULL
+		  AND (last_seen_at IS NULL OR last_seen_at < $2)
+	`, source, seenSince)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
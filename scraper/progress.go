@@ -0,0 +1,124 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type RunStats struct {
+	Seen     int
+	Inserted int
+	Updated  int
+	Failed   int
+}
+
+func (s *RunStats) add(other RunStats) {
+	s.Seen += other.Seen
+	s.Inserted += other.Inserted
+	s.Updated += other.Updated
+	s.Failed += other.Failed
+}
+
+// Progress of a run as stored in the scrape_run table
+type run struct {
+	ID                int
+	StartedAt         time.Time
+	LastCompletedPage int
+	Stats             RunStats
+}
+
+/*
+Picks up the most recent unfinished run for the source, or starts a new one
+when there is none or restart is set.  Offline runs always start afresh and
+are kept apart, they neither resume nor abandon online runs and online runs
+never resume them.
+*/
+func startRun(ctx context.Context, db *pgxpool.Pool, source string, restart bool, offline bool) (*run, error) {
+	r := &run{}
+
+	if offline {
+		err := db.QueryRow(ctx, "INSERT INTO scrape_run (source, offline) VALUES ($1, TRUE) RETURNING scrape_run_id, started_at", source).Scan(&r.ID, &r.StartedAt)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	if !restart {
+		err := db.QueryRow(ctx, `
+			UPDATE scrape_run SET status = 'running', updated_at = NOW(), error = NULL
+			WHERE scrape_run_id = (
+				SELECT scrape_run_id FROM scrape_run
+				WHERE source = $1 AND NOT offline
+				ORDER BY started_at DESC
+				LIMIT 1
+			) AND status <> 'completed'
+			RETURNING scrape_run_id, started_at, last_completed_page, items_seen, items_inserted, items_updated, items_failed
+		`, source).Scan(&r.ID, &r.StartedAt, &r.LastCompletedPage, &r.Stats.Seen, &r.Stats.Inserted, &r.Stats.Updated, &r.Stats.Failed)
+		if err == nil {
+			return r, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+	} else {
+		_, err := db.Exec(ctx, `
+			UPDATE scrape_run SET status = 'failed', updated_at = NOW(), error = 'abandoned by restart'
+			WHERE source = $1 AND status <> 'completed' AND NOT offline
+		`, source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := db.QueryRow(ctx, "INSERT INTO scrape_run (source) VALUES ($1) RETURNING scrape_run_id, started_at", source).Scan(&r.ID, &r.StartedAt)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Records that a page was fully ingested
+func (r *run) completePage(ctx context.Context, db *pgxpool.Pool, page int, totalPages int, stats RunStats) error {
+	r.LastCompletedPage = page
+	r.Stats.add(stats)
+
+	var total *int
+	if totalPages > 0 {
+		total = &totalPages
+	}
+	_, err := db.Exec(ctx, `
+		UPDATE scrape_run SET
+			last_completed_page = $2,
+			total_pages = COALESCE($3, total_pages),
+			items_seen = $4,
+			items_inserted = $5,
+			items_updated = $6,
+			items_failed = $7,
+			updated_at = NOW()
+		WHERE scrape_run_id = $1
+	`, r.ID, r.LastCompletedPage, total, r.Stats.Seen, r.Stats.Inserted, r.Stats.Updated, r.Stats.Failed)
+	return err
+}
+
+// Marks the run as completed, paused or failed depending on how it stopped
+func (r *run) finish(ctx context.Context, db *pgxpool.Pool, status string, runErr error) error {
+	var errText *string
+	if runErr != nil {
+		s := runErr.Error()
+		errText = &s
+	}
+	_, err := db.Exec(ctx, `
+		UPDATE scrape_run SET
+			status = $2,
+			error = $3,
+			updated_at = NOW(),
+			finished_at = CASE WHEN $2 = 'completed' THEN NOW() ELSE NULL END
+		WHERE scrape_run_id = $1
+	`, r.ID, status, errText)
+	return err
+}
@@ -0,0 +1,17 @@
+package scraper
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Returned for any request that would have to go to the network while offline
+var ErrNotCached = errors.New("response is not in the scraper cache")
+
+// Only ever called by colly on a cache miss, so every request fails
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("%w: %s", ErrNotCached, r.URL)
+}
@@ -0,0 +1,146 @@
+package scraper
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// Same layout colly uses for its CacheDir
+func cachePath(cacheDir string, rawURL string) string {
+	sum := sha1.Sum([]byte(rawURL))
+	hash := hex.EncodeToString(sum[:])
+	return filepath.Join(cacheDir, hash[:2], hash)
+}
+
+func readCachedResponse(cacheDir string, rawURL string) (*colly.Response, error) {
+	f, err := os.Open(cachePath(cacheDir, rawURL))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotCached, rawURL)
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	resp := &colly.Response{}
+	if err := gob.NewDecoder(f).Decode(resp); err != nil {
+		return nil, fmt.Errorf("decoding cached response for %s: %w", rawURL, err)
+	}
+	return resp, nil
+}
+
+/*
+Stands in for every site a source talks to by answering from a colly cache
+directory, so the scraper can be exercised end to end without the network.
+The cache dir in Options must be different from the one being replayed,
+otherwise colly answers from it directly and the server is never called.
+*/
+type replayServer struct {
+	*httptest.Server
+	CacheDir string
+}
+
+// Carries the scheme of the original request through to the server
+const replaySchemeHeader = "X-Replay-Scheme"
+
+func newReplayServer(t *testing.T, cacheDir string) *replayServer {
+	s := &replayServer{CacheDir: cacheDir}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *replayServer) serve(w http.ResponseWriter, r *http.Request) {
+	scheme := r.Header.Get(replaySchemeHeader)
+	if scheme == "" {
+		scheme = "https"
+	}
+	originalURL := fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.RequestURI())
+
+	resp, err := readCachedResponse(s.CacheDir, originalURL)
+	if errors.Is(err, ErrNotCached) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if resp.Headers != nil {
+		for k, values := range *resp.Headers {
+			for _, v := range values {
+				w.Header().Add(k, v)
+			}
+		}
+	}
+	// the body was already decompressed before it was cached
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Body)
+}
+
+// Sends every request to the replay server while keeping the original host
+// so the server can find the matching cache entry
+func (s *replayServer) Transport() http.RoundTripper {
+	return &replayTransport{server: s}
+}
+
+type replayTransport struct {
+	server *replayServer
+}
+
+func (t *replayTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	target := r.Clone(r.Context())
+	target.Host = r.URL.Host
+	target.Header.Set(replaySchemeHeader, r.URL.Scheme)
+	target.URL.Scheme = "http"
+	target.URL.Host = t.server.Listener.Addr().String()
+	return t.server.Client().Transport.RoundTrip(target)
+}
+
+func TestReplayServer(t *testing.T) {
+	srv := newReplayServer(t, testCacheDir)
+	client := &http.Client{Transport: srv.Transport()}
+	source := fashionPassSource{}
+
+	cached, err := readCachedResponse(testCacheDir, source.PageURL(1))
+	if err != nil {
+		t.Fatalf("reading the cached first page: %v", err)
+	}
+
+	resp, err := client.Get(source.PageURL(1))
+	if err != nil {
+		t.Fatalf("getting the first page: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("reading the first page: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("first page status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if string(body) != string(cached.Body) {
+		t.Errorf("first page body is %d bytes, want the %d cached", len(body), len(cached.Body))
+	}
+
+	resp, err = client.Get(source.PageURL(2))
+	if err != nil {
+		t.Fatalf("getting an uncached page: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("uncached page status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -1,162 +1,233 @@
 package scraper
 
 import (
-	"clothes/models"
+	"clothes/images"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"net/url"
 	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/gocolly/colly/v2"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func ScrapeAll() {
-	slog.Info("Starting scraper")
-	scrapeFashionPass()
+// A product as scraped from any source, before it is written to the database
+type Product struct {
+	// Identifier of the product at the source
+	SourceID     string
+	Name         string
+	Description  string
+	Brand        string
+	Rating       float64
+	ThumbnailURL string
+	ImageURLs    []string
+	Tags         []string
+	// Size name to the quantity in stock
+	Sizes map[string]uint
+	// ISO 4217 code, defaults to USD
+	Currency string
+	// Zero when the source does not list a price
+	ListPrice float64
+	// Zero when the product is not on sale
+	SalePrice float64
+	// What the source paid for the product, when it says
+	Cost float64
 }
 
-type FashionPassResponse struct {
-	Success     bool `json:"success"`
-	ProductList struct {
-		Pages            int               `json:"pages"`
-		CurrentPage      int               `json:"current_page"`
-		PageItemsTotal   int               `json:"page_items_total"`
-		SearchItemsTotal int               `json:"search_items_total"`
-		VendorList       map[string]string `json:"vendor_list"`
-		TagList          []struct {
-			TagId       int    `json:"tag_id"`
-			TagName     string `json:"tag_name"`
-			WebsiteText string `json:"website_text"`
-		} `json:"tag_list"`
-		ResultItems []struct {
-			ID                  string  `json:"id"`
-			Title               string  `json:"title"`
-			Handle              string  `json:"handle"`
-			AverageReviewRating float64 `json:"averageReviewRating"`
-			// They misspelled "product_cost" in their API
-			PrductCost        float64         `json:"prduct_cost"`
-			Retail            float64         `json:"retail"`
-			Discount          float64         `json:"discount"`
-			SaleStockDiscount float64         `json:"sale_stock_discount"`
-			SalePrice         float64         `json:"sale_price"`
-			NewItemDiscount   float64         `json:"newitem_discount"`
-			UseItemDiscount   float64         `json:"useitem_discount"`
-			Vendor            string          `json:"vendor"`
-			VendorHandle      string          `json:"vendor_handle"`
-			ThumbnailImage    string          `json:"thumbnail_image"`
-			Images            []string        `json:"images"`
-			Sizes             map[string]uint `json:"sizes"`
-			// IDs to their tags
-			Tags []int `json:"tags"`
-		} `json:"result_items"`
-	} `json:"product_list"`
+// Everything parsed out of a single listing page
+type Page struct {
+	Products   []Product
+	Tags       []string
+	Brands     []string
+	TotalPages int
 }
 
-func scrapeFashionPass() {
+// A retailer that can be scraped.  Sources only know how to find and parse
+// listing pages, fetching and storing the results is shared.
+type Source interface {
+	Name() string
+	// URL of the listing page, starting at page 1
+	PageURL(page int) string
+	Parse(pageURL *url.URL, body []byte) (*Page, error)
+}
+
+var sources = map[string]Source{}
+
+func Register(s Source) {
+	sources[s.Name()] = s
+}
+
+func SourceNames() []string {
+	names := []string{}
+	for name := range sources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func init() {
+	Register(&fashionPassSource{})
+}
+
+type Options struct {
+	// Stop after this many pages in a single run, 0 for no limit.  The next
+	// run resumes from the following page.
+	MaxPages int
+	// Ignore any unfinished run and start again from the first page
+	Restart bool
+	// Only use responses already in the cache.  Offline runs always start
+	// from the first page and stop at the first page that is not cached,
+	// finishing as completed since there is nothing left they could resume.
+	Offline bool
+	// Defaults to .cache/<source name>
+	CacheDir string
+	// Replaces the HTTP transport, for tests that answer from a stand-in
+	// server
+	Transport http.RoundTripper
+	// Wait between requests to the same site
+	Delay time.Duration
+}
+
+// Runs the named source, or every registered source for "all"
+func Scrape(db *pgxpool.Pool, name string, opts Options) error {
+	if name == "all" {
+		for _, n := range SourceNames() {
+			if err := scrapeSource(db, sources[n], opts); err != nil {
+				slog.Error("Scraper failed", "source", n, "error", err)
+			}
+		}
+		return nil
+	}
+
+	s, ok := sources[name]
+	if !ok {
+		return fmt.Errorf("unknown scraper source %q, expected one of %v or all", name, SourceNames())
+	}
+	return scrapeSource(db, s, opts)
+}
+
+func scrapeSource(db *pgxpool.Pool, s Source, opts Options) error {
+	ctx := context.Background()
+
+	progress, err := startRun(ctx, db, s.Name(), opts.Restart, opts.Offline)
+	if err != nil {
+		return fmt.Errorf("starting scrape run: %w", err)
+	}
+	slog.Info("Starting scraper", "source", s.Name(), "run", progress.ID, "startPage", progress.LastCompletedPage+1, "offline", opts.Offline)
+
+	cacheDir := opts.CacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join("./.cache", s.Name())
+	}
 	apiC := colly.NewCollector(
-		colly.CacheDir("./.cache/fashionpass"),
+		colly.CacheDir(cacheDir),
 	)
 
-	apiC.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: 1, Delay: 1 * time.Second})
+	apiC.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: 1, Delay: opts.Delay})
+
+	if opts.Offline {
+		apiC.WithTransport(offlineTransport{})
+	} else if opts.Transport != nil {
+		apiC.WithTransport(opts.Transport)
+	}
 
 	imgC := apiC.Clone()
 
 	imgC.OnResponse(func(r *colly.Response) {
-		name := filepath.Base(r.Request.URL.Path)
-
-		err := r.Save("./images/" + name)
+		_, err := images.Save(ctx, db, r.Request.URL.String(), r.Body)
 		if err != nil {
-			slog.Error("Failed to save image", "error", err)
+			slog.Error("Failed to save image", "url", r.Request.URL, "error", err)
 		}
 	})
 
-	fashionPassTagIds := map[int]string{}
+	// set by the response handler for the page currently being visited
+	var page *Page
+	var parseErr error
 
 	apiC.OnResponse(func(r *colly.Response) {
-		j := FashionPassResponse{}
-		json.Unmarshal(r.Body, &j)
+		page, parseErr = s.Parse(r.Request.URL, r.Body)
+	})
 
-		tags := []string{}
-		for _, t := range j.ProductList.TagList {
-			tags = append(tags, t.WebsiteText)
-			fashionPassTagIds[t.TagId] = t.WebsiteText
-		}
-		_, err := models.GetDb().Exec(context.Background(), "INSERT INTO tag (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING", tags)
-		if err != nil {
-			slog.Error("Failed to insert tags", "error", err)
+	totalPages := 0
+	visited := 0
+	status := "completed"
+	// stopped before the last page, so missing items may just not be cached
+	partial := false
+	var runErr error
+
+	for pageNum := progress.LastCompletedPage + 1; totalPages == 0 || pageNum <= totalPages; pageNum++ {
+		if opts.MaxPages > 0 && visited == opts.MaxPages {
+			status = "paused"
+			break
 		}
 
-		vendors := []string{}
-		for _, v := range j.ProductList.VendorList {
-			vendors = append(vendors, v)
+		pageURL := s.PageURL(pageNum)
+		slog.Info("Visiting", "source", s.Name(), "page", pageNum, "url", pageURL)
+
+		page, parseErr = nil, nil
+		if err := apiC.Visit(pageURL); errors.Is(err, ErrNotCached) {
+			slog.Info("Reached the end of the cache", "source", s.Name(), "page", pageNum)
+			partial = true
+			break
+		} else if err != nil {
+			status, runErr = "failed", fmt.Errorf("visiting page %d: %w", pageNum, err)
+			break
 		}
-		_, err = models.GetDb().Exec(context.Background(), "INSERT INTO brand (name) SELECT unnest($1::text[]) ON CONFLICT (name) DO NOTHING", vendors)
-		if err != nil {
-			slog.Error("Failed to insert vendors", "error", err)
+		if parseErr != nil {
+			status, runErr = "failed", fmt.Errorf("parsing page %d: %w", pageNum, parseErr)
+			break
 		}
-		for _, item := range j.ProductList.ResultItems {
-			images := []string{}
-			for _, img := range item.Images {
-				imgUrl := fmt.Sprintf("https://images.fashionpass.com/products/%s?profile=a", img)
-				images = append(images, imgUrl)
-				imgC.Visit(imgUrl)
-			}
+		visited++
 
-			tags := []string{}
-			for _, tagID := range item.Tags {
-				if tagName, ok := fashionPassTagIds[tagID]; ok {
-					tags = append(tags, tagName)
-				}
-			}
+		// sources that don't report a page count end at the first empty page
+		if page == nil || len(page.Products) == 0 {
+			break
+		}
+		totalPages = page.TotalPages
 
-			var baseID int64
-			err := models.GetDb().QueryRow(context.Background(), `
-				SELECT add_base_item($1, $2, $3, $4, $5, $6, $7);
-			`, item.Title, "", item.Vendor, item.ThumbnailImage, item.Images, item.AverageReviewRating, tags).Scan(&baseID)
-			if err != nil {
-				slog.Error("Failed to insert item", "error", err, "item", item)
+		stats := ingest(ctx, db, s.Name(), page)
+		for _, p := range page.Products {
+			imageURLs := p.ImageURLs
+			if p.ThumbnailURL != "" && !slices.Contains(imageURLs, p.ThumbnailURL) {
+				imageURLs = append([]string{p.ThumbnailURL}, imageURLs...)
 			}
-
-			for size, count := range item.Sizes {
-				var clothingID int64
-				err := models.GetDb().QueryRow(context.Background(), `
-				   SELECT add_clothing_item($1, $2);
-				`, baseID, size).Scan(&clothingID)
-				if err != nil {
-					slog.Error("Failed to insert clothing item", "error", err, "item", item, "size", size)
-				}
-
-				_, err = models.GetDb().Exec(context.Background(), `
-					SELECT api.transaction('audit', $1, $2);
-				`, clothingID, count)
-				if err != nil {
-					slog.Error("Failed to insert stock audit", "error", err, "item", item, "size", size)
+			for _, img := range imageURLs {
+				if err := imgC.Visit(img); errors.Is(err, ErrNotCached) {
+					slog.Debug("Image is not cached", "url", img)
 				}
 			}
 		}
-	})
 
-	u := url.URL{}
-	u.Host = "collections.fashionpass.com"
-	u.Scheme = "https"
-	u.Path = "/api/v1/collections/SearchByHandle2/clothing"
-	q := u.Query()
-	q.Set("items_per_page", "48")
-	q.Set("sort_by", "pos")
-	q.Set("sort_order", "desc")
-	q.Set("page", "1")
-	u.RawQuery = q.Encode()
+		if err := progress.completePage(ctx, db, pageNum, totalPages, stats); err != nil {
+			status, runErr = "failed", fmt.Errorf("recording progress: %w", err)
+			break
+		}
+		slog.Info("Page complete", "source", s.Name(), "page", pageNum, "totalPages", totalPages,
+			"seen", stats.Seen, "inserted", stats.Inserted, "updated", stats.Updated, "failed", stats.Failed)
+	}
 
-	fmt.Println("Visiting", u.String())
+	// an empty first page would otherwise discontinue the whole catalog
+	if status == "completed" && !partial && progress.Stats.Seen > 0 {
+		n, err := discontinueMissing(ctx, db, s.Name(), progress.StartedAt)
+		if err != nil {
+			slog.Error("Failed to mark missing items as discontinued", "source", s.Name(), "error", err)
+		} else if n > 0 {
+			slog.Info("Marked items discontinued", "source", s.Name(), "count", n)
+		}
+	}
 
-	err := apiC.Visit(u.String())
-	if err != nil {
-		slog.Error("Error visiting site", "error", err)
-		return
+	if err := progress.finish(ctx, db, status, runErr); err != nil {
+		slog.Error("Failed to record scrape run", "source", s.Name(), "run", progress.ID, "error", err)
 	}
 
-	// http.Get("https://collections.fashionpass.com/api/v1/collections/SearchByHandle2/clothing?items_per_page=48&sort_by=pos&sort_order=desc&page=33&show_hidden_items=3&exclude_tags=bump-photo&flex_size=&default_size=&sort_by_size=false&in_stock=0&in_stock_sizes=0&isprice_for_customer=false&isSub=false&new_inStockFlag=true&auto_hide=true&is_customer_subscribed=false")
+	slog.Info("Scrape run finished", "source", s.Name(), "run", progress.ID, "status", status,
+		"lastPage", progress.LastCompletedPage, "totalPages", totalPages, "seen", progress.Stats.Seen,
+		"inserted", progress.Stats.Inserted, "updated", progress.Stats.Updated, "failed", progress.Stats.Failed)
+	return runErr
 }
@@ -0,0 +1,207 @@
+package scraper
+
+import (
+	"clothes/config"
+	"clothes/images"
+	"clothes/models"
+	"context"
+	"net/url"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The responses shipped with the repo, relative to this package
+const testCacheDir = "../.cache/fashionpass"
+
+// Only page 1 of the listing is in the shipped cache
+const testCachedProducts = 48
+
+func parseCachedPage(t *testing.T, pageNum int) *Page {
+	t.Helper()
+	source := fashionPassSource{}
+	pageURL := source.PageURL(pageNum)
+
+	resp, err := readCachedResponse(testCacheDir, pageURL)
+	if err != nil {
+		t.Fatalf("reading cached page %d: %v", pageNum, err)
+	}
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := source.Parse(u, resp.Body)
+	if err != nil {
+		t.Fatalf("parsing cached page %d: %v", pageNum, err)
+	}
+	return page
+}
+
+func TestFashionPassParseCached(t *testing.T) {
+	page := parseCachedPage(t, 1)
+
+	if len(page.Products) != testCachedProducts {
+		t.Fatalf("parsed %d products, want %d", len(page.Products), testCachedProducts)
+	}
+	if page.TotalPages != 159 {
+		t.Errorf("TotalPages = %d, want 159", page.TotalPages)
+	}
+	if len(page.Brands) == 0 || len(page.Tags) == 0 {
+		t.Errorf("parsed %d brands and %d tags, want some of each", len(page.Brands), len(page.Tags))
+	}
+
+	p := page.Products[0]
+	if p.SourceID != "10816" || p.Name != "HARMONY SWEATER" || p.Brand != "Free People" {
+		t.Errorf("first product is %s %q by %q, want 10816 \"HARMONY SWEATER\" by \"Free People\"", p.SourceID, p.Name, p.Brand)
+	}
+	if p.ListPrice != 198 || p.SalePrice != 0 || p.Cost != 72.09 || p.Currency != "USD" {
+		t.Errorf("first product prices are list %v, sale %v, cost %v %s, want 198, 0, 72.09 USD", p.ListPrice, p.SalePrice, p.Cost, p.Currency)
+	}
+	if p.Sizes["S"] != 24 || p.Sizes["XL"] != 1 || len(p.Sizes) != 5 {
+		t.Errorf("first product sizes = %v, want 5 sizes with S:24 and XL:1", p.Sizes)
+	}
+	if !slices.Contains(p.Tags, "Sweaters & Knits") {
+		t.Errorf("first product tags %v do not include \"Sweaters & Knits\"", p.Tags)
+	}
+	if p.ThumbnailURL == "" || len(p.ImageURLs) != 4 {
+		t.Errorf("first product has thumbnail %q and %d images, want a thumbnail and 4", p.ThumbnailURL, len(p.ImageURLs))
+	}
+}
+
+/*
+Connects to the database in CLOTHES_TEST_DATABASE_URL and brings it up to
+date, skipping the test when it is not set.  The working directory moves to
+the repo root, where the migrations are.  Scraped rows are left behind, so
+the database should be one kept for tests.
+*/
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dsn := os.Getenv("CLOTHES_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("CLOTHES_TEST_DATABASE_URL is not set")
+	}
+
+	t.Chdir("..")
+	images.Dir = t.TempDir()
+
+	ctx := context.Background()
+	if err := models.Connect(ctx, config.Database{DSN: dsn}); err != nil {
+		t.Fatalf("connecting to the test database: %v", err)
+	}
+	t.Cleanup(models.Close)
+	if err := models.MigrateUp(ctx); err != nil {
+		t.Fatalf("migrating the test database: %v", err)
+	}
+	return models.GetDb()
+}
+
+// Latest run of the source, offline or not
+func lastRun(t *testing.T, db *pgxpool.Pool) (id int, status string, lastPage int, seen int, offline bool) {
+	t.Helper()
+	err := db.QueryRow(context.Background(), `
+		SELECT scrape_run_id, status, last_completed_page, items_seen, offline
+		FROM scrape_run
+		WHERE source = 'fashionpass'
+		ORDER BY scrape_run_id DESC
+		LIMIT 1
+	`).Scan(&id, &status, &lastPage, &seen, &offline)
+	if err != nil {
+		t.Fatalf("reading the last scrape run: %v", err)
+	}
+	return
+}
+
+func TestScrapeReplay(t *testing.T) {
+	// parsed before testDB moves the working directory
+	want := parseCachedPage(t, 1)
+	db := testDB(t)
+	ctx := context.Background()
+
+	srv := newReplayServer(t, ".cache/fashionpass")
+	err := Scrape(db, "fashionpass", Options{
+		MaxPages:  1,
+		Restart:   true,
+		CacheDir:  t.TempDir(),
+		Transport: srv.Transport(),
+	})
+	if err != nil {
+		t.Fatalf("scraping: %v", err)
+	}
+
+	_, status, lastPage, seen, offline := lastRun(t, db)
+	if status != "paused" || lastPage != 1 || seen != testCachedProducts || offline {
+		t.Errorf("run is %s after page %d having seen %d, offline %v, want paused after page 1 having seen %d online", status, lastPage, seen, offline, testCachedProducts)
+	}
+
+	for _, p := range want.Products {
+		var name, brand string
+		var baseItemID int
+		err := db.QueryRow(ctx, `
+			SELECT bi.base_item_id, bi.name, b.name
+			FROM base_item bi
+			JOIN brand b ON b.brand_id = bi.brand_id
+			WHERE bi.source = 'fashionpass' AND bi.source_id = $1
+		`, p.SourceID).Scan(&baseItemID, &name, &brand)
+		if err != nil {
+			t.Errorf("reading item %s: %v", p.SourceID, err)
+			continue
+		}
+		if name != p.Name || brand != p.Brand {
+			t.Errorf("item %s is %q by %q, want %q by %q", p.SourceID, name, brand, p.Name, p.Brand)
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT ic.basic_size::TEXT, inv.stock_quantity
+			FROM item i
+			JOIN item.clothing ic ON ic.item_id = i.item_id
+			JOIN inventory inv ON inv.item_id = i.item_id
+			WHERE i.base_item_id = $1
+		`, baseItemID)
+		if err != nil {
+			t.Fatalf("reading stock of item %s: %v", p.SourceID, err)
+		}
+		stock := map[string]uint{}
+		for rows.Next() {
+			var size string
+			var quantity int
+			if err := rows.Scan(&size, &quantity); err != nil {
+				t.Fatal(err)
+			}
+			if quantity != 0 {
+				stock[size] = uint(quantity)
+			}
+		}
+		rows.Close()
+
+		for size, count := range p.Sizes {
+			if count != 0 && stock[size] != count {
+				t.Errorf("item %s size %s has %d in stock, want %d", p.SourceID, size, stock[size], count)
+			}
+		}
+	}
+}
+
+func TestOfflineRunIsNotResumed(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+
+	if err := Scrape(db, "fashionpass", Options{Offline: true}); err != nil {
+		t.Fatalf("scraping offline: %v", err)
+	}
+
+	offlineID, status, lastPage, _, offline := lastRun(t, db)
+	if !offline || status != "completed" || lastPage != 1 {
+		t.Errorf("offline run is %s after page %d, offline %v, want completed after page 1", status, lastPage, offline)
+	}
+
+	next, err := startRun(ctx, db, "fashionpass", false, false)
+	if err != nil {
+		t.Fatalf("starting an online run: %v", err)
+	}
+	defer next.finish(ctx, db, "failed", nil)
+	if next.ID == offlineID {
+		t.Errorf("online run resumed offline run %d", offlineID)
+	}
+}
@@ -0,0 +1,104 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalid = errors.New("the link is not valid")
+	ErrExpired = errors.New("the link has expired")
+)
+
+var key []byte
+
+// Sets the key tokens are signed with, called once at startup.  An empty key
+// gets a random one, so tokens stop working when the process restarts.
+func Use(secret string) (random bool, err error) {
+	if secret != "" {
+		key = []byte(secret)
+		return false, nil
+	}
+	key = make([]byte, 32)
+	_, err = rand.Read(key)
+	return true, err
+}
+
+type envelope struct {
+	Expires int64           `json:"exp"`
+	Claims  json.RawMessage `json:"claims"`
+}
+
+func mac(purpose, payload string) []byte {
+	h := hmac.New(sha256.New, key)
+	// the purpose keeps a token made for one thing from being used for another
+	h.Write([]byte(purpose))
+	h.Write([]byte{0})
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
+
+// A url safe MAC of parts for purpose, for values that only need checking
+// against a fresh computation rather than decoding
+func Tag(purpose string, parts ...string) string {
+	return base64.RawURLEncoding.EncodeToString(mac(purpose, strings.Join(parts, "\x00")))
+}
+
+/*
+Signs claims into a url safe token that Verify accepts until expires.  The
+claims are readable by anyone holding the token, only tampering is
+prevented, so they should not be secret.
+*/
+func Sign(purpose string, claims any, expires time.Time) (string, error) {
+	if len(key) == 0 {
+		return "", errors.New("no signing key is configured")
+	}
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(envelope{Expires: expires.Unix(), Claims: raw})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(body)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac(purpose, payload)), nil
+}
+
+// Checks a token from Sign made for the same purpose and reads its claims
+func Verify(purpose, token string, claims any) error {
+	if len(key) == 0 {
+		return errors.New("no signing key is configured")
+	}
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrInvalid
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sum, mac(purpose, payload)) {
+		return ErrInvalid
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ErrInvalid
+	}
+	var e envelope
+	if err := json.Unmarshal(body, &e); err != nil {
+		return ErrInvalid
+	}
+	if time.Now().Unix() >= e.Expires {
+		return ErrExpired
+	}
+	if err := json.Unmarshal(e.Claims, claims); err != nil {
+		return ErrInvalid
+	}
+	return nil
+}
@@ -282,6 +282,7 @@ export class AddToClosetButton extends LitElement {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
+        "X-CSRF-Token": document.querySelector('meta[name="csrf-token"]')?.content ?? "",
       },
       body: JSON.stringify({
         closet_name: closetName,
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"clothes/models"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// Long enough to be safe to hand to someone once and have them change it
+func generatePassword() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func runUser(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: user create|promote|demote|reset-password|list")
+	}
+
+	switch args[0] {
+	case "create":
+		return runUserCreate(args[1:])
+	case "promote":
+		return runUserSetRole("promote", true, args[1:])
+	case "demote":
+		return runUserSetRole("demote", false, args[1:])
+	case "reset-password":
+		return runUserResetPassword(args[1:])
+	case "list":
+		return runUserList(args[1:])
+	default:
+		return fmt.Errorf("unknown user command %q, expected create, promote, demote, reset-password or list", args[0])
+	}
+}
+
+func runUserCreate(args []string) error {
+	fs := flag.NewFlagSet("user create", flag.ExitOnError)
+	username := fs.String("username", "", "Username (required)")
+	email := fs.String("email", "", "Email address (required)")
+	firstName := fs.String("first-name", "", "First name")
+	lastName := fs.String("last-name", "", "Last name")
+	password := fs.String("password", "", "Password, a random one is generated and printed when empty")
+	staff := fs.Bool("staff", false, "Make the account staff")
+	admin := fs.Bool("admin", false, "Make the account an admin")
+	if _, err := setup(fs, args); err != nil {
+		return err
+	}
+	defer models.Close()
+
+	if *username == "" || *email == "" {
+		return fmt.Errorf("usage: user create -username NAME -email ADDRESS [flags]")
+	}
+
+	generated := *password == ""
+	if generated {
+		*password = generatePassword()
+	}
+
+	// accounts made here are trusted, there is no one to click a link
+	_, err := models.ApiQuery[any](context.Background(), "site_user_create", *firstName, *lastName, *username, *email, *password, *staff, *admin, true)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created %s\n", *username)
+	if generated {
+		fmt.Printf("Password: %s\n", *password)
+	}
+	return nil
+}
+
+func runUserSetRole(name string, enabled bool, args []string) error {
+	fs := flag.NewFlagSet("user "+name, flag.ExitOnError)
+	role := fs.String("role", "staff", "Role to change, staff or admin")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: user %s [flags] USERNAME\n", name)
+		fs.PrintDefaults()
+	}
+	if _, err := setup(fs, args); err != nil {
+		return err
+	}
+	defer models.Close()
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("a username is required")
+	}
+
+	_, err := models.ApiQuery[any](context.Background(), "site_user_set_role", fs.Arg(0), *role, enabled)
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		fmt.Printf("%s is now %s\n", fs.Arg(0), *role)
+	} else {
+		fmt.Printf("%s is no longer %s\n", fs.Arg(0), *role)
+	}
+	return nil
+}
+
+func runUserResetPassword(args []string) error {
+	fs := flag.NewFlagSet("user reset-password", flag.ExitOnError)
+	password := fs.String("password", "", "New password, a random one is generated and printed when empty")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: user reset-password [flags] USERNAME")
+		fs.PrintDefaults()
+	}
+	if _, err := setup(fs, args); err != nil {
+		return err
+	}
+	defer models.Close()
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("a username is required")
+	}
+
+	generated := *password == ""
+	if generated {
+		*password = generatePassword()
+	}
+
+	_, err := models.ApiQuery[any](context.Background(), "site_user_set_password", fs.Arg(0), *password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Password changed for %s, their sessions were signed out\n", fs.Arg(0))
+	if generated {
+		fmt.Printf("Password: %s\n", *password)
+	}
+	return nil
+}
+
+func runUserList(args []string) error {
+	fs := flag.NewFlagSet("user list", flag.ExitOnError)
+	staffOnly := fs.Bool("staff", false, "Only list staff and admins")
+	if _, err := setup(fs, args); err != nil {
+		return err
+	}
+	defer models.Close()
+
+	users, err := models.ApiQuery[[]struct {
+		models.SiteUser
+		CreatedAt string `json:"created_at"`
+	}](context.Background(), "site_users", *staffOnly)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USERNAME\tEMAIL\tVERIFIED\tNAME\tROLE\tCREATED")
+	for _, u := range *users {
+		role := ""
+		switch {
+		case u.IsAdmin:
+			role = "admin"
+		case u.IsStaff:
+			role = "staff"
+		}
+		verified := "no"
+		if u.EmailVerified {
+			verified = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s %s\t%s\t%s\n", u.Username, u.Email, verified, u.FirstName, u.LastName, role, u.CreatedAt)
+	}
+	return tw.Flush()
+}
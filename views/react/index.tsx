@@ -2,6 +2,11 @@ import React from "react";
 import { createRoot } from "react-dom/client";
 import useSWR, { SWRConfig } from "swr";
 
+// The server rejects unsafe requests without the token from the page's meta tag
+function csrfToken(): string {
+    return document.querySelector<HTMLMetaElement>('meta[name="csrf-token"]')?.content ?? "";
+}
+
 async function fetcher(resource: string, init?: RequestInit) {
     const res = await fetch(resource, init);
     return res.json();
@@ -11,6 +16,7 @@ type ClosetItem = {
     base_item_name: string;
     brand_name?: string;
     thumbnail_url?: string;
+    thumbnail_hash?: string;
 };
 
 type Closet = {
@@ -29,10 +35,65 @@ type SiteUser = {
 
 type Order = {
     id: string;
-    date: string;
+    created_at: string;
     status: string;
-    total: string;
-    badges?: string[];
+    currency: string;
+    total: number;
+    item_count: number;
+};
+
+type RentalPlan = {
+    name: string;
+    items_at_a_time: number;
+    swaps_per_month: number | null;
+    currency: string;
+    monthly_price: number;
+};
+
+type Rental = {
+    id: number;
+    status: "out" | "returning" | "returned" | "lost";
+    item_name: string;
+    brand_name: string;
+    size: string;
+    due_at: string;
+    overdue: boolean;
+    thumbnail_hash?: string;
+};
+
+type Rentals = {
+    subscription: {
+        plan: RentalPlan;
+        period_end: string;
+        items_out: number;
+        slots_left: number;
+        swaps_left: number | null;
+    } | null;
+    rentals: Rental[];
+};
+
+const sizes = ["XS", "S", "M", "L", "XL", "XXL"];
+
+function formatDate(date: string) {
+    return new Date(date).toLocaleDateString(undefined, {
+        month: "short",
+        day: "numeric",
+        year: "numeric",
+    });
+}
+
+function formatMoney(currency: string, amount: number) {
+    return new Intl.NumberFormat(undefined, {
+        style: "currency",
+        currency,
+    }).format(amount);
+}
+
+const orderStatusLabels: Record<string, string> = {
+    pending: "Awaiting payment",
+    paid: "Processing",
+    fulfilled: "Shipped",
+    cancelled: "Cancelled",
 };
 
 function Hero() {
@@ -125,6 +186,13 @@ function ProfileCard({ user }: { user: SiteUser }) {
                         {user.isActive ? "Active" : "Inactive"}
                     </span>
                 </div>
+
+                <a
+                    href="/account/sessions"
+                    className="small text-decoration-none"
+                >
+                    Signed in devices →
+                </a>
             </div>
         </div>
     );
@@ -132,6 +200,8 @@ function ProfileCard({ user }: { user: SiteUser }) {
 
 function ClosetsCard({ closets }: { closets: Closet[] }) {
     const { data: swrClosets, mutate } = useSWR<Closet[]>("/api/user/closets");
+    const { mutate: mutateRentals } = useSWR<Rentals>("/api/user/rentals");
+    const [rentMessage, setRentMessage] = React.useState<string>();
     const displayClosets = swrClosets || closets;
     console.log(displayClosets);
 
@@ -146,6 +216,7 @@ function ClosetsCard({ closets }: { closets: Closet[] }) {
             method: "POST",
             headers: {
                 "Content-Type": "application/json",
+                "X-CSRF-Token": csrfToken(),
             },
             body: JSON.stringify({ closet_name: closetName }),
         });
@@ -165,6 +236,7 @@ function ClosetsCard({ closets }: { closets: Closet[] }) {
             method: "DELETE",
             headers: {
                 "Content-Type": "application/json",
+                "X-CSRF-Token": csrfToken(),
             },
             body: JSON.stringify({ closet_name: closetName }),
         });
@@ -177,6 +249,42 @@ function ClosetsCard({ closets }: { closets: Closet[] }) {
         }
     };
 
+    const handleRentCloset = async (
+        event: React.FormEvent<HTMLFormElement>,
+        closetName: string,
+    ) => {
+        event.preventDefault();
+        const formData = new FormData(event.currentTarget);
+
+        const res = await fetch("/api/user/closets/rent", {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+                "X-CSRF-Token": csrfToken(),
+            },
+            body: JSON.stringify({
+                closet_name: closetName,
+                size: formData.get("size"),
+            }),
+        });
+
+        if (res.ok) {
+            const result: {
+                rented: Rental[];
+                skipped: { item_name: string; reason: string }[];
+            } = await res.json();
+            setRentMessage(
+                [
+                    `Rented ${result.rented.length} items.`,
+                    ...result.skipped.map((s) => `${s.item_name}: ${s.reason}`),
+                ].join(" "),
+            );
+            await mutateRentals?.();
+        } else {
+            setRentMessage(await res.text());
+        }
+    };
+
     return (
         <div className="card border-0 shadow-sm rounded-4 mt-4">
             <div className="card-body p-4">
@@ -205,6 +313,13 @@ function ClosetsCard({ closets }: { closets: Closet[] }) {
                         </button>
                     </form>
                 </div>
+                {rentMessage
+                    ? (
+                        <div className="alert alert-info small" role="alert">
+                            {rentMessage}
+                        </div>
+                    )
+                    : null}
                 <div className="accordion" id="accordionExample">
                     {displayClosets.map((c) => (
                         <div className="accordion-item" key={c.name}>
@@ -235,6 +350,29 @@ function ClosetsCard({ closets }: { closets: Closet[] }) {
                                     >
                                         Delete
                                     </button>
+                                    <form
+                                        className="d-flex gap-2 mb-3"
+                                        onSubmit={(event) =>
+                                            handleRentCloset(event, c.name)}
+                                    >
+                                        <select
+                                            className="form-select form-select-sm w-auto"
+                                            name="size"
+                                            aria-label="Size"
+                                            defaultValue="M"
+                                        >
+                                            {sizes.map((size) => (
+                                                <option key={size}>{size}</option>
+                                            ))}
+                                        </select>
+                                        <button
+                                            type="submit"
+                                            className="btn btn-primary btn-sm"
+                                            disabled={c.items.length === 0}
+                                        >
+                                            Rent from this closet
+                                        </button>
+                                    </form>
                                     {c.items.map((it, idx) => (
                                         <div
                                             className="mb-2 d-flex align-items-center gap-3"
@@ -243,7 +381,9 @@ function ClosetsCard({ closets }: { closets: Closet[] }) {
                                             {it.thumbnail_url
                                                 ? (
                                                     <img
-                                                        src={`/static/images/${it.thumbnail_url}`}
+                                                        src={it.thumbnail_hash
+                                                            ? `/images/${it.thumbnail_hash}/thumb`
+                                                            : `/static/images/${it.thumbnail_url}`}
                                                         alt={it.base_item_name}
                                                         className="img-fluid"
                                                         style={{ maxWidth: 64 }}
@@ -275,31 +415,89 @@ function ClosetsCard({ closets }: { closets: Closet[] }) {
 }
 
 function MembershipCard() {
+    const { data: rentals, mutate } = useSWR<Rentals>("/api/user/rentals");
+    const { data: plans } = useSWR<RentalPlan[]>("/api/rental_plans");
+    const subscription = rentals?.subscription;
+
+    const handleSubscribe = async (plan: string) => {
+        const res = await fetch("/api/user/subscription", {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+                "X-CSRF-Token": csrfToken(),
+            },
+            body: JSON.stringify({ plan }),
+        });
+
+        if (res.ok) {
+            await mutate(await res.json(), { revalidate: false });
+        } else {
+            console.error("Failed to subscribe", await res.text());
+        }
+    };
+
     return (
         <div className="card border-0 shadow-sm rounded-4 mt-4">
             <div className="card-body p-4">
                 <h2 className="h6 fw-semibold mb-1">Membership</h2>
                 <p className="small text-muted mb-3">Current plan and perks</p>
 
-                <div className="small">
-                    <div className="d-flex justify-content-between">
-                        <span className="text-muted">Plan</span>
-                        <span className="fw-semibold">Essential (Demo)</span>
-                    </div>
-                    <div className="d-flex justify-content-between mt-2">
-                        <span className="text-muted">Next billing</span>
-                        <span className="fw-semibold">April 15, 2025</span>
-                    </div>
-                    <div className="d-flex justify-content-between mt-2">
-                        <span className="text-muted">Shipping</span>
-                        <span className="fw-semibold">Same-day eligible</span>
-                    </div>
-                </div>
+                {subscription
+                    ? (
+                        <div className="small">
+                            <div className="d-flex justify-content-between">
+                                <span className="text-muted">Plan</span>
+                                <span className="fw-semibold">
+                                    {subscription.plan.name} ·{" "}
+                                    {formatMoney(
+                                        subscription.plan.currency,
+                                        subscription.plan.monthly_price,
+                                    )}/mo
+                                </span>
+                            </div>
+                            <div className="d-flex justify-content-between mt-2">
+                                <span className="text-muted">Items out</span>
+                                <span className="fw-semibold">
+                                    {subscription.items_out} of{" "}
+                                    {subscription.plan.items_at_a_time}
+                                </span>
+                            </div>
+                            <div className="d-flex justify-content-between mt-2">
+                                <span className="text-muted">
+                                    Swaps left this month
+                                </span>
+                                <span className="fw-semibold">
+                                    {subscription.swaps_left ?? "Unlimited"}
+                                </span>
+                            </div>
+                            <div className="d-flex justify-content-between mt-2">
+                                <span className="text-muted">Next billing</span>
+                                <span className="fw-semibold">
+                                    {formatDate(subscription.period_end)}
+                                </span>
+                            </div>
+                        </div>
+                    )
+                    : (
+                        <div className="d-grid gap-2">
+                            {(plans || []).map((p) => (
+                                <button
+                                    key={p.name}
+                                    className="btn btn-outline-primary text-start"
+                                    onClick={() => handleSubscribe(p.name)}
+                                >
+                                    <span className="fw-semibold">
+                                        {p.name}
+                                    </span>{" "}
+                                    · {p.items_at_a_time} at a time ·{" "}
+                                    {formatMoney(p.currency, p.monthly_price)}
+                                    /mo
+                                </button>
+                            ))}
+                        </div>
+                    )}
 
                 <div className="d-grid gap-2 mt-4">
-                    <a href="/pricing" className="btn btn-primary">
-                        Manage membership
-                    </a>
                     <a href="/help" className="btn btn-outline-secondary">
                         Help & support
                     </a>
@@ -309,83 +507,129 @@ function MembershipCard() {
     );
 }
 
-function CurrentShipmentCard() {
+function CurrentRentalsCard() {
+    const { data: rentals, mutate } = useSWR<Rentals>("/api/user/rentals");
+    const open = (rentals?.rentals || []).filter((r) =>
+        r.status === "out" || r.status === "returning"
+    );
+
+    const handleReturn = async (rentalId: number) => {
+        const res = await fetch(`/api/user/rentals/${rentalId}/return`, {
+            method: "POST",
+            headers: {
+                "X-CSRF-Token": csrfToken(),
+            },
+        });
+
+        if (res.ok) {
+            await mutate?.();
+        } else {
+            console.error("Failed to start return", await res.text());
+        }
+    };
+
     return (
         <div className="card border-0 shadow-lg rounded-4">
             <div className="card-body p-4 p-lg-5">
-                <div className="d-flex flex-column flex-md-row justify-content-between align-items-md-start gap-3">
-                    <div>
-                        <p className="small text-uppercase text-secondary mb-1">
-                            In progress
-                        </p>
-                        <h2 className="h4 fw-bold mb-1">
-                            Your current shipment
-                        </h2>
-                        <p className="text-muted mb-0">
-                            Track delivery and return status.
-                        </p>
-                    </div>
-                    <a
-                        href="/account/orders"
-                        className="small text-decoration-none"
-                    >
-                        View all orders →
-                    </a>
+                <div>
+                    <p className="small text-uppercase text-secondary mb-1">
+                        In progress
+                    </p>
+                    <h2 className="h4 fw-bold mb-1">Your rentals</h2>
+                    <p className="text-muted mb-0">
+                        Send items back to free up room for your next swap.
+                    </p>
                 </div>
 
                 <hr className="my-4" />
 
-                <div className="row g-3 align-items-center">
-                    <div className="col-md-7">
-                        <div className="d-flex flex-wrap gap-2 mb-2">
-                            <span className="badge text-bg-primary-subtle text-primary-emphasis">
-                                Order #FP-123456
-                            </span>
-                            <span className="badge text-bg-light text-dark">
-                                Out for delivery
-                            </span>
-                            <span className="badge text-bg-warning-subtle text-warning-emphasis">
-                                Same-day
-                            </span>
-                        </div>
+                {open.length === 0
+                    ? (
+                        <p className="small text-muted mb-0">
+                            Nothing is out with you. Rent from one of your
+                            closets to get started.
+                        </p>
+                    )
+                    : null}
 
-                        <div className="small text-muted">
-                            <div>
-                                <span className="fw-semibold text-dark">
-                                    Delivery:
-                                </span>{" "}
-                                Today · 4–8 PM
+                {open.map((r) => (
+                    <div
+                        className="d-flex align-items-center gap-3 mb-3"
+                        key={r.id}
+                    >
+                        {r.thumbnail_hash
+                            ? (
+                                <img
+                                    src={`/images/${r.thumbnail_hash}/thumb`}
+                                    alt={r.item_name}
+                                    className="img-fluid"
+                                    style={{ maxWidth: 64 }}
+                                />
+                            )
+                            : null}
+                        <div className="flex-grow-1">
+                            <div className="fw-semibold">{r.item_name}</div>
+                            <div className="small text-muted">
+                                {r.brand_name} · Size {r.size}
                             </div>
-                            <div className="mt-1">
-                                <span className="fw-semibold text-dark">
-                                    Return by:
-                                </span>{" "}
-                                March 28, 2025
+                            <div className="small">
+                                {r.status === "returning"
+                                    ? (
+                                        <span className="badge text-bg-light text-dark">
+                                            On its way back
+                                        </span>
+                                    )
+                                    : (
+                                        <span
+                                            className={r.overdue
+                                                ? "text-danger"
+                                                : "text-muted"}
+                                        >
+                                            Return by {formatDate(r.due_at)}
+                                        </span>
+                                    )}
                             </div>
                         </div>
+                        {r.status === "out"
+                            ? (
+                                <button
+                                    className="btn btn-outline-secondary btn-sm"
+                                    onClick={() => handleReturn(r.id)}
+                                >
+                                    Start a return
+                                </button>
+                            )
+                            : null}
                     </div>
-
-                    <div className="col-md-5">
-                        <div className="d-grid gap-2">
-                            <a href="#" className="btn btn-primary">
-                                Track shipment
-                            </a>
-                            <a href="#" className="btn btn-outline-secondary">
-                                Start a return
-                            </a>
-                        </div>
-                    </div>
-                </div>
+                ))}
             </div>
         </div>
     );
 }
 
-function RecentOrdersCard({ orders }: { orders: Order[] }) {
+function RecentOrdersCard() {
+    const { data: orders } = useSWR<Order[]>("/api/user/orders");
+
     return (
         <div className="card border-0 shadow-sm rounded-4 mt-4">
             <div className="card-body p-4">
-                <h2 className="h5 fw-semibold mb-3">Recent orders</h2>
+                <div className="d-flex justify-content-between align-items-baseline mb-3">
+                    <h2 className="h5 fw-semibold mb-0">Recent orders</h2>
+                    <a
+                        href="/account/orders"
+                        className="small text-decoration-none"
+                    >
+                        View all orders →
+                    </a>
+                </div>
+
+                {orders && orders.length === 0
+                    ? (
+                        <p className="small text-muted mb-0">
+                            You have not placed any orders yet.
+                        </p>
+                    )
+                    : null}
 
                 <div className="table-responsive">
                     <table className="table align-middle mb-0">
@@ -398,19 +642,24 @@ function RecentOrdersCard({ orders }: { orders: Order[] }) {
                             </tr>
                         </thead>
                         <tbody>
-                            {orders.map((o) => (
+                            {(orders || []).slice(0, 5).map((o) => (
                                 <tr key={o.id}>
-                                    <td className="fw-semibold">#{o.id}</td>
+                                    <td className="fw-semibold">
+                                        <a href={`/account/orders/${o.id}`}>
+                                            #{o.id}
+                                        </a>
+                                    </td>
                                     <td className="small text-muted">
-                                        {o.date}
+                                        {formatDate(o.created_at)}
                                     </td>
                                     <td>
                                         <span className="badge text-bg-light text-dark">
-                                            {o.status}
+                                            {orderStatusLabels[o.status] ??
+                                                o.status}
                                         </span>
                                     </td>
                                     <td className="text-end fw-semibold">
-                                        {o.total}
+                                        {formatMoney(o.currency, o.total)}
                                     </td>
                                 </tr>
                             ))}
@@ -426,7 +675,6 @@ function App() {
     // fetch data from API endpoints here
     useSWR<SiteUser>("/api/user");
     useSWR<Closet[]>("/api/closets");
-    useSWR<Order[]>("/api/orders");
 
     // Static dummy data based on the provided template
     const user: SiteUser = {
@@ -467,21 +715,6 @@ function App() {
         },
     ];
 
-    const orders: Order[] = [
-        {
-            id: "FP-123102",
-            date: "Mar 2, 2025",
-            status: "Returned",
-            total: "$59",
-        },
-        {
-            id: "FP-122884",
-            date: "Feb 18, 2025",
-            status: "Completed",
-            total: "$49",
-        },
-    ];
-
     return (
         <>
             <Hero />
@@ -494,8 +727,8 @@ function App() {
                     </div>
 
                     <div className="col-lg-8">
-                        <CurrentShipmentCard />
-                        <RecentOrdersCard orders={orders} />
+                        <CurrentRentalsCard />
+                        <RecentOrdersCard />
                     </div>
                 </div>
             </div>
@@ -14,6 +14,9 @@ type PageData struct {
 	SiteUser *models.SiteUser
 	Title    string
 	Data     any
+	// Sent back by forms through csrfField and by fetch calls from the
+	// csrf-token meta tag
+	CSRFToken string
 }
 
 const layoutFile string = "views/base-page.gohtml"
@@ -31,20 +34,22 @@ func RenderPage(page string, w http.ResponseWriter, pageData PageData) {
 	}
 	templateFiles = append(templateFiles, widgetFiles...)
 
-	tmpl, err := template.ParseFiles(templateFiles...)
-	if err != nil {
-		slog.Error("Error loading templates:", slog.Any("err", err))
-		http.Error(w, "Error loading templates", http.StatusInternalServerError)
-		return
-	}
-
 	funcs := template.FuncMap{
 		"repeat": func(n int) []struct{} {
 			return make([]struct{}, n)
 		},
+		// goes inside every POST form
+		"csrfField": func() string {
+			return `<input type="hidden" name="csrf_token" value="` + template.HTMLEscapeString(pageData.CSRFToken) + `">`
+		},
 	}
 
-	tmpl = tmpl.Funcs(funcs)
+	tmpl, err := template.New(filepath.Base(layoutFile)).Funcs(funcs).ParseFiles(templateFiles...)
+	if err != nil {
+		slog.Error("Error loading templates:", slog.Any("err", err))
+		http.Error(w, "Error loading templates", http.StatusInternalServerError)
+		return
+	}
 
 	if err := tmpl.Execute(w, pageData); err != nil {
 		http.Error(w, "Error rendering template", http.StatusInternalServerError)
@@ -22,11 +22,109 @@ type Alert struct {
 }
 
 type ItemCard struct {
-	ItemName string
-	Brand    string
-	ImageURL string
-	ImageAlt string
-	Href     string
+	ItemName    string
+	Brand       string
+	ImageURL    string
+	ImageSrcset string
+	ImageAlt    string
+	Href        string
+	Price       *Price
+}
+
+// One line of the cart page
+type CartLine struct {
+	ItemID      int
+	ItemName    string
+	Brand       string
+	Size        string
+	Href        string
+	ImageURL    string
+	ImageSrcset string
+	Quantity    int
+	// Most that can be ordered right now
+	StockQuantity int
+	Available     bool
+	Price         *Price
+	LineTotal     string
+}
+
+type Order struct {
+	Number        string
+	Href          string
+	Status        string
+	Date          string
+	ItemCount     int
+	Subtotal      string
+	Total         string
+	ShipToName    string
+	ShipToAddress string
+	Cancellable   bool
+	Lines         []OrderLine
+	History       []OrderStatusChange
+}
+
+type OrderLine struct {
+	ItemName    string
+	Brand       string
+	Size        string
+	Href        string
+	ImageURL    string
+	ImageSrcset string
+	Quantity    int
+	UnitPrice   string
+	LineTotal   string
+}
+
+type OrderStatusChange struct {
+	Status string
+	Note   string
+	Date   string
+}
+
+type Image struct {
+	URL    string
+	Srcset string
+}
+
+// A checkbox or radio button in the browse filter sidebar
+type FilterOption struct {
+	Value   string
+	Label   string
+	Count   int
+	Checked bool
+}
+
+// Query parameters the filter form passes through untouched
+type HiddenField struct {
+	Name  string
+	Value string
+}
+
+type BrowseFilters struct {
+	Action    string
+	Hidden    []HiddenField
+	Brands    []FilterOption
+	Sizes     []FilterOption
+	Ratings   []FilterOption
+	InStock   FilterOption
+	MinPrice  string
+	MaxPrice  string
+	PriceLow  string
+	PriceHigh string
+	// Set when any filter is applied
+	ClearHref string
+}
+
+type SortOption struct {
+	Label  string
+	Href   string
+	Active bool
+}
+
+type SortMenu struct {
+	// Label of the current sort
+	Label   string
+	Options []SortOption
 }
 
 type MoreLike struct {
@@ -73,6 +171,56 @@ func (p Pageination) PagesAvailable() []pageinationData {
 	return pages
 }
 
+type Price struct {
+	Currency  string
+	Price     float64
+	ListPrice float64
+}
+
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"CAD": "CA$",
+	"AUD": "A$",
+	"EUR": "€",
+	"GBP": "£",
+}
+
+// Formats an amount with the symbol of its currency, or its code when the
+// symbol is not known
+func FormatMoney(currency string, amount float64) string {
+	if symbol, ok := currencySymbols[currency]; ok {
+		return fmt.Sprintf("%s%.2f", symbol, amount)
+	}
+	return fmt.Sprintf("%.2f %s", amount, currency)
+}
+
+func (p Price) OnSale() bool {
+	return p.Price < p.ListPrice
+}
+
+func (p Price) Current() string {
+	return FormatMoney(p.Currency, p.Price)
+}
+
+func (p Price) List() string {
+	return FormatMoney(p.Currency, p.ListPrice)
+}
+
+func (p Price) PercentOff() int {
+	if p.ListPrice <= 0 {
+		return 0
+	}
+	return int(math.Round((p.ListPrice - p.Price) / p.ListPrice * 100))
+}
+
+// A past or current price and when it applied
+type PriceChange struct {
+	Price Price
+	From  string
+	// Empty for the current price
+	To string
+}
+
 type Rating struct {
 	Rating float64
 	Max    int
@@ -76,6 +76,7 @@ export class AddToClosetButton extends LitElement {
             method: "POST",
             headers: {
                 "Content-Type": "application/json",
+                "X-CSRF-Token": document.querySelector<HTMLMetaElement>('meta[name="csrf-token"]')?.content ?? "",
             },
             body: JSON.stringify({
                 closet_name: closetName,